@@ -0,0 +1,531 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The v2 API is the stable one. Unlike v1, which hands out whatever the pages
+// are built from, its resources are made for it: snake_case keys, RFC 3339
+// timestamps in UTC, lists paged with cursors and errors with a code. It is
+// described by openapi/v2.json, which must be kept in step with this file.
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	// DefaultPageLimit is how many items a page of a list has when not asked.
+	DefaultPageLimit = 50
+	// MaxPageLimit is the most items a page of a list can have.
+	MaxPageLimit = 500
+)
+
+// V2Error is the body of every error response of the v2 API.
+type V2Error struct {
+	Error V2ErrorDetail `json:"error"`
+}
+
+type V2ErrorDetail struct {
+	// Code is one of invalid_parameter, unauthorized, forbidden, not_found,
+	// method_not_allowed and internal.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Param is the parameter that was wrong, for invalid_parameter.
+	Param string `json:"param,omitempty"`
+}
+
+// V2Page is a page of a list. NextCursor is set when there is more, and is
+// given as the cursor parameter to get it.
+type V2Page struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+type V2Follow struct {
+	Language string `json:"language"`
+}
+
+// V2Feed is the list of a language and period.
+type V2Feed struct {
+	Language       string     `json:"language"`
+	Period         string     `json:"period"`
+	LatestScrapeAt *time.Time `json:"latest_scrape_at"`
+	Items          []V2Item   `json:"items,omitempty"`
+}
+
+type V2Item struct {
+	Rank          int    `json:"rank"`
+	Owner         string `json:"owner"`
+	Name          string `json:"name"`
+	Description   string `json:"description"`
+	RepoLanguage  string `json:"repo_language"`
+	Stars         int    `json:"stars"`
+	StarsIncrease int    `json:"stars_increase"`
+	Forks         int    `json:"forks"`
+}
+
+// V2Scrape is a scrape of a language. Periods is only set when a single
+// scrape is asked for.
+type V2Scrape struct {
+	Language  string              `json:"language"`
+	ScrapedAt time.Time           `json:"scraped_at"`
+	Periods   map[string][]V2Item `json:"periods,omitempty"`
+}
+
+type V2Repo struct {
+	Owner       string    `json:"owner"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Language    string    `json:"language"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+}
+
+type V2Run struct {
+	ID int `json:"id"`
+	// Status is running, succeeded or failed.
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	Languages  []string   `json:"languages"`
+	Error      string     `json:"error,omitempty"`
+}
+
+func v2Items(tis []TrendingItem) []V2Item {
+	its := make([]V2Item, len(tis))
+	for i, ti := range tis {
+		its[i] = V2Item{
+			Rank:          i + 1,
+			Owner:         ti.RepoOwner,
+			Name:          ti.RepoName,
+			Description:   ti.Description,
+			RepoLanguage:  ti.Language,
+			Stars:         ti.Stars,
+			StarsIncrease: ti.StarsIncrease,
+			Forks:         ti.Forks,
+		}
+	}
+	return its
+}
+
+func v2RepoOf(ri RepoInfo) V2Repo {
+	return V2Repo{
+		Owner:       ri.Owner,
+		Name:        ri.Name,
+		Description: ri.Description,
+		Language:    ri.Language,
+		LastSeenAt:  ri.LastSeen.UTC(),
+	}
+}
+
+func v2RunOf(r Run) V2Run {
+	vr := V2Run{
+		ID:        r.ID,
+		Status:    "succeeded",
+		StartedAt: r.StartedAt,
+		Languages: r.Langs,
+		Error:     r.Error,
+	}
+	if vr.Languages == nil {
+		vr.Languages = []string{}
+	}
+	switch {
+	case r.FinishedAt.IsZero():
+		vr.Status = "running"
+	case r.Error != "":
+		vr.Status = "failed"
+	}
+	if !r.FinishedAt.IsZero() {
+		vr.FinishedAt = &r.FinishedAt
+	}
+	return vr
+}
+
+// v2Write responds with v as JSON.
+func v2Write(w http.ResponseWriter, code int, v interface{}) {
+	bb, err := json.Marshal(v)
+	if err != nil {
+		v2WriteError(w, http.StatusInternalServerError, V2ErrorDetail{Code: "internal", Message: "Couldn't serialize json: " + err.Error()})
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	w.Write(bb)
+}
+
+func v2WriteError(w http.ResponseWriter, code int, d V2ErrorDetail) {
+	bb, _ := json.Marshal(V2Error{Error: d})
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	w.Write(bb)
+}
+
+// v2Fail responds with the error, deciding from it whose fault it was.
+func v2Fail(w http.ResponseWriter, err error) {
+	var qe *QueryError
+	switch {
+	case errors.As(err, &qe):
+		v2WriteError(w, http.StatusBadRequest, V2ErrorDetail{Code: "invalid_parameter", Message: err.Error(), Param: qe.Param})
+	case err == ErrUnknownRepo, err == ErrUnknownRun, err == ErrNoScrapesForLang, err == ErrNoScrapesForPeriod:
+		v2WriteError(w, http.StatusNotFound, V2ErrorDetail{Code: "not_found", Message: err.Error()})
+	default:
+		v2WriteError(w, http.StatusInternalServerError, V2ErrorDetail{Code: "internal", Message: err.Error()})
+	}
+}
+
+func v2NotFound(w http.ResponseWriter, r *http.Request) {
+	v2WriteError(w, http.StatusNotFound, V2ErrorDetail{Code: "not_found", Message: "No such resource: " + r.URL.Path})
+}
+
+func v2MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	v2WriteError(w, http.StatusMethodNotAllowed, V2ErrorDetail{Code: "method_not_allowed", Message: "Method not allowed: " + r.Method})
+}
+
+// pageQuery is where a page of a list starts and how long it is.
+type pageQuery struct {
+	Limit int
+	// After is the key of the last item of the previous page.
+	After string
+}
+
+// parsePageQuery reads the limit and cursor query parameters.
+func parsePageQuery(r *http.Request) (pageQuery, error) {
+	qv := r.URL.Query()
+	pq := pageQuery{Limit: DefaultPageLimit}
+	if s := qv.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MaxPageLimit {
+			return pq, &QueryError{"limit", s}
+		}
+		pq.Limit = n
+	}
+	if s := qv.Get("cursor"); s != "" {
+		bs, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(bs) == 0 {
+			return pq, &QueryError{"cursor", s}
+		}
+		pq.After = string(bs)
+	}
+	return pq, nil
+}
+
+// page returns the bounds of the page of a list of n items, ordered by key,
+// with the cursor of the next page. The order is descending with desc. Going
+// by the key rather than an offset keeps the pages right when the list
+// changes between them.
+func (pq pageQuery) page(n int, key func(i int) string, desc bool) (from, to int, next string) {
+	if pq.After != "" {
+		from = sort.Search(n, func(i int) bool {
+			if desc {
+				return key(i) < pq.After
+			}
+			return key(i) > pq.After
+		})
+	}
+	to = from + pq.Limit
+	if to >= n {
+		return from, n, ""
+	}
+	return from, to, base64.RawURLEncoding.EncodeToString([]byte(key(to - 1)))
+}
+
+// v2Time is the key of a time in a list ordered by time.
+func v2Time(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// v2Lang looks up the language named in the URL.
+func v2Lang(r *http.Request) (Language, error) {
+	n := chi.URLParam(r, "language")
+	l, ok := StoreToLang[n]
+	if !ok {
+		return l, &QueryError{"language", n}
+	}
+	return l, nil
+}
+
+func v2Follows(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	pq, err := parsePageQuery(r)
+	if err != nil {
+		v2Fail(w, err)
+		return
+	}
+	fs, err := c.Follows()
+	if err != nil {
+		v2Fail(w, err)
+		return
+	}
+	sort.Slice(fs, func(i, j int) bool { return fs[i].StoreName < fs[j].StoreName })
+
+	from, to, next := pq.page(len(fs), func(i int) string { return fs[i].StoreName }, false)
+	out := []V2Follow{}
+	for _, f := range fs[from:to] {
+		out = append(out, V2Follow{Language: f.StoreName})
+	}
+	v2Write(w, http.StatusOK, V2Page{Data: out, NextCursor: next})
+}
+
+// v2Feeds lists the feeds of the followed languages.
+func v2Feeds(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	pq, err := parsePageQuery(r)
+	if err != nil {
+		v2Fail(w, err)
+		return
+	}
+	fs, err := c.Follows()
+	if err != nil {
+		v2Fail(w, err)
+		return
+	}
+	sort.Slice(fs, func(i, j int) bool { return fs[i].StoreName < fs[j].StoreName })
+
+	// The periods are numbered, so the keys sort in the order we list them, and
+	// the separator sorts before anything in a language name.
+	periods := []string{PeriodDaily, PeriodWeekly, PeriodMonthly}
+	key := func(i int) string {
+		return fs[i/len(periods)].StoreName + "\x00" + strconv.Itoa(i%len(periods))
+	}
+	from, to, next := pq.page(len(fs)*len(periods), key, false)
+
+	out := []V2Feed{}
+	for i := from; i < to; i++ {
+		f, p := fs[i/len(periods)], periods[i%len(periods)]
+		feed := V2Feed{Language: f.StoreName, Period: p}
+		_, ts, err := c.Latest(f, p)
+		if err != nil && err != ErrNoScrapesForLang && err != ErrNoScrapesForPeriod {
+			v2Fail(w, err)
+			return
+		}
+		if err == nil {
+			ts = ts.UTC()
+			feed.LatestScrapeAt = &ts
+		}
+		out = append(out, feed)
+	}
+	v2Write(w, http.StatusOK, V2Page{Data: out, NextCursor: next})
+}
+
+// v2Feed returns a feed with the items of its latest scrape.
+func v2Feed(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	l, err := v2Lang(r)
+	if err != nil {
+		v2Fail(w, err)
+		return
+	}
+	p := chi.URLParam(r, "period")
+	switch p {
+	case PeriodDaily, PeriodWeekly, PeriodMonthly:
+	default:
+		v2Fail(w, &QueryError{"period", p})
+		return
+	}
+
+	tis, ts, err := c.Latest(l, p)
+	if err != nil {
+		v2Fail(w, err)
+		return
+	}
+	ts = ts.UTC()
+	v2Write(w, http.StatusOK, V2Feed{
+		Language:       l.StoreName,
+		Period:         p,
+		LatestScrapeAt: &ts,
+		Items:          v2Items(tis),
+	})
+}
+
+// v2Scrapes lists the scrapes of the language given in the language query
+// parameter, newest first.
+func v2Scrapes(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	pq, err := parsePageQuery(r)
+	if err != nil {
+		v2Fail(w, err)
+		return
+	}
+	n := r.URL.Query().Get("language")
+	l, ok := StoreToLang[n]
+	if !ok {
+		v2Fail(w, &QueryError{"language", n})
+		return
+	}
+
+	ts, err := c.ScrapeHistory(l)
+	if err != nil && err != ErrNoScrapesForLang {
+		v2Fail(w, err)
+		return
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].After(ts[j]) })
+
+	from, to, next := pq.page(len(ts), func(i int) string { return v2Time(ts[i]) }, true)
+	out := []V2Scrape{}
+	for _, t := range ts[from:to] {
+		out = append(out, V2Scrape{Language: l.StoreName, ScrapedAt: t.UTC()})
+	}
+	v2Write(w, http.StatusOK, V2Page{Data: out, NextCursor: next})
+}
+
+// v2Scrape returns a scrape with the items of each of its periods.
+func v2Scrape(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	l, err := v2Lang(r)
+	if err != nil {
+		v2Fail(w, err)
+		return
+	}
+	s := chi.URLParam(r, "scraped_at")
+	ts, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v2Fail(w, &QueryError{"scraped_at", s})
+		return
+	}
+
+	sc := V2Scrape{Language: l.StoreName, ScrapedAt: ts.UTC(), Periods: make(map[string][]V2Item)}
+	for _, p := range []string{PeriodDaily, PeriodWeekly, PeriodMonthly} {
+		tis, err := c.GetScrape(l, p, ts)
+		if err == ErrNoScrapesForPeriod {
+			continue
+		}
+		if err != nil {
+			v2Fail(w, err)
+			return
+		}
+		sc.Periods[p] = v2Items(tis)
+	}
+	if len(sc.Periods) == 0 {
+		v2Fail(w, ErrNoScrapesForLang)
+		return
+	}
+	v2Write(w, http.StatusOK, sc)
+}
+
+// v2Repos lists the repos we know of, sorted by owner and name. With the q
+// query parameter, only those matching all its words are listed.
+func v2Repos(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	pq, err := parsePageQuery(r)
+	if err != nil {
+		v2Fail(w, err)
+		return
+	}
+
+	var rs []RepoInfo
+	if q := r.URL.Query().Get("q"); q != "" {
+		terms := searchTerms(q)
+		if len(terms) == 0 {
+			v2Fail(w, &QueryError{"q", q})
+			return
+		}
+		rs, err = c.SearchRepos(terms)
+	} else {
+		rs, err = c.Repos()
+	}
+	if err != nil {
+		v2Fail(w, err)
+		return
+	}
+
+	// The separator sorts before anything allowed in a name.
+	key := func(i int) string { return rs[i].Owner + "\x00" + rs[i].Name }
+	from, to, next := pq.page(len(rs), key, false)
+	out := []V2Repo{}
+	for _, ri := range rs[from:to] {
+		out = append(out, v2RepoOf(ri))
+	}
+	v2Write(w, http.StatusOK, V2Page{Data: out, NextCursor: next})
+}
+
+func v2Repo(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	ri, err := c.Repo(chi.URLParam(r, "owner"), chi.URLParam(r, "name"))
+	if err != nil {
+		v2Fail(w, err)
+		return
+	}
+	v2Write(w, http.StatusOK, v2RepoOf(ri))
+}
+
+// v2Runs lists the refresh runs since the server started, newest first.
+func v2Runs(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	pq, err := parsePageQuery(r)
+	if err != nil {
+		v2Fail(w, err)
+		return
+	}
+
+	rs := c.Runs()
+	key := func(i int) string { return fmt.Sprintf("%020d", rs[i].ID) }
+	from, to, next := pq.page(len(rs), key, true)
+	out := []V2Run{}
+	for _, run := range rs[from:to] {
+		out = append(out, v2RunOf(run))
+	}
+	v2Write(w, http.StatusOK, V2Page{Data: out, NextCursor: next})
+}
+
+func v2RunByID(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	s := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		v2Fail(w, &QueryError{"id", s})
+		return
+	}
+	run, err := c.Run(id)
+	if err != nil {
+		v2Fail(w, err)
+		return
+	}
+	v2Write(w, http.StatusOK, v2RunOf(run))
+}
+
+// v2Spec is the OpenAPI description of the v2 API, built into the binary so
+// the server doesn't depend on where it is started from.
+//
+//go:embed openapi/v2.json
+var v2Spec []byte
+
+// v2Routes sets up the v2 API.
+func v2Routes() func(r chi.Router) {
+	return func(r chi.Router) {
+		r.NotFound(v2NotFound)
+		r.MethodNotAllowed(v2MethodNotAllowed)
+
+		r.Get("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("content-type", "application/json")
+			w.Write(v2Spec)
+		})
+		r.Get("/follows", v2Follows)
+		r.Get("/feeds", v2Feeds)
+		r.Get("/feeds/{language}/{period}", v2Feed)
+		r.Get("/scrapes", v2Scrapes)
+		r.Get("/scrapes/{language}/{scraped_at}", v2Scrape)
+		r.Get("/repos", v2Repos)
+		r.Get("/repos/{owner}/{name}", v2Repo)
+		r.Get("/runs", v2Runs)
+		r.Get("/runs/{id}", v2RunByID)
+	}
+}
@@ -0,0 +1,401 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The contract tests check every response of the v2 API against
+// openapi/v2.json, so that the two can't drift apart.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openAPISpec is the part of an OpenAPI description the tests use. Schemas are
+// left as decoded json.
+type openAPISpec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas   map[string]map[string]interface{} `json:"schemas"`
+		Responses map[string]openAPIResponse        `json:"responses"`
+	} `json:"components"`
+}
+
+type openAPIResponse struct {
+	Ref     string `json:"$ref"`
+	Content map[string]struct {
+		Schema map[string]interface{} `json:"schema"`
+	} `json:"content"`
+}
+
+func loadOpenAPISpec(t *testing.T) *openAPISpec {
+	t.Helper()
+	bb, err := os.ReadFile("openapi/v2.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec openAPISpec
+	if err := json.Unmarshal(bb, &spec); err != nil {
+		t.Fatal(err)
+	}
+	return &spec
+}
+
+// responseSchema returns the schema of the response to a GET of path with the
+// status code, or an error if the description doesn't have it.
+func (spec *openAPISpec) responseSchema(path string, code int) (map[string]interface{}, error) {
+	tmpl, ok := spec.matchPath(path)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't described", path)
+	}
+	var op struct {
+		Responses map[string]openAPIResponse `json:"responses"`
+	}
+	if err := json.Unmarshal(spec.Paths[tmpl]["get"], &op); err != nil {
+		return nil, err
+	}
+	resp, ok := op.Responses[fmt.Sprint(code)]
+	if !ok {
+		return nil, fmt.Errorf("GET %s doesn't describe status %d", tmpl, code)
+	}
+	if resp.Ref != "" {
+		resp = spec.Components.Responses[strings.TrimPrefix(resp.Ref, "#/components/responses/")]
+	}
+	ct, ok := resp.Content["application/json"]
+	if !ok {
+		return nil, fmt.Errorf("GET %s with status %d has no json", tmpl, code)
+	}
+	return ct.Schema, nil
+}
+
+// matchPath finds the path template of the description matching path.
+func (spec *openAPISpec) matchPath(path string) (string, bool) {
+	segs := strings.Split(path, "/")
+	for tmpl := range spec.Paths {
+		tsegs := strings.Split(tmpl, "/")
+		if len(tsegs) != len(segs) {
+			continue
+		}
+		ok := true
+		for i, ts := range tsegs {
+			if ts != segs[i] && !strings.HasPrefix(ts, "{") {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return tmpl, true
+		}
+	}
+	return "", false
+}
+
+// validate checks v against the schema. Only what the description uses is
+// supported. Objects may not have properties the schema doesn't list, as
+// those would be undocumented.
+func (spec *openAPISpec) validate(schema map[string]interface{}, v interface{}, at string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		return spec.validate(spec.Components.Schemas[strings.TrimPrefix(ref, "#/components/schemas/")], v, at)
+	}
+	if v == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return fmt.Errorf("%s is null", at)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == v
+		}
+		if !found {
+			return fmt.Errorf("%s is %v, which isn't one of %v", at, v, enum)
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		o, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s is %T, not an object", at, v)
+		}
+		req, _ := schema["required"].([]interface{})
+		for _, k := range req {
+			if _, ok := o[k.(string)]; !ok {
+				return fmt.Errorf("%s is missing %s", at, k)
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		addl, _ := schema["additionalProperties"].(map[string]interface{})
+		for k, pv := range o {
+			ps, ok := props[k].(map[string]interface{})
+			if !ok {
+				ps = addl
+			}
+			if ps == nil {
+				return fmt.Errorf("%s has %s, which isn't described", at, k)
+			}
+			if err := spec.validate(ps, pv, at+"."+k); err != nil {
+				return err
+			}
+		}
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s is %T, not an array", at, v)
+		}
+		is, _ := schema["items"].(map[string]interface{})
+		for i, iv := range a {
+			if err := spec.validate(is, iv, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s is %T, not a string", at, v)
+		}
+		if schema["format"] == "date-time" {
+			ts, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return fmt.Errorf("%s is %q, not a date-time", at, s)
+			}
+			if ts.Location() != time.UTC {
+				return fmt.Errorf("%s is %q, which isn't in UTC", at, s)
+			}
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s is %v, not an integer", at, v)
+		}
+		if min, ok := schema["minimum"].(float64); ok && n < min {
+			return fmt.Errorf("%s is %v, below %v", at, n, min)
+		}
+	default:
+		return fmt.Errorf("%s has a schema of type %v, which we can't check", at, schema["type"])
+	}
+	return nil
+}
+
+// newTestV2 sets up a website on an in-memory store with some follows,
+// scrapes and runs.
+func newTestV2(t *testing.T) http.Handler {
+	t.Helper()
+	c, err := NewCrawler("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	t1 := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+	for _, l := range []Language{LangGo, LangRust, LangRuby} {
+		if err := c.Follow(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		err := c.SaveScrape(Scrape{Lang: LangGo, TakenAt: t1.Add(time.Duration(i) * time.Hour), Periods: map[string][]TrendingItem{
+			PeriodDaily: {
+				{RepoOwner: "o", RepoName: fmt.Sprintf("daily-%d", i), Description: "A repo", Language: "Go", Stars: 10, StarsIncrease: 2, Forks: 1},
+				{RepoOwner: "p", RepoName: "parser", Language: "Go", Stars: 5},
+			},
+			PeriodWeekly: {{RepoOwner: "o", RepoName: "weekly", Language: "Go", Stars: 7}},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ok := c.runs.start()
+	c.runs.update(ok, func(r *Run) {
+		r.FinishedAt = r.StartedAt.Add(time.Minute)
+		r.Langs = []string{"go"}
+	})
+	failed := c.runs.start()
+	c.runs.update(failed, func(r *Run) {
+		r.FinishedAt = r.StartedAt.Add(time.Minute)
+		r.Error = "GitHub is down"
+	})
+	c.runs.start()
+
+	return NewWebsite(c, WebsiteOptions{})
+}
+
+// getV2 gets path from the v2 API, checks the response against the
+// description and returns it decoded.
+func getV2(t *testing.T, h http.Handler, spec *openAPISpec, path string) (int, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/v2"+path, nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Fatalf("GET %s: got content type %q, want json", path, ct)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("GET %s: %s", path, err)
+	}
+	schema, err := spec.responseSchema(strings.SplitN(path, "?", 2)[0], rec.Code)
+	if err != nil {
+		t.Fatalf("GET %s: %s", path, err)
+	}
+	if err := spec.validate(schema, body, "body"); err != nil {
+		t.Fatalf("GET %s: %s", path, err)
+	}
+	return rec.Code, body
+}
+
+func TestV2Contract(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+	h := newTestV2(t)
+
+	tests := []struct {
+		path string
+		code int
+		// errCode and param are the error wanted, for codes other than 200.
+		errCode string
+		param   string
+	}{
+		{"/follows", 200, "", ""},
+		{"/follows?limit=0", 400, "invalid_parameter", "limit"},
+		{"/follows?limit=501", 400, "invalid_parameter", "limit"},
+		{"/follows?cursor=!", 400, "invalid_parameter", "cursor"},
+		{"/feeds", 200, "", ""},
+		{"/feeds?limit=x", 400, "invalid_parameter", "limit"},
+		{"/feeds/go/daily", 200, "", ""},
+		{"/feeds/go/monthly", 404, "not_found", ""},
+		{"/feeds/rust/daily", 404, "not_found", ""},
+		{"/feeds/go/yearly", 400, "invalid_parameter", "period"},
+		{"/feeds/klingon/daily", 400, "invalid_parameter", "language"},
+		{"/scrapes?language=go", 200, "", ""},
+		{"/scrapes?language=rust", 200, "", ""},
+		{"/scrapes", 400, "invalid_parameter", "language"},
+		{"/scrapes/go/2026-09-01T12:00:00Z", 200, "", ""},
+		{"/scrapes/go/2026-09-02T12:00:00Z", 404, "not_found", ""},
+		{"/scrapes/go/yesterday", 400, "invalid_parameter", "scraped_at"},
+		{"/scrapes/klingon/2026-09-01T12:00:00Z", 400, "invalid_parameter", "language"},
+		{"/repos", 200, "", ""},
+		{"/repos?q=pars", 200, "", ""},
+		{"/repos?q=!!", 400, "invalid_parameter", "q"},
+		{"/repos/p/parser", 200, "", ""},
+		{"/repos/p/missing", 404, "not_found", ""},
+		{"/runs", 200, "", ""},
+		{"/runs/1", 200, "", ""},
+		{"/runs/2", 200, "", ""},
+		{"/runs/3", 200, "", ""},
+		{"/runs/4", 404, "not_found", ""},
+		{"/runs/first", 400, "invalid_parameter", "id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			code, body := getV2(t, h, spec, tt.path)
+			if code != tt.code {
+				t.Fatalf("got status %d, want %d: %v", code, tt.code, body)
+			}
+			if tt.code == http.StatusOK {
+				return
+			}
+			e := body["error"].(map[string]interface{})
+			if e["code"] != tt.errCode {
+				t.Errorf("got error code %v, want %s", e["code"], tt.errCode)
+			}
+			if p, _ := e["param"].(string); p != tt.param {
+				t.Errorf("got param %q, want %q", p, tt.param)
+			}
+		})
+	}
+}
+
+// TestV2Paging checks that following the cursors one item at a time gives
+// the same list as getting it all at once.
+func TestV2Paging(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+	h := newTestV2(t)
+
+	for _, path := range []string{"/follows", "/feeds", "/scrapes?language=go", "/repos", "/repos?q=o", "/runs"} {
+		t.Run(path, func(t *testing.T) {
+			sep := "?"
+			if strings.Contains(path, "?") {
+				sep = "&"
+			}
+			_, all := getV2(t, h, spec, path+sep+"limit="+fmt.Sprint(MaxPageLimit))
+			if _, ok := all["next_cursor"]; ok {
+				t.Fatalf("got a next cursor for the whole list")
+			}
+			want := all["data"].([]interface{})
+			if len(want) < 2 {
+				t.Fatalf("got %d items, want a list that needs paging", len(want))
+			}
+
+			var got []interface{}
+			cursor := ""
+			for i := 0; i <= len(want); i++ {
+				p := path + sep + "limit=1"
+				if cursor != "" {
+					p += "&cursor=" + url.QueryEscape(cursor)
+				}
+				_, page := getV2(t, h, spec, p)
+				got = append(got, page["data"].([]interface{})...)
+				next, ok := page["next_cursor"].(string)
+				if !ok {
+					break
+				}
+				cursor = next
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got pages %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestV2Described checks that every route of the description is tested, and
+// that the description is served as is.
+func TestV2Described(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+	bb, err := os.ReadFile("openapi/v2.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	newTestV2(t).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/openapi.json", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != string(bb) {
+		t.Errorf("got status %d and a different description from /openapi.json", rec.Code)
+	}
+
+	var paths []string
+	for p := range spec.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	want := []string{
+		"/feeds", "/feeds/{language}/{period}", "/follows", "/openapi.json",
+		"/repos", "/repos/{owner}/{name}", "/runs", "/runs/{id}",
+		"/scrapes", "/scrapes/{language}/{scraped_at}",
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("got paths %v, want %v; add tests for the new ones", paths, want)
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role is what someone is allowed to do.
+type Role string
+
+const (
+	// RoleReader can only look.
+	RoleReader Role = "read"
+	// RoleAdmin can change things as well.
+	RoleAdmin Role = "admin"
+)
+
+var ErrUnknownRole = errors.New("Unknown role, it must be read or admin")
+
+func parseRole(s string) (Role, error) {
+	switch r := Role(s); r {
+	case RoleReader, RoleAdmin:
+		return r, nil
+	default:
+		return "", ErrUnknownRole
+	}
+}
+
+// Allows says if the role is allowed to do what need is.
+func (r Role) Allows(need Role) bool {
+	return r == RoleAdmin || r == need
+}
+
+// Principal is who made a request.
+type Principal struct {
+	Name string
+	Role Role
+}
+
+// User is someone who logs in with a password.
+type User struct {
+	Name         string
+	PasswordHash []byte
+	Role         Role
+}
+
+// NewUser makes a user, hashing the password.
+func NewUser(name, password string, role Role) (User, error) {
+	if !validUser(name) {
+		return User{}, fmt.Errorf("Invalid user name: %s", name)
+	}
+	if password == "" {
+		return User{}, errors.New("The password is empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+	return User{Name: name, PasswordHash: hash, Role: role}, nil
+}
+
+// Authenticator finds out who made a request. It returns nil if the request
+// doesn't have credentials it knows.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// credentials returns the secret of the request, from a bearer token or the
+// password of basic auth.
+func credentials(r *http.Request) string {
+	if _, pass, ok := r.BasicAuth(); ok {
+		return pass
+	}
+	h := r.Header.Get("Authorization")
+	if strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return ""
+}
+
+// TokenAuth lets in requests with a static token, as a bearer token or the
+// password of basic auth. Browsers can't send bearer tokens, so the latter is
+// for them.
+type TokenAuth []TokenEntry
+
+type TokenEntry struct {
+	Token string
+	Principal
+}
+
+// LoadTokens reads tokens from a file with one "name role token" per line.
+// Empty lines and lines starting with # are skipped.
+func LoadTokens(path string) (TokenAuth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ta TokenAuth
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fs := strings.Fields(line)
+		if len(fs) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected name, role and token", path, n)
+		}
+		role, err := parseRole(fs[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err.Error())
+		}
+		ta = append(ta, TokenEntry{Token: fs[2], Principal: Principal{Name: fs[0], Role: role}})
+	}
+	return ta, sc.Err()
+}
+
+func (ta TokenAuth) Authenticate(r *http.Request) (*Principal, error) {
+	got := credentials(r)
+	if got == "" {
+		return nil, nil
+	}
+	// Every token is compared, so the time taken doesn't tell which matched.
+	var found *Principal
+	for i := range ta {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(ta[i].Token)) == 1 {
+			found = &ta[i].Principal
+		}
+	}
+	return found, nil
+}
+
+// UserAuth lets in the users of the store with basic auth.
+type UserAuth struct {
+	c *Crawler
+}
+
+func (ua UserAuth) Authenticate(r *http.Request) (*Principal, error) {
+	name, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	u, err := ua.c.User(name)
+	if err == ErrUnknownUser {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(pass)) != nil {
+		return nil, nil
+	}
+	return &Principal{Name: u.Name, Role: u.Role}, nil
+}
+
+// sessionCookie holds who logged in through OIDC.
+const sessionCookie = "trendhub-session"
+
+// Sessions are signed cookies saying who someone is, so they only have to log
+// in once.
+type Sessions struct {
+	key []byte
+	ttl time.Duration
+}
+
+type session struct {
+	Principal
+	Expires int64
+}
+
+func NewSessions(key []byte, ttl time.Duration) *Sessions {
+	return &Sessions{key: key, ttl: ttl}
+}
+
+func (s *Sessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue sets the session cookie for the principal.
+func (s *Sessions) Issue(w http.ResponseWriter, r *http.Request, p Principal) error {
+	j, err := json.Marshal(session{Principal: p, Expires: time.Now().Add(s.ttl).Unix()})
+	if err != nil {
+		return err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(j)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    payload + "." + s.sign(payload),
+		Path:     "/",
+		MaxAge:   int(s.ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Clear removes the session cookie.
+func (s *Sessions) Clear(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+}
+
+func (s *Sessions) Authenticate(r *http.Request) (*Principal, error) {
+	ck, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, nil
+	}
+	i := strings.IndexByte(ck.Value, '.')
+	if i < 0 {
+		return nil, nil
+	}
+	payload, sig := ck.Value[:i], ck.Value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+		return nil, nil
+	}
+	j, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, nil
+	}
+	var ss session
+	if err := json.Unmarshal(j, &ss); err != nil {
+		return nil, nil
+	}
+	if time.Now().Unix() > ss.Expires {
+		return nil, nil
+	}
+	return &ss.Principal, nil
+}
+
+// Auth decides who may do what on the website.
+type Auth struct {
+	// Authenticators are asked in order who made a request.
+	Authenticators []Authenticator
+	// OIDC is the login through an identity provider, if there is one.
+	OIDC *OIDC
+	// Private makes looking need a login as well, not just changing things.
+	Private bool
+}
+
+// Authenticate puts who made the request in the context, if anyone did.
+// Requests with credentials nobody knows are turned away, so that a mistyped
+// password isn't taken as not logging in at all. Requests through the control
+// socket are made by the admin.
+func (a Auth) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p *Principal
+		if r.Context().Value(ctxControl) != nil {
+			p = &Principal{Name: "control", Role: RoleAdmin}
+		}
+		for _, au := range a.Authenticators {
+			if p != nil {
+				break
+			}
+			var err error
+			if p, err = au.Authenticate(r); err != nil {
+				http.Error(w, "Couldn't authenticate: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if p == nil {
+			if r.Header.Get("Authorization") != "" {
+				a.deny(w, r, http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxPrincipal, p)))
+	})
+}
+
+// Require only lets through those with a role allowing need.
+func (a Auth) Require(need Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := principal(r)
+			switch {
+			case p == nil:
+				a.deny(w, r, http.StatusUnauthorized)
+			case !p.Role.Allows(need):
+				a.deny(w, r, http.StatusForbidden)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// deny turns the request away in the way whoever made it understands. People
+// looking at pages are sent to log in, if they can.
+func (a Auth) deny(w http.ResponseWriter, r *http.Request, code int) {
+	msg, v2Code := "Forbidden", "forbidden"
+	if code == http.StatusUnauthorized {
+		msg, v2Code = "Unauthorized", "unauthorized"
+		w.Header().Add("WWW-Authenticate", "Bearer")
+		w.Header().Add("WWW-Authenticate", `Basic realm="trendhub"`)
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/v2/"):
+		v2WriteError(w, code, V2ErrorDetail{Code: v2Code, Message: msg})
+	case strings.HasPrefix(r.URL.Path, "/api/"):
+		apiError(w, msg, code)
+	case code == http.StatusUnauthorized && a.OIDC != nil && r.Method == http.MethodGet:
+		http.Redirect(w, r, "/auth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+	default:
+		http.Error(w, msg, code)
+	}
+}
+
+// principal returns who made the request, or nil if we don't know.
+func principal(r *http.Request) *Principal {
+	p, _ := r.Context().Value(ctxPrincipal).(*Principal)
+	return p
+}
+
+// checkOrigin turns away changes from other sites. Browsers send cookies and
+// basic auth along by themselves, so without this another site could make
+// changes in the name of whoever is logged in.
+func checkOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if o := r.Header.Get("Origin"); o != "" {
+				if u, err := url.Parse(o); err != nil || u.Host != r.Host {
+					http.Error(w, "Cross origin request", http.StatusForbidden)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
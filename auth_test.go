@@ -0,0 +1,444 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIdP is an OpenID Connect provider handing out id tokens with the claims
+// the test asks for.
+type testIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]testGrant
+}
+
+// testGrant is what a code is traded for, if the verifier matches the
+// challenge.
+type testGrant struct {
+	challenge string
+	claims    map[string]any
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{key: key, grants: make(map[string]testGrant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		g, ok := idp.grants[r.FormValue("code")]
+		delete(idp.grants, r.FormValue("code"))
+		idp.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idp.sign(t, g.claims),
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// sign makes an id token for the test client with the claims.
+func (idp *testIdP) sign(t *testing.T, claims map[string]any) string {
+	now := time.Now()
+	cs := map[string]any{"iss": idp.URL, "aud": "trendhub", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()}
+	for k, v := range claims {
+		cs[k] = v
+	}
+	h, err := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	if err != nil {
+		t.Error(err)
+	}
+	p, err := json.Marshal(cs)
+	if err != nil {
+		t.Error(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(p)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Error(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// grant lets the code be traded for an id token with the claims.
+func (idp *testIdP) grant(code, challenge string, claims map[string]any) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.grants[code] = testGrant{challenge: challenge, claims: claims}
+}
+
+// newTestOIDC makes a website logging in with the provider, with
+// admin@example.com as the admin.
+func newTestOIDC(t *testing.T, idp *testIdP) (http.Handler, *Sessions) {
+	t.Helper()
+	c, err := NewCrawler("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	sessions := NewSessions([]byte("0123456789abcdef0123456789abcdef"), time.Hour)
+	o, err := NewOIDC(context.Background(), OIDCOptions{
+		Issuer:       idp.URL,
+		ClientID:     "trendhub",
+		ClientSecret: "secret",
+		RedirectURL:  "http://trendhub.test/auth/callback",
+		Admins:       []string{"admin@example.com"},
+	}, sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := Auth{Authenticators: []Authenticator{sessions}, OIDC: o}
+	return NewWebsite(c, WebsiteOptions{Auth: auth}), sessions
+}
+
+// startLogin goes to the login page, and returns the cookie keeping the login
+// with the query sent to the provider.
+func startLogin(t *testing.T, h http.Handler, next string) (*http.Cookie, url.Values) {
+	t.Helper()
+	rec := get(t, h, "", "/auth/login?next="+url.QueryEscape(next))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: got status %d, want %d", rec.Code, http.StatusFound)
+	}
+	u, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ck := range rec.Result().Cookies() {
+		if ck.Name == oidcCookie {
+			return ck, u.Query()
+		}
+	}
+	t.Fatal("login: no login cookie")
+	return nil, nil
+}
+
+// callback comes back from the provider with the code and state.
+func callback(h http.Handler, ck *http.Cookie, code, state string) *httptest.ResponseRecorder {
+	q := url.Values{"code": {code}, "state": {state}}
+	req := httptest.NewRequest(http.MethodGet, "/auth/callback?"+q.Encode(), nil)
+	req.AddCookie(ck)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// sessionOf returns who the session set by the response is for.
+func sessionOf(t *testing.T, s *Sessions, rec *httptest.ResponseRecorder) *Principal {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, ck := range rec.Result().Cookies() {
+		if ck.Name == sessionCookie {
+			req.AddCookie(ck)
+		}
+	}
+	p, err := s.Authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	h, sessions := newTestOIDC(t, idp)
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   Principal
+	}{
+		{"verified admin", map[string]any{"sub": "s1", "email": "admin@example.com", "email_verified": true},
+			Principal{Name: "admin@example.com", Role: RoleAdmin}},
+		{"verified reader", map[string]any{"sub": "s2", "email": "bob@example.com", "email_verified": true},
+			Principal{Name: "bob@example.com", Role: RoleReader}},
+		{"unverified admin email", map[string]any{"sub": "s3", "email": "admin@example.com", "email_verified": false},
+			Principal{Name: "s3", Role: RoleReader}},
+		{"missing email_verified", map[string]any{"sub": "s4", "email": "admin@example.com"},
+			Principal{Name: "s4", Role: RoleReader}},
+	}
+	for _, tt := range tests {
+		ck, q := startLogin(t, h, "/stats")
+		if q.Get("code_challenge_method") != "S256" {
+			t.Errorf("%s: got challenge method %q, want S256", tt.name, q.Get("code_challenge_method"))
+		}
+		tt.claims["nonce"] = q.Get("nonce")
+		idp.grant("code", q.Get("code_challenge"), tt.claims)
+
+		rec := callback(h, ck, "code", q.Get("state"))
+		if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/stats" {
+			t.Errorf("%s: got status %d to %q, want %d to /stats: %s",
+				tt.name, rec.Code, rec.Header().Get("Location"), http.StatusSeeOther, rec.Body)
+			continue
+		}
+		if p := sessionOf(t, sessions, rec); p == nil || *p != tt.want {
+			t.Errorf("%s: got session for %v, want %v", tt.name, p, tt.want)
+		}
+	}
+}
+
+func TestOIDCCallbackMismatch(t *testing.T) {
+	idp := newTestIdP(t)
+	h, _ := newTestOIDC(t, idp)
+
+	tests := []struct {
+		name string
+		// change breaks one part of the login: the cookie, the state sent
+		// back or the claims of the id token.
+		change func(ck *http.Cookie, state *string, claims map[string]any)
+		code   int
+		msg    string
+	}{
+		{"state", func(ck *http.Cookie, state *string, claims map[string]any) {
+			*state = "other"
+		}, http.StatusBadRequest, "doesn't match"},
+		{"nonce", func(ck *http.Cookie, state *string, claims map[string]any) {
+			claims["nonce"] = "other"
+		}, http.StatusUnauthorized, "another login"},
+		{"pkce", func(ck *http.Cookie, state *string, claims map[string]any) {
+			parts := strings.Split(ck.Value, " ")
+			parts[2] = "other-verifier-that-is-long-enough-for-the-provider"
+			ck.Value = strings.Join(parts, " ")
+		}, http.StatusUnauthorized, "invalid_grant"},
+		{"cookie", func(ck *http.Cookie, state *string, claims map[string]any) {
+			ck.Value = "garbage"
+		}, http.StatusBadRequest, "expired"},
+	}
+	for _, tt := range tests {
+		ck, q := startLogin(t, h, "/")
+		state := q.Get("state")
+		claims := map[string]any{"sub": "s1", "nonce": q.Get("nonce")}
+		tt.change(ck, &state, claims)
+		idp.grant("code", q.Get("code_challenge"), claims)
+
+		rec := callback(h, ck, "code", state)
+		if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.msg) {
+			t.Errorf("%s: got status %d: %s, want %d: %s", tt.name, rec.Code, rec.Body, tt.code, tt.msg)
+		}
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == sessionCookie && c.MaxAge >= 0 {
+				t.Errorf("%s: got a session", tt.name)
+			}
+		}
+	}
+}
+
+func TestOIDCLoginRedirect(t *testing.T) {
+	idp := newTestIdP(t)
+	h, _ := newTestOIDC(t, idp)
+
+	rec := get(t, h, "", "/admin/follows")
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/auth/login?next=%2Fadmin%2Ffollows" {
+		t.Errorf("got status %d to %q, want to be sent to log in", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// Where to go after the login is kept in the cookie, and only local
+	// paths make it there.
+	for _, next := range []string{"https://evil.example", "//evil.example", "/\\evil.example", "stats"} {
+		ck, _ := startLogin(t, h, next)
+		if !strings.HasSuffix(ck.Value, " /") {
+			t.Errorf("%q: got login cookie %q, want it to go to /", next, ck.Value)
+		}
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"/", "/"},
+		{"/stats?period=weekly", "/stats?period=weekly"},
+		{"", "/"},
+		{"stats", "/"},
+		{"https://evil.example/", "/"},
+		{"//evil.example/", "/"},
+		{"/\\evil.example/", "/"},
+	}
+	for _, tt := range tests {
+		if got := localPath(tt.in); got != tt.want {
+			t.Errorf("localPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	issue := func(s *Sessions, p Principal) string {
+		rec := httptest.NewRecorder()
+		if err := s.Issue(rec, httptest.NewRequest(http.MethodGet, "/", nil), p); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Result().Cookies()[0].Value
+	}
+	check := func(s *Sessions, value string) *Principal {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: value})
+		p, err := s.Authenticate(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	s := NewSessions(key, time.Hour)
+	bob := Principal{Name: "bob", Role: RoleReader}
+	good := issue(s, bob)
+	if p := check(s, good); p == nil || *p != bob {
+		t.Errorf("got %v, want %v", p, bob)
+	}
+
+	// Making oneself admin, with the signature of the real session.
+	payload, sig, _ := strings.Cut(good, ".")
+	j, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(j), `"read"`, `"admin"`, 1)))
+
+	expired := issue(NewSessions(key, -time.Minute), bob)
+	other := issue(NewSessions([]byte("another key"), time.Hour), Principal{Name: "bob", Role: RoleAdmin})
+	for name, v := range map[string]string{
+		"forged":    forged + "." + sig,
+		"no sig":    payload,
+		"bad sig":   payload + "." + sig[1:],
+		"expired":   expired,
+		"other key": other,
+	} {
+		if p := check(s, v); p != nil {
+			t.Errorf("%s: got %v, want nobody", name, p)
+		}
+	}
+}
+
+func TestAuthRoles(t *testing.T) {
+	c, err := NewCrawler("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, u := range []struct {
+		name, pass string
+		role       Role
+	}{{"alice", "adminpw", RoleAdmin}, {"bob", "readpw", RoleReader}} {
+		nu, err := NewUser(u.name, u.pass, u.role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SaveUser(nu); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ta := TokenAuth{
+		{Token: "admintoken", Principal: Principal{Name: "ops", Role: RoleAdmin}},
+		{Token: "readtoken", Principal: Principal{Name: "viewer", Role: RoleReader}},
+	}
+
+	tests := []struct {
+		name    string
+		private bool
+		// auth sets the credentials on the request.
+		auth func(r *http.Request)
+		path string
+		code int
+	}{
+		{"anonymous page", false, func(r *http.Request) {}, "/", http.StatusOK},
+		{"anonymous admin", false, func(r *http.Request) {}, "/admin/follows", http.StatusUnauthorized},
+		{"anonymous private", true, func(r *http.Request) {}, "/", http.StatusUnauthorized},
+		{"read token admin", false, bearer("readtoken"), "/admin/follows", http.StatusForbidden},
+		{"read token private", true, bearer("readtoken"), "/", http.StatusOK},
+		{"admin token", false, bearer("admintoken"), "/admin/follows", http.StatusOK},
+		{"admin token as password", false, basic("anyone", "admintoken"), "/admin/follows", http.StatusOK},
+		{"reader user admin", false, basic("bob", "readpw"), "/admin/follows", http.StatusForbidden},
+		{"reader user private", true, basic("bob", "readpw"), "/", http.StatusOK},
+		{"admin user", false, basic("alice", "adminpw"), "/admin/follows", http.StatusOK},
+		// Credentials nobody knows are turned away, even where none are
+		// needed.
+		{"unknown token", false, bearer("nope"), "/", http.StatusUnauthorized},
+		{"wrong password", false, basic("alice", "readpw"), "/", http.StatusUnauthorized},
+		{"unknown user", false, basic("carol", "adminpw"), "/api/v1/trending", http.StatusUnauthorized},
+		{"unknown scheme", false, func(r *http.Request) { r.Header.Set("Authorization", "Digest x") }, "/", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		h := NewWebsite(c, WebsiteOptions{Auth: Auth{Private: tt.private, Authenticators: []Authenticator{ta, UserAuth{c}}}})
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		tt.auth(req)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s: got status %d, want %d", tt.name, rec.Code, tt.code)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: got no WWW-Authenticate", tt.name)
+		}
+	}
+}
+
+func bearer(token string) func(r *http.Request) {
+	return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+}
+
+func basic(user, pass string) func(r *http.Request) {
+	return func(r *http.Request) { r.SetBasicAuth(user, pass) }
+}
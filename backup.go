@@ -0,0 +1,122 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Backup writes a consistent snapshot of the store to w, if the store supports
+// it.
+func (c *Crawler) Backup(w io.Writer, compress bool) (int64, error) {
+	b, ok := c.Store.(Backuper)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+	return b.Backup(w, compress)
+}
+
+// Restore replaces the database at dbpath with the backup at src, which may be
+// gzipped. The backup is unpacked next to the database and checked before it is
+// swapped in, and the old database is locked while that happens so that we don't
+// pull it out from under a running server.
+func Restore(dbpath, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dbpath), filepath.Base(dbpath)+".restore-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		return err
+	}
+
+	if err := validateBackup(tmpPath); err != nil {
+		return fmt.Errorf("Backup is not valid: %s", err.Error())
+	}
+
+	old, err := bolt.Open(dbpath, 0600, &bolt.Options{Timeout: dbOpenTimeout})
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	return os.Rename(tmpPath, dbpath)
+}
+
+// validateBackup makes sure the file is a bolt database without consistency
+// errors, and that it has the buckets we expect.
+func validateBackup(path string) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: dbOpenTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		// We have to drain the channel, as the check keeps reading the file
+		// until it is done.
+		var cerr error
+		for err := range tx.Check() {
+			if cerr == nil {
+				cerr = err
+			}
+		}
+		if cerr != nil {
+			return cerr
+		}
+		if _, err := checkBoltSchema(tx); err != nil {
+			return err
+		}
+		for _, name := range [][]byte{FollowsBucket, LanguageBucket} {
+			if tx.Bucket(name) == nil {
+				return fmt.Errorf("Missing bucket %s", name)
+			}
+		}
+		return nil
+	})
+}
@@ -15,24 +15,34 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
-	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Crawler fetches the trending pages and keeps them in a Store.
 type Crawler struct {
-	c  http.Client
-	db *bolt.DB
+	Store
+
+	c    http.Client
+	runs runLog
+	// followed gets the languages followed while running, so the refresher
+	// can scrape them right away instead of at the next refresh.
+	followed chan Language
+	// events tells the pages open in browsers about new scrapes.
+	events *scrapeEvents
+	// breakouts keeps the breakouts found since the scrapes last changed.
+	breakouts breakoutCache
 }
 
 type Language struct {
@@ -40,11 +50,6 @@ type Language struct {
 	QueryName string
 }
 
-var (
-	FollowsBucket  = []byte("follows")
-	LanguageBucket = []byte("language")
-)
-
 const (
 	PeriodDaily   = "daily"
 	PeriodWeekly  = "weekly"
@@ -56,212 +61,150 @@ var (
 	ErrNoScrapesForPeriod = errors.New("No scrapes for the period")
 )
 
-// NewCrawler Returns a new crawler
-func NewCrawler(dbpath string) (*Crawler, error) {
-	db, err := bolt.Open(dbpath, 0600, nil)
+// NewCrawler Returns a new crawler, using the store described by spec. See
+// OpenStore for what it can be.
+func NewCrawler(spec string) (*Crawler, error) {
+	s, err := OpenStore(spec)
 	if err != nil {
 		return nil, err
 	}
+	return &Crawler{Store: s, followed: make(chan Language, 16), events: newScrapeEvents()}, nil
+}
 
-	// We don't want to check for the existance of buckets everywhere, so we make sure
-	// they are created at the start
-	if err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(FollowsBucket)
-		if err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists(LanguageBucket); err != nil {
-			return err
+// Follow follows the language, and lets the refresher know if it is new.
+func (c *Crawler) Follow(lang Language) error {
+	fs, err := c.Follows()
+	if err != nil {
+		return err
+	}
+	for _, f := range fs {
+		if f == lang {
+			return nil
 		}
-		return nil
-	}); err != nil {
-		db.Close()
-		return nil, err
 	}
-
-	return &Crawler{db: db}, nil
+	if err := c.Store.Follow(lang); err != nil {
+		return err
+	}
+	select {
+	case c.followed <- lang:
+	default:
+		// Nobody is listening, or they are far behind. Either way it will
+		// be scraped at the next refresh.
+	}
+	return nil
 }
 
-// Close closes the crawler
-func (c *Crawler) Close() error {
-	return c.db.Close()
-}
+func (c *Crawler) getTrendingPage(ctx context.Context, lang Language, period string) (tis []TrendingItem, err error) {
+	defer observeSince(fetchDuration.WithLabelValues(lang.StoreName, period), time.Now())
+	ctx, sp := tracer.Start(ctx, "fetch", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("language", lang.StoreName),
+		attribute.String("period", period),
+	))
+	defer func() { endSpan(sp, err) }()
 
-func (c *Crawler) getTrendingPage(lang Language, period string) ([]TrendingItem, error) {
 	u := fmt.Sprintf("https://github.com/trending/%s?since=%s", lang.QueryName, period)
-	res, err := c.c.Get(u)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
-	return parsePage(res.Body)
-}
-
-// Follows() returns the languages we are following
-func (c *Crawler) Follows() ([]Language, error) {
-	var following []Language
-
-	if err := c.db.View(func(tx *bolt.Tx) error {
-		bk := tx.Bucket(FollowsBucket)
-
-		if err := bk.ForEach(func(k, v []byte) error {
-			following = append(following, StoreToLang[string(k)])
-			return nil
-		}); err != nil {
-			return err
-		}
-		return nil
-	}); err != nil {
+	res, err := c.c.Do(req)
+	if err != nil {
+		fetchResponses.WithLabelValues(lang.StoreName, period, "error").Inc()
 		return nil, err
 	}
-	return following, nil
-}
-
-func (c *Crawler) Follow(lang Language) error {
-	return c.db.Update(func(tx *bolt.Tx) error {
-		bk := tx.Bucket(FollowsBucket)
-		return bk.Put([]byte(lang.StoreName), nil)
-	})
-}
-
-func (c *Crawler) Unfollow(lang Language) error {
-	return c.db.Update(func(tx *bolt.Tx) error {
-		bk := tx.Bucket(FollowsBucket)
-		return bk.Delete([]byte(lang.StoreName))
-	})
-}
-
-func (c *Crawler) ScrapeHistory(lang Language) ([]time.Time, error) {
-	var times []time.Time
-	err := c.db.View(func(tx *bolt.Tx) error {
-		lb := tx.Bucket(LanguageBucket).Bucket([]byte(lang.StoreName))
-		if lb == nil {
-			return nil
-		}
+	defer res.Body.Close()
+	fetchResponses.WithLabelValues(lang.StoreName, period, strconv.Itoa(res.StatusCode)).Inc()
+	sp.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
 
-		err := lb.ForEach(func(k, v []byte) error {
-			ts, err := time.Parse(time.RFC3339, string(k))
-			if err != nil {
-				return err
-			}
-			times = append(times, ts)
-			return nil
-		})
-		return err
-	})
+	tis, err = parsePage(ctx, res.Body)
 	if err != nil {
+		parseFailures.WithLabelValues(lang.StoreName, period).Inc()
 		return nil, err
 	}
-	return times, nil
+	pageItems.WithLabelValues(lang.StoreName, period).Observe(float64(len(tis)))
+	return tis, nil
 }
 
-// Latest returns the latest scrape, with the time of the scrape
-func (c *Crawler) Latest(lang Language, period string) ([]TrendingItem, time.Time, error) {
-	var tis []TrendingItem
-	var ts time.Time
-	var err error
-
-	err = c.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(LanguageBucket).Bucket([]byte(lang.StoreName))
-		if b == nil {
-			return ErrNoScrapesForLang
-		}
-		c := b.Cursor()
-
-		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
-			ts, err = time.Parse(time.RFC3339, string(k))
-			if err != nil {
-				return err
-			}
-			nc := b.Bucket(k).Cursor()
-			prefix := []byte(period)
-			for nk, nv := nc.Seek(prefix); nk != nil && bytes.HasPrefix(nk, prefix); nk, nv = nc.Next() {
-				var ti TrendingItem
-				if err := json.Unmarshal(nv, &ti); err != nil {
-					return err
-				}
-				tis = append(tis, ti)
-			}
-
-			if len(tis) != 0 {
-				break
-			}
-		}
-		if ts.IsZero() {
-			return ErrNoScrapesForLang
-		}
-		if len(tis) == 0 {
-			return ErrNoScrapesForPeriod
-		}
-		return nil
-	})
-
-	return tis, ts, err
-}
-
-// GetScrape returns a specific scrape from history
-func (c *Crawler) GetScrape(lang, period string, ts time.Time) ([]TrendingItem, error) {
-	return nil, errors.New("Not implemented yet")
-}
-
-func (c *Crawler) Refresh() error {
+// Refresh scrapes the followed languages, and is remembered as a Run.
+func (c *Crawler) Refresh(ctx context.Context) error {
 	fs, err := c.Follows()
 	if err != nil {
 		return err
 	}
+	return c.RefreshLangs(ctx, fs)
+}
 
-	var buf bytes.Buffer
-
-	for _, f := range fs {
-		log.Printf("Refreshing language %s\n", f.StoreName)
-		periods := []string{PeriodDaily, PeriodWeekly, PeriodMonthly}
-		trends := [][]TrendingItem{}
-		for _, p := range periods {
-			log.Printf("Getting trending page: %s %s\n", f.StoreName, p)
-			tis, err := c.getTrendingPage(f, p)
-			if err != nil {
-				return err
-			}
-			trends = append(trends, tis)
+// RefreshLangs scrapes the languages, and is remembered as a Run.
+func (c *Crawler) RefreshLangs(ctx context.Context, fs []Language) error {
+	id := c.runs.start()
+	ctx = withLog(ctx, "run_id", id)
+	ctx, sp := tracer.Start(ctx, "refresh", trace.WithAttributes(
+		attribute.Int("run_id", id),
+		attribute.Int("languages", len(fs)),
+	))
+	start := time.Now()
+	err := c.refresh(ctx, id, fs)
+	endSpan(sp, err)
+	observeSince(refreshDuration, start)
+	if err == nil {
+		slog.InfoContext(ctx, "Refreshed", "languages", len(fs), "duration", time.Since(start))
+	}
+	if err != nil {
+		refreshRuns.WithLabelValues("failed").Inc()
+	} else {
+		refreshRuns.WithLabelValues("succeeded").Inc()
+	}
+	c.runs.update(id, func(r *Run) {
+		r.FinishedAt = time.Now().UTC()
+		if err != nil {
+			r.Error = err.Error()
 		}
-		takenAt := time.Now().UTC().Format(time.RFC3339)
-
-		if err := c.db.Update(func(tx *bolt.Tx) error {
-			lb := tx.Bucket(LanguageBucket)
-			llb, err := lb.CreateBucketIfNotExists([]byte(f.StoreName))
-			if err != nil {
-				return err
-			}
-			hlb, err := llb.CreateBucketIfNotExists([]byte(takenAt))
-			if err != nil {
-				return err
-			}
+	})
+	return err
+}
 
-			// We put these into the buckets
-			for ip, p := range periods {
-				tis := trends[ip]
-				for i, ti := range tis {
-					buf.Reset()
-					fmt.Fprintf(&buf, "%s-%02d", p, i)
-
-					j, err := json.Marshal(ti)
-					if err != nil {
-						return err
-					}
-
-					if err := hlb.Put(buf.Bytes(), j); err != nil {
-						return err
-					}
-				}
-			}
-			return nil
-		}); err != nil {
+func (c *Crawler) refresh(ctx context.Context, id int, fs []Language) error {
+	for _, f := range fs {
+		ts, err := c.refreshLang(ctx, f)
+		if err != nil {
 			return err
 		}
+		c.runs.update(id, func(r *Run) { r.Langs = append(r.Langs, f.StoreName) })
+		c.events.publish(ScrapeEvent{Language: f.StoreName, ScrapedAt: ts, RunID: id})
 	}
 	return nil
 }
 
+// refreshLang scrapes every period of the language, and saves them as one
+// scrape taken at the returned time.
+func (c *Crawler) refreshLang(ctx context.Context, f Language) (ts time.Time, err error) {
+	ctx = withLog(ctx, "language", f.StoreName)
+	ctx, sp := tracer.Start(ctx, "refresh_language", trace.WithAttributes(attribute.String("language", f.StoreName)))
+	defer func() { endSpan(sp, err) }()
+
+	slog.InfoContext(ctx, "Refreshing language")
+	periods := []string{PeriodDaily, PeriodWeekly, PeriodMonthly}
+	sc := Scrape{
+		Lang:    f,
+		Periods: make(map[string][]TrendingItem),
+	}
+	for _, p := range periods {
+		pctx := withLog(ctx, "period", p)
+		slog.DebugContext(pctx, "Getting trending page")
+		tis, err := c.getTrendingPage(pctx, f, p)
+		if err != nil {
+			return ts, err
+		}
+		sc.Periods[p] = tis
+	}
+	sc.TakenAt = time.Now().UTC().Truncate(time.Second)
+
+	_, ssp := c.storeSpan(ctx, "save_scrape", attribute.String("language", f.StoreName))
+	err = c.SaveScrape(sc)
+	endSpan(ssp, err)
+	return sc.TakenAt, err
+}
+
 type TrendingItem struct {
 	RepoOwner     string
 	RepoName      string
@@ -272,7 +215,15 @@ type TrendingItem struct {
 	StarsIncrease int
 }
 
-func parsePage(body io.Reader) ([]TrendingItem, error) {
+// parsePage parses a trending page. Repos missing things we can do without are
+// logged as warnings with ctx, which should say which page it is.
+func parsePage(ctx context.Context, body io.Reader) (items []TrendingItem, err error) {
+	ctx, sp := tracer.Start(ctx, "parse")
+	defer func() {
+		sp.SetAttributes(attribute.Int("items", len(items)))
+		endSpan(sp, err)
+	}()
+
 	doc, err := goquery.NewDocumentFromReader(body)
 	if err != nil {
 		return nil, err
@@ -280,7 +231,7 @@ func parsePage(body io.Reader) ([]TrendingItem, error) {
 
 	var outerErr error
 
-	items := make([]TrendingItem, 0)
+	items = make([]TrendingItem, 0)
 	doc.Find("article.Box-row").EachWithBreak(func(i int, s *goquery.Selection) bool {
 		// Repolink, repo organization and repo name
 		titlelink, ok := s.Find("h1.h3.lh-condensed > a").Attr("href")
@@ -330,7 +281,7 @@ func parsePage(body io.Reader) ([]TrendingItem, error) {
 				return false
 			}
 		} else {
-			fmt.Printf("Could not find one stargazers link\n")
+			slog.WarnContext(ctx, "Found no stargazers link", "rank", i+1, "repo", repoOwner+"/"+repoName)
 		}
 
 		// forks
@@ -369,7 +320,7 @@ func parsePage(body io.Reader) ([]TrendingItem, error) {
 				return false
 			}
 		} else {
-			fmt.Printf("Warning: We found no starsToday\n")
+			slog.WarnContext(ctx, "Found no stars today", "rank", i+1, "repo", repoOwner+"/"+repoName)
 		}
 
 		ti := TrendingItem{
@@ -0,0 +1,214 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DoctorOptions controls what the doctor looks for.
+type DoctorOptions struct {
+	// Interval is how often we refresh. Gaps between scrapes a quarter longer
+	// than this are reported, the extra is to allow for the refresh itself.
+	Interval time.Duration
+	// GapsSince is where we start looking for gaps, as pruning leaves gaps in
+	// older scrapes on purpose.
+	GapsSince time.Time
+	// Repair removes the things we can't read.
+	Repair bool
+}
+
+// Problem is something wrong the doctor found.
+type Problem struct {
+	Lang string
+	Key  string
+	What string
+	// Repaired is set if the problem was fixed by removing the data.
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	var sb strings.Builder
+	if p.Lang != "" {
+		sb.WriteString(p.Lang)
+	}
+	if p.Key != "" {
+		sb.WriteString(" " + p.Key)
+	}
+	if sb.Len() != 0 {
+		sb.WriteString(": ")
+	}
+	sb.WriteString(p.What)
+	if p.Repaired {
+		sb.WriteString(" (removed)")
+	}
+	return sb.String()
+}
+
+// LangHealth sums up the scrapes of a language.
+type LangHealth struct {
+	Lang    string
+	Scrapes int
+	First   time.Time
+	Last    time.Time
+}
+
+// DoctorReport is what the doctor found.
+type DoctorReport struct {
+	Langs    []LangHealth
+	Problems []Problem
+}
+
+// Doctor walks the whole database looking for problems. Problems that make data
+// impossible to read are fixed by removing the data, if asked to.
+func (s *BoltStore) Doctor(opts DoctorOptions) (DoctorReport, error) {
+	var rep DoctorReport
+	run := s.view
+	if opts.Repair {
+		run = s.update
+	}
+
+	err := run(func(tx *bolt.Tx) error {
+		// We can't change buckets while iterating over them, so the repairs are
+		// done after the walk.
+		var repairs []func() error
+		problem := func(lang, key, what string, repair func() error) {
+			p := Problem{Lang: lang, Key: key, What: what}
+			if opts.Repair && repair != nil {
+				p.Repaired = true
+				repairs = append(repairs, repair)
+			}
+			rep.Problems = append(rep.Problems, p)
+		}
+
+		fb := tx.Bucket(FollowsBucket)
+		if err := fb.ForEach(func(k, v []byte) error {
+			if _, ok := StoreToLang[string(k)]; !ok {
+				k := append([]byte(nil), k...)
+				problem(string(k), "", "following an unknown language", func() error {
+					return fb.Delete(k)
+				})
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		rc := newRepoCache(tx)
+		lb := tx.Bucket(LanguageBucket)
+		err := lb.ForEach(func(lang, v []byte) error {
+			llb := lb.Bucket(lang)
+			if llb == nil {
+				return nil
+			}
+			if _, ok := StoreToLang[string(lang)]; !ok {
+				problem(string(lang), "", "scrapes for an unknown language", nil)
+			}
+
+			lh := LangHealth{Lang: string(lang)}
+			err := llb.ForEach(func(k, v []byte) error {
+				k = append([]byte(nil), k...)
+				hlb := llb.Bucket(k)
+				if hlb == nil {
+					problem(lh.Lang, string(k), "not a scrape", func() error {
+						return llb.Delete(k)
+					})
+					return nil
+				}
+
+				ts, err := time.Parse(time.RFC3339, string(k))
+				if err != nil {
+					problem(lh.Lang, string(k), "the scrape time can't be parsed", func() error {
+						return llb.DeleteBucket(k)
+					})
+					return nil
+				}
+
+				if !lh.Last.IsZero() && !ts.Before(opts.GapsSince) {
+					if gap := ts.Sub(lh.Last); gap > opts.Interval+opts.Interval/4 {
+						problem(lh.Lang, string(k), fmt.Sprintf("%s since the scrape before", gap), nil)
+					}
+				}
+				if lh.First.IsZero() {
+					lh.First = ts
+				}
+				lh.Last = ts
+				lh.Scrapes++
+
+				return checkScrape(rc, hlb, func(ik, what string, repair bool) {
+					var fix func() error
+					if repair {
+						ik := []byte(ik)
+						fix = func() error { return hlb.Delete(ik) }
+					}
+					key := string(k)
+					if ik != "" {
+						key += " " + ik
+					}
+					problem(lh.Lang, key, what, fix)
+				})
+			})
+			rep.Langs = append(rep.Langs, lh)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, fix := range repairs {
+			if err := fix(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return rep, err
+}
+
+// checkScrape looks for items we can't read and for missing periods in a scrape.
+func checkScrape(rc *repoCache, hlb *bolt.Bucket, problem func(ik, what string, repair bool)) error {
+	seen := make(map[string]bool)
+	err := hlb.ForEach(func(ik, iv []byte) error {
+		period, _, err := splitItemKey(ik)
+		if err != nil {
+			problem(string(ik), "the item key can't be parsed", true)
+			return nil
+		}
+		if _, err := rc.item(iv); err != nil {
+			problem(string(ik), "the item can't be decoded", true)
+			return nil
+		}
+		seen[period] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, p := range []string{PeriodDaily, PeriodWeekly, PeriodMonthly} {
+		if !seen[p] {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) != 0 {
+		problem("", "missing periods "+strings.Join(missing, ", "), false)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// The bolt store used to keep every item as JSON, repeating the description of a
+// repository in every scrape it was in. Now the repository is stored once in the
+// repo table, and an item is only:
+//
+//	itemFormatCompact
+//	uvarint repo id
+//	varint stars, forks and stars increase
+//
+// A repository is stored under its id, as a big endian uint64, as:
+//
+//	uvarint length prefixed owner, name, description and language
+//	varint unix time it was last seen
+//
+// When a repository was seen in a feed is stored under seen/<lang>/<period>/
+// <owner>/<name> as the varint unix times it was first and last seen.
+
+// itemFormatCompact is the first byte of a compact item. JSON items start with
+// '{', so the two can be told apart.
+const itemFormatCompact = 0x01
+
+var ErrCorruptRecord = errors.New("Corrupt record")
+
+func repoIDKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+// encodeItem encodes the counts of an item. The rest is in the repo table.
+func encodeItem(id uint64, ti TrendingItem) []byte {
+	b := make([]byte, 0, 1+4*binary.MaxVarintLen64)
+	b = append(b, itemFormatCompact)
+	b = binary.AppendUvarint(b, id)
+	b = binary.AppendVarint(b, int64(ti.Stars))
+	b = binary.AppendVarint(b, int64(ti.Forks))
+	b = binary.AppendVarint(b, int64(ti.StarsIncrease))
+	return b
+}
+
+// decodeItem decodes an item, returning the repo id and the item with only the
+// counts filled in.
+func decodeItem(b []byte) (uint64, TrendingItem, error) {
+	var ti TrendingItem
+	if len(b) == 0 || b[0] != itemFormatCompact {
+		return 0, ti, ErrCorruptRecord
+	}
+	b = b[1:]
+
+	id, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, ti, ErrCorruptRecord
+	}
+	b = b[n:]
+
+	for _, dst := range []*int{&ti.Stars, &ti.Forks, &ti.StarsIncrease} {
+		v, n := binary.Varint(b)
+		if n <= 0 {
+			return 0, ti, ErrCorruptRecord
+		}
+		*dst = int(v)
+		b = b[n:]
+	}
+	if len(b) != 0 {
+		return 0, ti, ErrCorruptRecord
+	}
+	return id, ti, nil
+}
+
+func encodeRepo(ri RepoInfo) []byte {
+	var b []byte
+	for _, s := range []string{ri.Owner, ri.Name, ri.Description, ri.Language} {
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		b = append(b, s...)
+	}
+	return binary.AppendVarint(b, ri.LastSeen.Unix())
+}
+
+func decodeRepo(b []byte) (RepoInfo, error) {
+	var ri RepoInfo
+	for _, dst := range []*string{&ri.Owner, &ri.Name, &ri.Description, &ri.Language} {
+		l, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < l {
+			return ri, ErrCorruptRecord
+		}
+		*dst = string(b[n : n+int(l)])
+		b = b[n+int(l):]
+	}
+
+	ts, n := binary.Varint(b)
+	if n <= 0 || len(b) != n {
+		return ri, ErrCorruptRecord
+	}
+	ri.LastSeen = time.Unix(ts, 0).UTC()
+	return ri, nil
+}
+
+func encodeSeen(fs FeedSeen) []byte {
+	b := make([]byte, 0, 2*binary.MaxVarintLen64)
+	b = binary.AppendVarint(b, fs.FirstSeen.Unix())
+	return binary.AppendVarint(b, fs.LastSeen.Unix())
+}
+
+func decodeSeen(b []byte) (FeedSeen, error) {
+	var fs FeedSeen
+	first, n := binary.Varint(b)
+	if n <= 0 {
+		return fs, ErrCorruptRecord
+	}
+	last, m := binary.Varint(b[n:])
+	if m <= 0 || len(b) != n+m {
+		return fs, ErrCorruptRecord
+	}
+	fs.FirstSeen = time.Unix(first, 0).UTC()
+	fs.LastSeen = time.Unix(last, 0).UTC()
+	return fs, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventsKeepAlive is how often an idle event stream gets a comment, so that
+// proxies don't close it.
+const eventsKeepAlive = 30 * time.Second
+
+// ScrapeEvent says that a new scrape of a language has been saved.
+type ScrapeEvent struct {
+	Language  string    `json:"language"`
+	ScrapedAt time.Time `json:"scraped_at"`
+	RunID     int       `json:"run_id"`
+}
+
+// scrapeEvents passes the scrapes saved by a crawler on to whoever listens.
+// Listeners that fall behind miss events rather than hold up the refresh.
+type scrapeEvents struct {
+	mu   sync.Mutex
+	subs map[chan ScrapeEvent]bool
+	// done is closed when the server stops, to end the streams.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func newScrapeEvents() *scrapeEvents {
+	return &scrapeEvents{
+		subs: make(map[chan ScrapeEvent]bool),
+		done: make(chan struct{}),
+	}
+}
+
+// subscribe returns a channel getting the events from now on, and a function
+// to stop getting them.
+func (se *scrapeEvents) subscribe() (<-chan ScrapeEvent, func()) {
+	ch := make(chan ScrapeEvent, 16)
+	se.mu.Lock()
+	se.subs[ch] = true
+	se.mu.Unlock()
+	return ch, func() {
+		se.mu.Lock()
+		delete(se.subs, ch)
+		se.mu.Unlock()
+	}
+}
+
+func (se *scrapeEvents) publish(ev ScrapeEvent) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	for ch := range se.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// close ends all streams, as the server won't stop while they are open.
+func (se *scrapeEvents) close() {
+	se.doneOnce.Do(func() { close(se.done) })
+}
+
+// apiEvents streams a "scrape" event with a ScrapeEvent each time a scrape is
+// saved, as server-sent events. The langs parameter limits them to those
+// languages.
+func apiEvents(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+
+	want := make(map[string]bool)
+	if s := r.URL.Query().Get("langs"); s != "" {
+		for _, n := range strings.Split(s, ",") {
+			if _, ok := StoreToLang[n]; !ok {
+				apiError(w, "Unknown language: "+n, http.StatusBadRequest)
+				return
+			}
+			want[n] = true
+		}
+	}
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		apiError(w, "Streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	evs, stop := c.events.subscribe()
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Otherwise nginx holds the events back until it has enough of them.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": listening\n\n")
+	fl.Flush()
+
+	tick := time.NewTicker(eventsKeepAlive)
+	defer tick.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c.events.done:
+			return
+		case <-tick.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case ev := <-evs:
+			if len(want) != 0 && !want[ev.Language] {
+				continue
+			}
+			bb, err := json.Marshal(ev)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: scrape\ndata: %s\n\n", bb)
+		}
+		fl.Flush()
+	}
+}
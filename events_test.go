@@ -0,0 +1,179 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trendingFixture is a trending page with a single repo.
+const trendingFixture = `<html><body>
+<article class="Box-row">
+	<h1 class="h3 lh-condensed"><a href="/o/r">o / r</a></h1>
+	<p>A repo</p>
+	<a href="/o/r/stargazers.r">1,234</a>
+	<span class="d-inline-block float-sm-right">12 stars today</span>
+</article>
+</body></html>`
+
+// fixtureTransport answers every request with the trending fixture, so
+// refreshing doesn't go to GitHub.
+type fixtureTransport struct{}
+
+func (fixtureTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       io.NopCloser(strings.NewReader(trendingFixture)),
+		Request:    r,
+	}, nil
+}
+
+func TestRefreshPublishes(t *testing.T) {
+	c, err := NewCrawler("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.c.Transport = fixtureTransport{}
+	for _, l := range []Language{LangGo, LangRust} {
+		if err := c.Follow(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	evs, stop := c.events.subscribe()
+	defer stop()
+
+	// Each event is checked as it comes, to see that the scrape was saved
+	// before anyone was told about it.
+	type got struct {
+		ev    ScrapeEvent
+		saved bool
+	}
+	gots := make(chan got)
+	go func() {
+		for ev := range evs {
+			times, err := c.ScrapeHistory(StoreToLang[ev.Language])
+			gots <- got{ev, err == nil && slices.ContainsFunc(times, ev.ScrapedAt.Equal)}
+		}
+	}()
+
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	tis, _, err := c.Latest(LangGo, PeriodDaily)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tis) != 1 || tis[0].RepoOwner != "o" || tis[0].Stars != 1234 || tis[0].StarsIncrease != 12 {
+		t.Errorf("got %+v, want o/r from the fixture", tis)
+	}
+	runs := c.Runs()
+	if len(runs) != 1 {
+		t.Fatalf("got %d runs, want 1", len(runs))
+	}
+
+	var langs []string
+	for range 2 {
+		select {
+		case g := <-gots:
+			if !g.saved {
+				t.Errorf("got an event for %s before the scrape was saved", g.ev.Language)
+			}
+			if g.ev.RunID != runs[0].ID {
+				t.Errorf("got run %d, want %d", g.ev.RunID, runs[0].ID)
+			}
+			langs = append(langs, g.ev.Language)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got events for %v, want go and rust", langs)
+		}
+	}
+	select {
+	case g := <-gots:
+		t.Errorf("got another event %+v", g.ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+	slices.Sort(langs)
+	if !slices.Equal(langs, []string{"go", "rust"}) {
+		t.Errorf("got events for %v, want go and rust", langs)
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	c, err := NewCrawler("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	srv := httptest.NewServer(NewWebsite(c, WebsiteOptions{}))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/api/v1/events?langs=rust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got content type %q, want text/event-stream", ct)
+	}
+	br := bufio.NewReader(res.Body)
+	if l, err := br.ReadString('\n'); err != nil || l != ": listening\n" {
+		t.Fatalf("got %q and %v, want the stream to start", l, err)
+	}
+
+	// Only rust is asked for, so go is left out.
+	ts := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	c.events.publish(ScrapeEvent{Language: "go", ScrapedAt: ts, RunID: 1})
+	c.events.publish(ScrapeEvent{Language: "rust", ScrapedAt: ts, RunID: 1})
+	var lines []string
+	for len(lines) < 2 {
+		l, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	want := []string{"event: scrape", `data: {"language":"rust","scraped_at":"2026-09-01T00:00:00Z","run_id":1}`}
+	if !slices.Equal(lines, want) {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+
+	// Shutting down ends the stream, or the server would wait for it.
+	done := make(chan error)
+	go func() {
+		_, err := io.Copy(io.Discard, br)
+		done <- err
+	}()
+	c.events.close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("got %v, want the stream to end", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream didn't end")
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	FormatJSONL   = "jsonl"
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+// ScrapeRecord is a single trending item from a scrape, flattened so it can be
+// exported as one row. Rank starts at 1.
+type ScrapeRecord struct {
+	Language      string    `json:"language" parquet:"language"`
+	Period        string    `json:"period" parquet:"period"`
+	ScrapedAt     time.Time `json:"scraped_at" parquet:"scraped_at,timestamp(millisecond)"`
+	Rank          int       `json:"rank" parquet:"rank"`
+	RepoOwner     string    `json:"repo_owner" parquet:"repo_owner"`
+	RepoName      string    `json:"repo_name" parquet:"repo_name"`
+	Description   string    `json:"description" parquet:"description"`
+	RepoLanguage  string    `json:"repo_language" parquet:"repo_language"`
+	Forks         int       `json:"forks" parquet:"forks"`
+	Stars         int       `json:"stars" parquet:"stars"`
+	StarsIncrease int       `json:"stars_increase" parquet:"stars_increase"`
+}
+
+var csvHeader = []string{
+	"language", "period", "scraped_at", "rank", "repo_owner", "repo_name",
+	"description", "repo_language", "forks", "stars", "stars_increase",
+}
+
+// RecordFilter limits which records are exported. Zero values match everything.
+type RecordFilter struct {
+	Langs  []Language
+	Period string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f RecordFilter) matchLang(lang string) bool {
+	if len(f.Langs) == 0 {
+		return true
+	}
+	for _, l := range f.Langs {
+		if l.StoreName == lang {
+			return true
+		}
+	}
+	return false
+}
+
+func (f RecordFilter) matchTime(ts time.Time) bool {
+	if !f.Since.IsZero() && ts.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && ts.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// TrendingItem returns the item part of the record.
+func (r ScrapeRecord) TrendingItem() TrendingItem {
+	return TrendingItem{
+		RepoOwner:     r.RepoOwner,
+		RepoName:      r.RepoName,
+		Description:   r.Description,
+		Language:      r.RepoLanguage,
+		Forks:         r.Forks,
+		Stars:         r.Stars,
+		StarsIncrease: r.StarsIncrease,
+	}
+}
+
+func newScrapeRecord(lang, period string, ts time.Time, rank int, ti TrendingItem) ScrapeRecord {
+	return ScrapeRecord{
+		Language:      lang,
+		Period:        period,
+		ScrapedAt:     ts,
+		Rank:          rank,
+		RepoOwner:     ti.RepoOwner,
+		RepoName:      ti.RepoName,
+		Description:   ti.Description,
+		RepoLanguage:  ti.Language,
+		Forks:         ti.Forks,
+		Stars:         ti.Stars,
+		StarsIncrease: ti.StarsIncrease,
+	}
+}
+
+// splitItemKey splits a key of the form "daily-03" into the period and the rank,
+// which starts at 1.
+func splitItemKey(k []byte) (string, int, error) {
+	i := bytes.LastIndexByte(k, '-')
+	if i < 0 {
+		return "", 0, fmt.Errorf("Invalid item key: %q", k)
+	}
+	n, err := strconv.Atoi(string(k[i+1:]))
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid item key: %q", k)
+	}
+	return string(k[:i]), n + 1, nil
+}
+
+// ImportRecords stores the records read from next until it returns io.EOF. The
+// records are written to the same place they were exported from, so importing
+// the same data twice leaves the store unchanged.
+func (c *Crawler) ImportRecords(next func() (ScrapeRecord, error)) (int, error) {
+	sw := &scrapeWriter{s: c}
+	for {
+		r, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return sw.n, err
+		}
+		if err := sw.add(r); err != nil {
+			return sw.n, err
+		}
+	}
+	return sw.n, sw.flush()
+}
+
+func validateRecord(r ScrapeRecord) error {
+	if _, ok := StoreToLang[r.Language]; !ok {
+		return fmt.Errorf("Unknown language: %s", r.Language)
+	}
+	switch r.Period {
+	case PeriodDaily, PeriodWeekly, PeriodMonthly:
+	default:
+		return fmt.Errorf("Unknown period: %s", r.Period)
+	}
+	if r.ScrapedAt.IsZero() {
+		return errors.New("Record is missing the scrape time")
+	}
+	if r.Rank < 1 || r.Rank > maxRank {
+		return fmt.Errorf("Invalid rank: %d", r.Rank)
+	}
+	return nil
+}
+
+// RecordWriter writes records in one of the export formats.
+type RecordWriter interface {
+	Write(r ScrapeRecord) error
+	Close() error
+}
+
+// NewRecordWriter returns a writer for the given format.
+func NewRecordWriter(format string, w io.Writer) (RecordWriter, error) {
+	switch format {
+	case FormatJSONL:
+		bw := bufio.NewWriter(w)
+		return &jsonlWriter{bw: bw, enc: json.NewEncoder(bw)}, nil
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvHeader); err != nil {
+			return nil, err
+		}
+		return &csvWriter{cw: cw}, nil
+	case FormatParquet:
+		return &parquetWriter{pw: parquet.NewGenericWriter[ScrapeRecord](w)}, nil
+	default:
+		return nil, fmt.Errorf("Unknown format: %s", format)
+	}
+}
+
+type jsonlWriter struct {
+	bw  *bufio.Writer
+	enc *json.Encoder
+}
+
+func (w *jsonlWriter) Write(r ScrapeRecord) error { return w.enc.Encode(r) }
+func (w *jsonlWriter) Close() error               { return w.bw.Flush() }
+
+type csvWriter struct {
+	cw *csv.Writer
+}
+
+func (w *csvWriter) Write(r ScrapeRecord) error {
+	return w.cw.Write([]string{
+		r.Language,
+		r.Period,
+		r.ScrapedAt.UTC().Format(time.RFC3339),
+		strconv.Itoa(r.Rank),
+		r.RepoOwner,
+		r.RepoName,
+		r.Description,
+		r.RepoLanguage,
+		strconv.Itoa(r.Forks),
+		strconv.Itoa(r.Stars),
+		strconv.Itoa(r.StarsIncrease),
+	})
+}
+
+func (w *csvWriter) Close() error {
+	w.cw.Flush()
+	return w.cw.Error()
+}
+
+type parquetWriter struct {
+	pw *parquet.GenericWriter[ScrapeRecord]
+}
+
+func (w *parquetWriter) Write(r ScrapeRecord) error {
+	_, err := w.pw.Write([]ScrapeRecord{r})
+	return err
+}
+
+func (w *parquetWriter) Close() error { return w.pw.Close() }
+
+// NewRecordReader returns a function reading records in the given format, which
+// returns io.EOF when there are no more. Parquet needs random access, so it is
+// read into memory first.
+func NewRecordReader(format string, r io.Reader) (func() (ScrapeRecord, error), error) {
+	switch format {
+	case FormatJSONL:
+		dec := json.NewDecoder(r)
+		return func() (ScrapeRecord, error) {
+			var rec ScrapeRecord
+			err := dec.Decode(&rec)
+			return rec, err
+		}, nil
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		header, err := cr.Read()
+		if err != nil {
+			return nil, err
+		}
+		if strings.Join(header, ",") != strings.Join(csvHeader, ",") {
+			return nil, errors.New("Unexpected CSV header")
+		}
+		return func() (ScrapeRecord, error) {
+			row, err := cr.Read()
+			if err != nil {
+				return ScrapeRecord{}, err
+			}
+			return parseCSVRecord(row)
+		}, nil
+	case FormatParquet:
+		bb, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		pr := parquet.NewGenericReader[ScrapeRecord](bytes.NewReader(bb))
+		buf := make([]ScrapeRecord, 1)
+		return func() (ScrapeRecord, error) {
+			n, err := pr.Read(buf)
+			if n == 1 {
+				return buf[0], nil
+			}
+			if err == nil {
+				err = io.EOF
+			}
+			pr.Close()
+			return ScrapeRecord{}, err
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unknown format: %s", format)
+	}
+}
+
+func parseCSVRecord(row []string) (ScrapeRecord, error) {
+	var rec ScrapeRecord
+	var err error
+
+	ints := make([]int, 4)
+	for i, col := range []int{3, 8, 9, 10} {
+		ints[i], err = strconv.Atoi(row[col])
+		if err != nil {
+			return rec, fmt.Errorf("Invalid %s: %s", csvHeader[col], err.Error())
+		}
+	}
+	ts, err := time.Parse(time.RFC3339, row[2])
+	if err != nil {
+		return rec, err
+	}
+
+	rec = ScrapeRecord{
+		Language:      row[0],
+		Period:        row[1],
+		ScrapedAt:     ts,
+		Rank:          ints[0],
+		RepoOwner:     row[4],
+		RepoName:      row[5],
+		Description:   row[6],
+		RepoLanguage:  row[7],
+		Forks:         ints[1],
+		Stars:         ints[2],
+		StarsIncrease: ints[3],
+	}
+	return rec, nil
+}
+
+// formatFromPath guesses the format from the file extension.
+func formatFromPath(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".csv"):
+		return FormatCSV
+	case strings.HasSuffix(path, ".parquet"):
+		return FormatParquet
+	default:
+		return FormatJSONL
+	}
+}
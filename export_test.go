@@ -0,0 +1,53 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateRecord(t *testing.T) {
+	ok := ScrapeRecord{
+		Language:  "go",
+		Period:    PeriodDaily,
+		ScrapedAt: time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC),
+		Rank:      1,
+		RepoOwner: "o",
+		RepoName:  "r",
+	}
+	tests := []struct {
+		name    string
+		change  func(r *ScrapeRecord)
+		wantErr bool
+	}{
+		{"valid", func(r *ScrapeRecord) {}, false},
+		{"last rank", func(r *ScrapeRecord) { r.Rank = maxRank }, false},
+		{"unknown language", func(r *ScrapeRecord) { r.Language = "cobol-2050" }, true},
+		{"unknown period", func(r *ScrapeRecord) { r.Period = "yearly" }, true},
+		{"no time", func(r *ScrapeRecord) { r.ScrapedAt = time.Time{} }, true},
+		{"rank zero", func(r *ScrapeRecord) { r.Rank = 0 }, true},
+		{"rank past the keys", func(r *ScrapeRecord) { r.Rank = maxRank + 1 }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := ok
+			tt.change(&r)
+			if err := validateRecord(r); (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	SortRank     = "rank"
+	SortStars    = "stars"
+	SortIncrease = "increase"
+	SortForks    = "forks"
+)
+
+// Sorts are the orders the items of a feed can be shown in.
+var Sorts = []string{SortRank, SortStars, SortIncrease, SortForks}
+
+// ItemFilter picks and orders the items shown from a feed.
+type ItemFilter struct {
+	MinStars    int
+	MinIncrease int
+	// Keyword must be in the description, ignoring case.
+	Keyword       string
+	ExcludeOwners []string
+	Sort          string
+}
+
+// filterParams are the query parameters of an ItemFilter.
+var filterParams = []string{"min_stars", "min_increase", "q", "exclude", "sort"}
+
+// parseItemFilter reads the filter from the min_stars, min_increase, q, exclude
+// and sort query parameters, all of which may be empty.
+func parseItemFilter(qv url.Values) (ItemFilter, error) {
+	f := ItemFilter{
+		Keyword: strings.TrimSpace(qv.Get("q")),
+		Sort:    qv.Get("sort"),
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"min_stars", &f.MinStars}, {"min_increase", &f.MinIncrease}} {
+		s := qv.Get(p.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return f, &QueryError{p.name, s}
+		}
+		*p.dst = n
+	}
+
+	for _, o := range strings.Split(qv.Get("exclude"), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			f.ExcludeOwners = append(f.ExcludeOwners, o)
+		}
+	}
+
+	switch f.Sort {
+	case "":
+		f.Sort = SortRank
+	case SortRank, SortStars, SortIncrease, SortForks:
+	default:
+		return f, &QueryError{"sort", f.Sort}
+	}
+	return f, nil
+}
+
+// Apply returns the items passing the filter, in its order.
+func (f ItemFilter) Apply(its []IndexItem) []IndexItem {
+	keyword := strings.ToLower(f.Keyword)
+	out := make([]IndexItem, 0, len(its))
+	for _, it := range its {
+		if it.Stars < f.MinStars || it.StarsIncrease < f.MinIncrease {
+			continue
+		}
+		if keyword != "" && !strings.Contains(strings.ToLower(it.Description), keyword) {
+			continue
+		}
+		if f.excluded(it.RepoOwner) {
+			continue
+		}
+		out = append(out, it)
+	}
+
+	var key func(it IndexItem) int
+	switch f.Sort {
+	case SortStars:
+		key = func(it IndexItem) int { return it.Stars }
+	case SortIncrease:
+		key = func(it IndexItem) int { return it.StarsIncrease }
+	case SortForks:
+		key = func(it IndexItem) int { return it.Forks }
+	default:
+		return out
+	}
+	// Stable, so that ties stay in rank order.
+	sort.SliceStable(out, func(i, j int) bool { return key(out[i]) > key(out[j]) })
+	return out
+}
+
+func (f ItemFilter) excluded(owner string) bool {
+	for _, o := range f.ExcludeOwners {
+		if strings.EqualFold(o, owner) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseTrendingQueryFilter(t *testing.T) {
+	tests := []struct {
+		query string
+		want  ItemFilter
+		// bad is the parameter of the QueryError, if any.
+		bad string
+	}{
+		{"", ItemFilter{Sort: SortRank}, ""},
+		{"min_stars=10&min_increase=3", ItemFilter{MinStars: 10, MinIncrease: 3, Sort: SortRank}, ""},
+		{"min_stars=0", ItemFilter{Sort: SortRank}, ""},
+		{"min_stars=-1", ItemFilter{}, "min_stars"},
+		{"min_stars=many", ItemFilter{}, "min_stars"},
+		{"min_increase=1.5", ItemFilter{}, "min_increase"},
+		{"q=+Parser+", ItemFilter{Keyword: "Parser", Sort: SortRank}, ""},
+		{"exclude=a,+b+,,c", ItemFilter{ExcludeOwners: []string{"a", "b", "c"}, Sort: SortRank}, ""},
+		{"exclude=,", ItemFilter{Sort: SortRank}, ""},
+		{"sort=rank", ItemFilter{Sort: SortRank}, ""},
+		{"sort=stars", ItemFilter{Sort: SortStars}, ""},
+		{"sort=increase", ItemFilter{Sort: SortIncrease}, ""},
+		{"sort=forks", ItemFilter{Sort: SortForks}, ""},
+		{"sort=name", ItemFilter{}, "sort"},
+	}
+	for _, tt := range tests {
+		qv, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := parseTrendingQuery(qv)
+		if tt.bad != "" {
+			var qe *QueryError
+			if !errors.As(err, &qe) || qe.Param != tt.bad {
+				t.Errorf("%q: got error %v, want a QueryError for %s", tt.query, err, tt.bad)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(q.Filter, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.query, q.Filter, tt.want)
+		}
+	}
+}
+
+func TestItemFilterApply(t *testing.T) {
+	its := indexItems([]TrendingItem{
+		{RepoOwner: "a", RepoName: "one", Description: "A fast parser", Stars: 100, StarsIncrease: 5, Forks: 1},
+		{RepoOwner: "b", RepoName: "two", Description: "Web framework", Stars: 50, StarsIncrease: 20, Forks: 9},
+		{RepoOwner: "c", RepoName: "three", Description: "Parser combinators", Stars: 300, StarsIncrease: 5, Forks: 3},
+		{RepoOwner: "B", RepoName: "four", Description: "Tool", Stars: 10, StarsIncrease: 2, Forks: 0},
+	})
+	tests := []struct {
+		f    ItemFilter
+		want []string
+	}{
+		{ItemFilter{Sort: SortRank}, []string{"one", "two", "three", "four"}},
+		{ItemFilter{MinStars: 50}, []string{"one", "two", "three"}},
+		{ItemFilter{MinIncrease: 5}, []string{"one", "two", "three"}},
+		{ItemFilter{Keyword: "PARSER"}, []string{"one", "three"}},
+		{ItemFilter{ExcludeOwners: []string{"b"}}, []string{"one", "three"}},
+		{ItemFilter{Sort: SortStars}, []string{"three", "one", "two", "four"}},
+		// Ties stay in rank order.
+		{ItemFilter{Sort: SortIncrease}, []string{"two", "one", "three", "four"}},
+		{ItemFilter{Sort: SortForks, MinStars: 20}, []string{"two", "three", "one"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, it := range tt.f.Apply(its) {
+			got = append(got, it.RepoName)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.f, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// DefaultStaleAfter is how old the newest scrape of a language may be before
+// it is stale, when not given. It is three refreshes at the default interval.
+const DefaultStaleAfter = 12 * time.Hour
+
+const (
+	HealthOK    = "ok"
+	HealthStale = "stale"
+	HealthError = "error"
+)
+
+// Health is the answer of /healthz and /readyz. Status is ok, stale or error.
+type Health struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// StaleAfter is in seconds, like the ages.
+	StaleAfter float64          `json:"stale_after_seconds,omitempty"`
+	Languages  []LanguageHealth `json:"languages,omitempty"`
+	LastRun    *V2Run           `json:"last_run,omitempty"`
+}
+
+// LanguageHealth is how fresh the scrapes of a followed language are.
+type LanguageHealth struct {
+	Language string `json:"language"`
+	// LatestScrapeAt is nil if the language has never been scraped.
+	LatestScrapeAt *time.Time `json:"latest_scrape_at"`
+	AgeSeconds     float64    `json:"age_seconds,omitempty"`
+	Stale          bool       `json:"stale"`
+}
+
+// checkHealth checks that the database can be read, and with staleAfter set,
+// that every followed language has been scraped within it.
+func (c *Crawler) checkHealth(staleAfter time.Duration, now time.Time) Health {
+	h := Health{Status: HealthOK}
+	fs, err := c.Follows()
+	if err != nil {
+		h.Status, h.Error = HealthError, "Couldn't read the database: "+err.Error()
+		return h
+	}
+	if staleAfter == 0 {
+		return h
+	}
+
+	h.StaleAfter = staleAfter.Seconds()
+	h.Languages = []LanguageHealth{}
+	for _, f := range fs {
+		ts, err := c.ScrapeHistory(f)
+		if err != nil && err != ErrNoScrapesForLang {
+			h.Status, h.Error = HealthError, "Couldn't read the database: "+err.Error()
+			return h
+		}
+		lh := LanguageHealth{Language: f.StoreName, Stale: true}
+		var latest time.Time
+		for _, t := range ts {
+			if t.After(latest) {
+				latest = t
+			}
+		}
+		if !latest.IsZero() {
+			latest = latest.UTC()
+			lh.LatestScrapeAt = &latest
+			lh.AgeSeconds = now.Sub(latest).Truncate(time.Second).Seconds()
+			lh.Stale = now.Sub(latest) > staleAfter
+		}
+		if lh.Stale {
+			h.Status = HealthStale
+		}
+		h.Languages = append(h.Languages, lh)
+	}
+	if rs := c.Runs(); len(rs) != 0 {
+		vr := v2RunOf(rs[0])
+		h.LastRun = &vr
+	}
+	return h
+}
+
+// writeHealth writes h, with 503 unless everything is ok.
+func writeHealth(w http.ResponseWriter, h Health) {
+	code := http.StatusOK
+	if h.Status != HealthOK {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, code, h)
+}
+
+// healthz says if the server is alive, which is when it can read the database.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	writeHealth(w, c.checkHealth(0, time.Now()))
+}
+
+// readyz says if the server has fresh data to show. Every followed language
+// must have been scraped within the StaleAfter of the options, so a refresher
+// that has stopped shows up here.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	opts := r.Context().Value(ctxOptions).(WebsiteOptions)
+	writeHealth(w, c.checkHealth(opts.StaleAfter, time.Now()))
+}
@@ -0,0 +1,216 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Streak is a run of scrapes of a language in a row where a repo was trending.
+// Pruning thins out old scrapes, so for those it counts the scrapes we kept.
+type Streak struct {
+	Lang    string
+	Owner   string
+	Name    string
+	Scrapes int
+	From    time.Time
+	To      time.Time
+}
+
+// RepoStats is how a repo has done over all the scrapes it was in.
+type RepoStats struct {
+	Owner string
+	Name  string
+	// Appearances counts every list the repo was in, so being in both the daily
+	// and the weekly list of a scrape counts twice.
+	Appearances int
+	AvgRank     float64
+	BestRank    int
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	// StarGain is how many stars the repo got from the first to the last time
+	// it was trending.
+	StarGain      int
+	LongestStreak int
+
+	rankSum    int
+	firstStars int
+	lastStars  int
+}
+
+// OwnerStats is how often the repos of an owner have been trending.
+type OwnerStats struct {
+	Owner       string
+	Appearances int
+	Repos       int
+}
+
+// Leaderboards is what we get from going through the history.
+type Leaderboards struct {
+	// Streaks has the longest streak of each language.
+	Streaks []Streak
+	// Repos is sorted by star gain.
+	Repos []RepoStats
+	// Owners is sorted by appearances.
+	Owners []OwnerStats
+}
+
+// Leaderboards goes through the stored history matching the filter. The repos and
+// owners are cut to the limit, unless it is 0.
+func (c *Crawler) Leaderboards(f RecordFilter, limit int) (Leaderboards, error) {
+	var lb Leaderboards
+	repos := make(map[string]*RepoStats)
+	owners := make(map[string]*OwnerStats)
+
+	// Records come ordered by language and scrape time, so the streaks can be
+	// counted a language at a time by numbering its scrapes.
+	type run struct {
+		last, len int
+		from      time.Time
+	}
+	var (
+		runs  map[string]*run
+		best  *Streak
+		lang  string
+		n     int
+		prevT time.Time
+	)
+	endLang := func() {
+		if best != nil {
+			lb.Streaks = append(lb.Streaks, *best)
+		}
+		best = nil
+	}
+
+	err := c.ForEachRecord(f, func(r ScrapeRecord) error {
+		if r.Language != lang {
+			endLang()
+			lang = r.Language
+			runs = make(map[string]*run)
+			n = 0
+		}
+		if !r.ScrapedAt.Equal(prevT) || n == 0 {
+			prevT = r.ScrapedAt
+			n++
+		}
+
+		key := r.RepoOwner + "/" + r.RepoName
+		rs, ok := repos[key]
+		if !ok {
+			rs = &RepoStats{
+				Owner:      r.RepoOwner,
+				Name:       r.RepoName,
+				BestRank:   r.Rank,
+				FirstSeen:  r.ScrapedAt,
+				LastSeen:   r.ScrapedAt,
+				firstStars: r.Stars,
+				lastStars:  r.Stars,
+			}
+			repos[key] = rs
+
+			ow, ok := owners[r.RepoOwner]
+			if !ok {
+				ow = &OwnerStats{Owner: r.RepoOwner}
+				owners[r.RepoOwner] = ow
+			}
+			ow.Repos++
+		}
+		rs.Appearances++
+		rs.rankSum += r.Rank
+		if r.Rank < rs.BestRank {
+			rs.BestRank = r.Rank
+		}
+		if r.ScrapedAt.Before(rs.FirstSeen) {
+			rs.FirstSeen, rs.firstStars = r.ScrapedAt, r.Stars
+		}
+		if r.ScrapedAt.After(rs.LastSeen) {
+			rs.LastSeen, rs.lastStars = r.ScrapedAt, r.Stars
+		}
+		owners[r.RepoOwner].Appearances++
+
+		ru, ok := runs[key]
+		switch {
+		case !ok:
+			ru = &run{}
+			runs[key] = ru
+			fallthrough
+		case ru.last < n-1:
+			ru.len, ru.from = 1, r.ScrapedAt
+		case ru.last == n-1:
+			ru.len++
+		default:
+			// Already counted in this scrape.
+			return nil
+		}
+		ru.last = n
+
+		if ru.len > rs.LongestStreak {
+			rs.LongestStreak = ru.len
+		}
+		if best == nil || ru.len > best.Scrapes {
+			best = &Streak{
+				Lang:    lang,
+				Owner:   r.RepoOwner,
+				Name:    r.RepoName,
+				Scrapes: ru.len,
+				From:    ru.from,
+				To:      r.ScrapedAt,
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return lb, err
+	}
+	endLang()
+
+	for _, rs := range repos {
+		rs.AvgRank = float64(rs.rankSum) / float64(rs.Appearances)
+		rs.StarGain = rs.lastStars - rs.firstStars
+		lb.Repos = append(lb.Repos, *rs)
+	}
+	sort.Slice(lb.Repos, func(i, j int) bool {
+		a, b := lb.Repos[i], lb.Repos[j]
+		if a.StarGain != b.StarGain {
+			return a.StarGain > b.StarGain
+		}
+		if a.Owner != b.Owner {
+			return a.Owner < b.Owner
+		}
+		return a.Name < b.Name
+	})
+
+	for _, ow := range owners {
+		lb.Owners = append(lb.Owners, *ow)
+	}
+	sort.Slice(lb.Owners, func(i, j int) bool {
+		a, b := lb.Owners[i], lb.Owners[j]
+		if a.Appearances != b.Appearances {
+			return a.Appearances > b.Appearances
+		}
+		return a.Owner < b.Owner
+	})
+
+	if limit > 0 {
+		if len(lb.Repos) > limit {
+			lb.Repos = lb.Repos[:limit]
+		}
+		if len(lb.Owners) > limit {
+			lb.Owners = lb.Owners[:limit]
+		}
+	}
+	return lb, nil
+}
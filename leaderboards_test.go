@@ -0,0 +1,179 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// lbScrape is a scrape for the leaderboards, taken hours after lbStart.
+type lbScrape struct {
+	lang    Language
+	hours   int
+	periods map[string][]TrendingItem
+}
+
+var lbStart = time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+
+func lbAt(hours int) time.Time {
+	return lbStart.Add(time.Duration(hours) * time.Hour)
+}
+
+// lbItem is a repo with the stars it had.
+func lbItem(owner, name string, stars int) TrendingItem {
+	return TrendingItem{RepoOwner: owner, RepoName: name, Language: "Go", Stars: stars}
+}
+
+// lbRepo is what we check of the stats of a repo.
+type lbRepo struct {
+	Key           string
+	Appearances   int
+	AvgRank       float64
+	BestRank      int
+	StarGain      int
+	LongestStreak int
+}
+
+func TestLeaderboards(t *testing.T) {
+	x, y := "a/x", "b/y"
+	tests := []struct {
+		name    string
+		scrapes []lbScrape
+		limit   int
+		streaks []Streak
+		// repos are in the order of the leaderboard.
+		repos  []lbRepo
+		owners []OwnerStats
+	}{
+		{
+			name: "a gap ends a streak",
+			scrapes: []lbScrape{
+				{LangGo, 0, map[string][]TrendingItem{PeriodDaily: {lbItem("a", "x", 10)}}},
+				{LangGo, 1, map[string][]TrendingItem{PeriodDaily: {lbItem("a", "x", 12)}}},
+				{LangGo, 2, map[string][]TrendingItem{PeriodDaily: {lbItem("b", "y", 5)}}},
+				{LangGo, 3, map[string][]TrendingItem{PeriodDaily: {lbItem("a", "x", 20), lbItem("b", "y", 6)}}},
+			},
+			// y ties with x at the end, and the first to get there is kept.
+			streaks: []Streak{{Lang: "go", Owner: "a", Name: "x", Scrapes: 2, From: lbAt(0), To: lbAt(1)}},
+			repos: []lbRepo{
+				{Key: x, Appearances: 3, AvgRank: 1, BestRank: 1, StarGain: 10, LongestStreak: 2},
+				{Key: y, Appearances: 2, AvgRank: 1.5, BestRank: 1, StarGain: 1, LongestStreak: 2},
+			},
+			owners: []OwnerStats{{Owner: "a", Appearances: 3, Repos: 1}, {Owner: "b", Appearances: 2, Repos: 1}},
+		},
+		{
+			name: "several periods of a scrape are one step of a streak",
+			scrapes: []lbScrape{
+				{LangGo, 0, map[string][]TrendingItem{
+					PeriodDaily:  {lbItem("a", "x", 10)},
+					PeriodWeekly: {lbItem("b", "y", 3), lbItem("a", "x", 10)},
+				}},
+				{LangGo, 1, map[string][]TrendingItem{PeriodMonthly: {lbItem("a", "x", 11)}}},
+			},
+			streaks: []Streak{{Lang: "go", Owner: "a", Name: "x", Scrapes: 2, From: lbAt(0), To: lbAt(1)}},
+			repos: []lbRepo{
+				{Key: x, Appearances: 3, AvgRank: 4.0 / 3, BestRank: 1, StarGain: 1, LongestStreak: 2},
+				{Key: y, Appearances: 1, AvgRank: 1, BestRank: 1, StarGain: 0, LongestStreak: 1},
+			},
+			owners: []OwnerStats{{Owner: "a", Appearances: 3, Repos: 1}, {Owner: "b", Appearances: 1, Repos: 1}},
+		},
+		{
+			name: "languages have streaks of their own",
+			scrapes: []lbScrape{
+				{LangGo, 0, map[string][]TrendingItem{PeriodDaily: {lbItem("a", "x", 10)}}},
+				{LangGo, 1, map[string][]TrendingItem{PeriodDaily: {lbItem("a", "x", 11)}}},
+				{LangRust, 0, map[string][]TrendingItem{PeriodDaily: {lbItem("b", "y", 1)}}},
+				{LangRust, 1, map[string][]TrendingItem{PeriodDaily: {lbItem("a", "x", 11)}}},
+				{LangRust, 2, map[string][]TrendingItem{PeriodDaily: {lbItem("a", "x", 13)}}},
+				{LangRust, 3, map[string][]TrendingItem{PeriodDaily: {lbItem("a", "x", 14)}}},
+			},
+			streaks: []Streak{
+				{Lang: "go", Owner: "a", Name: "x", Scrapes: 2, From: lbAt(0), To: lbAt(1)},
+				{Lang: "rust", Owner: "a", Name: "x", Scrapes: 3, From: lbAt(1), To: lbAt(3)},
+			},
+			repos: []lbRepo{
+				{Key: x, Appearances: 5, AvgRank: 1, BestRank: 1, StarGain: 4, LongestStreak: 3},
+				{Key: y, Appearances: 1, AvgRank: 1, BestRank: 1, StarGain: 0, LongestStreak: 1},
+			},
+			owners: []OwnerStats{{Owner: "a", Appearances: 5, Repos: 1}, {Owner: "b", Appearances: 1, Repos: 1}},
+		},
+		{
+			name: "owners count all their repos",
+			scrapes: []lbScrape{
+				{LangGo, 0, map[string][]TrendingItem{PeriodDaily: {lbItem("a", "x", 1), lbItem("a", "z", 1), lbItem("b", "y", 1)}}},
+				{LangGo, 1, map[string][]TrendingItem{PeriodDaily: {lbItem("b", "y", 2)}}},
+				{LangGo, 2, map[string][]TrendingItem{PeriodDaily: {lbItem("b", "y", 3)}}},
+			},
+			streaks: []Streak{{Lang: "go", Owner: "b", Name: "y", Scrapes: 3, From: lbAt(0), To: lbAt(2)}},
+			repos: []lbRepo{
+				{Key: y, Appearances: 3, AvgRank: (3 + 1 + 1) / 3.0, BestRank: 1, StarGain: 2, LongestStreak: 3},
+				{Key: x, Appearances: 1, AvgRank: 1, BestRank: 1, StarGain: 0, LongestStreak: 1},
+				{Key: "a/z", Appearances: 1, AvgRank: 2, BestRank: 2, StarGain: 0, LongestStreak: 1},
+			},
+			owners: []OwnerStats{{Owner: "b", Appearances: 3, Repos: 1}, {Owner: "a", Appearances: 2, Repos: 2}},
+		},
+		{
+			name: "the limit cuts repos and owners",
+			scrapes: []lbScrape{
+				{LangGo, 0, map[string][]TrendingItem{PeriodDaily: {lbItem("a", "x", 10), lbItem("b", "y", 10)}}},
+				{LangGo, 1, map[string][]TrendingItem{PeriodDaily: {lbItem("a", "x", 20), lbItem("b", "y", 15)}}},
+			},
+			limit:   1,
+			streaks: []Streak{{Lang: "go", Owner: "a", Name: "x", Scrapes: 2, From: lbAt(0), To: lbAt(1)}},
+			repos:   []lbRepo{{Key: x, Appearances: 2, AvgRank: 1, BestRank: 1, StarGain: 10, LongestStreak: 2}},
+			owners:  []OwnerStats{{Owner: "a", Appearances: 2, Repos: 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		c, err := NewCrawler("memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sc := range tt.scrapes {
+			if err := c.SaveScrape(Scrape{Lang: sc.lang, TakenAt: lbAt(sc.hours), Periods: sc.periods}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		lb, err := c.Leaderboards(RecordFilter{}, tt.limit)
+		c.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(lb.Streaks, tt.streaks) {
+			t.Errorf("%s: got streaks %+v, want %+v", tt.name, lb.Streaks, tt.streaks)
+		}
+		var repos []lbRepo
+		for _, rs := range lb.Repos {
+			repos = append(repos, lbRepo{
+				Key:           rs.Owner + "/" + rs.Name,
+				Appearances:   rs.Appearances,
+				AvgRank:       rs.AvgRank,
+				BestRank:      rs.BestRank,
+				StarGain:      rs.StarGain,
+				LongestStreak: rs.LongestStreak,
+			})
+		}
+		if !reflect.DeepEqual(repos, tt.repos) {
+			t.Errorf("%s: got repos %+v, want %+v", tt.name, repos, tt.repos)
+		}
+		if !reflect.DeepEqual(lb.Owners, tt.owners) {
+			t.Errorf("%s: got owners %+v, want %+v", tt.name, lb.Owners, tt.owners)
+		}
+	}
+}
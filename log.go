@@ -0,0 +1,117 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ctxLogAttrs holds the attributes added to every line logged with the
+// context, see withLog.
+const ctxLogAttrs = "__logAttrs__"
+
+// withLog returns a context whose log lines have the attributes, given as
+// key value pairs like to slog.Info, on top of those already there.
+func withLog(ctx context.Context, args ...interface{}) context.Context {
+	old, _ := ctx.Value(ctxLogAttrs).([]interface{})
+	// The slice is cut to its length, so contexts made from the same parent
+	// don't write over each other.
+	return context.WithValue(ctx, ctxLogAttrs, append(old[:len(old):len(old)], args...))
+}
+
+// contextHandler adds the request ID, the trace ID and the attributes of
+// withLog to the lines logged with a context, so lines from the same request or
+// refresh run can be found together.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := middleware.GetReqID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	if args, ok := ctx.Value(ctxLogAttrs).([]interface{}); ok {
+		r.Add(args...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(as []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(as)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// setupLogging makes the default logger log at the level, as text or json, to
+// stderr. The standard logger ends up there as well.
+func setupLogging(level, format string) error {
+	var lv slog.Level
+	if err := lv.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("Unknown log level: %s", level)
+	}
+	opts := &slog.HandlerOptions{Level: lv}
+
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("Unknown log format: %s", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	return nil
+}
+
+// requestLogger logs every request once it is done. It replaces the logger of
+// chi, so the lines are structured like the rest.
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		lv := slog.LevelInfo
+		if code >= 500 {
+			lv = slog.LevelError
+		}
+		slog.LogAttrs(r.Context(), lv, "Request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.RequestURI()),
+			slog.Int("status", code),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote", r.RemoteAddr),
+		)
+	})
+}
@@ -15,19 +15,108 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
 var (
-	dbPath = flag.String("db", "testdir/testdb", "the location of the bolt database")
+	dbPath         = flag.String("db", "testdir/testdb", "the database, either a path to a bolt file, sqlite:<path> or memory:")
+	keepAll        = flag.Duration("keep-all", DefaultRetention.KeepAll, "keep every scrape younger than this")
+	keepDaily      = flag.Duration("keep-daily", DefaultRetention.KeepDaily, "keep one scrape per day younger than this, and one per week after")
+	interval       = flag.Duration("interval", 4*time.Hour, "how often serveandrefresh refreshes")
+	breakoutFactor = flag.Float64("breakout-factor", DefaultBreakouts.Factor, "how many times faster than its baseline a repo must get stars to be a breakout")
+	breakoutWindow = flag.Duration("breakout-window", DefaultBreakouts.Window, "how far back the baseline of a breakout goes")
+	staleAfter     = flag.Duration("stale-after", DefaultStaleAfter, "how old the newest scrape of a followed language may be before /readyz fails, 0 to not check")
+	newWindow      = flag.Duration("new-window", 24*time.Hour, "how long after first showing up in a feed a repo is marked as new")
+	adminToken     = flag.String("admin-token", os.Getenv("TRENDHUB_ADMIN_TOKEN"), "a bearer token with the admin role, also used by the command line to talk to -server")
+	tokensPath     = flag.String("tokens", "", "a file of API tokens, one \"name role token\" per line")
+	private        = flag.Bool("private", false, "require a login to look at the website and API, not just to change things")
+	oidcIssuer     = flag.String("oidc-issuer", "", "the URL of an OpenID Connect provider to log in with")
+	oidcClientID   = flag.String("oidc-client-id", "", "the client id at the OpenID Connect provider")
+	oidcSecret     = flag.String("oidc-client-secret", os.Getenv("TRENDHUB_OIDC_CLIENT_SECRET"), "the client secret at the OpenID Connect provider")
+	oidcRedirect   = flag.String("oidc-redirect-url", "http://localhost:8099/auth/callback", "the URL of /auth/callback, as the OpenID Connect provider sees it")
+	oidcAdmins     = flag.String("oidc-admins", "", "comma separated list of emails or subjects logging in through OpenID Connect that get the admin role")
+	logLevel       = flag.String("log-level", "info", "the least important lines to log, debug, info, warn or error")
+	logFormat      = flag.String("log-format", "text", "log as text or json")
+	traceExporter  = flag.String("trace", "none", "where to send traces, none, otlp as set up by the OTEL_EXPORTER_OTLP_* variables, or file:<path>")
+	sessionKey     = flag.String("session-key", os.Getenv("TRENDHUB_SESSION_KEY"), "the key signing login sessions, random if not given so they end with the server")
+	server         = flag.String("server", os.Getenv("TRENDHUB_SERVER"), "the URL of a running server to send follows, follow, unfollow, refresh, history and export to")
+	controlSocket  = flag.String("control-socket", "", "the unix socket the server listens on for the command line, the database path with .sock added if not given, or none")
 )
 
+func retentionPolicy() RetentionPolicy {
+	return RetentionPolicy{KeepAll: *keepAll, KeepDaily: *keepDaily}
+}
+
+func websiteOptions() WebsiteOptions {
+	return WebsiteOptions{
+		Breakouts:  BreakoutOptions{Factor: *breakoutFactor, Window: *breakoutWindow},
+		NewWindow:  *newWindow,
+		StaleAfter: *staleAfter,
+	}
+}
+
+// websiteAuth sets up who may do what on the website from the flags. Tokens
+// are tried first, then the users of the database and last the sessions of
+// those who logged in through OpenID Connect.
+func websiteAuth(c *Crawler) (Auth, error) {
+	a := Auth{Private: *private}
+
+	var ta TokenAuth
+	if *tokensPath != "" {
+		var err error
+		if ta, err = LoadTokens(*tokensPath); err != nil {
+			return a, err
+		}
+	}
+	if *adminToken != "" {
+		ta = append(ta, TokenEntry{Token: *adminToken, Principal: Principal{Name: "admin", Role: RoleAdmin}})
+	}
+	a.Authenticators = append(a.Authenticators, ta, UserAuth{c})
+
+	if *oidcIssuer == "" {
+		return a, nil
+	}
+	key := []byte(*sessionKey)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return a, err
+		}
+	}
+	sessions := NewSessions(key, 7*24*time.Hour)
+	opts := OIDCOptions{
+		Issuer:       *oidcIssuer,
+		ClientID:     *oidcClientID,
+		ClientSecret: *oidcSecret,
+		RedirectURL:  *oidcRedirect,
+	}
+	if *oidcAdmins != "" {
+		opts.Admins = strings.Split(*oidcAdmins, ",")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	o, err := NewOIDC(ctx, opts, sessions)
+	if err != nil {
+		return a, fmt.Errorf("Couldn't set up OpenID Connect: %s", err.Error())
+	}
+	a.OIDC = o
+	a.Authenticators = append(a.Authenticators, sessions)
+	return a, nil
+}
+
 func printTableOfLang(tis []TrendingItem) error {
 	for i, ti := range tis {
 		stars := ti.Stars
@@ -57,14 +146,45 @@ func cmdFollows(c *Crawler) error {
 	return nil
 }
 
-func cmdServe(c *Crawler) error {
-	hh := NewWebsite(c)
-	if err := http.ListenAndServe(":8099", hh); err != nil {
+// serveWebsite serves the website, and the control socket for the command line.
+func serveWebsite(c *Crawler) error {
+	opts := websiteOptions()
+	var err error
+	if opts.Auth, err = websiteAuth(c); err != nil {
 		return err
 	}
+	hh := NewWebsite(c, opts)
+	cs := listenControlSocket(hh)
+
+	// On a signal the server finishes the requests it is serving and returns,
+	// so that the traces are flushed and the database closed on the way out.
+	srv := &http.Server{Addr: ":8099", Handler: hh}
+	srv.RegisterOnShutdown(c.events.close)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(sctx)
+		if cs != nil {
+			// This removes the socket as well.
+			cs.Shutdown(sctx)
+		}
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-done
 	return nil
 }
 
+func cmdServe(c *Crawler) error {
+	return serveWebsite(c)
+}
+
 func cmdFollow(c *Crawler) error {
 	var ls []Language
 	for i := 1; i < flag.NArg(); i++ {
@@ -100,23 +220,558 @@ func cmdUnfollow(c *Crawler) error {
 }
 
 func cmdRefresh(c *Crawler) error {
-	return c.Refresh()
+	return c.Refresh(context.Background())
+}
+
+func cmdPrune(c *Crawler) error {
+	stats, err := c.Prune(retentionPolicy(), time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d scrapes, kept %d\n", stats.Removed, stats.Kept)
+
+	before, after, err := c.Compact()
+	if err == ErrNotSupported {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Compacted %d bytes to %d bytes, saved %d bytes\n", before, after, before-after)
+	return nil
+}
+
+// pruneAndCompact is run by the refresher after each refresh. We only compact
+// when something was removed, as it locks out the web handlers while it runs.
+func pruneAndCompact(c *Crawler) error {
+	stats, err := c.Prune(retentionPolicy(), time.Now())
+	if err != nil {
+		return err
+	}
+	if stats.Removed == 0 {
+		return nil
+	}
+	slog.Info("Pruned scrapes", "removed", stats.Removed, "kept", stats.Kept)
+
+	before, after, err := c.Compact()
+	if err == ErrNotSupported {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("Compacted database", "before_bytes", before, "after_bytes", after, "saved_bytes", before-after)
+	return nil
+}
+
+// parseLangs parses a comma separated list of languages.
+func parseLangs(s string) ([]Language, error) {
+	var ls []Language
+	for _, n := range strings.Split(s, ",") {
+		l, ok := StoreToLang[n]
+		if !ok {
+			return nil, fmt.Errorf("Unknown language: %s", n)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// parseRecordFilter builds a filter from the command line flags, all of which
+// may be empty.
+func parseRecordFilter(langs, period, since, until string) (RecordFilter, error) {
+	var f RecordFilter
+	var err error
+	if langs != "" {
+		if f.Langs, err = parseLangs(langs); err != nil {
+			return f, err
+		}
+	}
+	switch period {
+	case "", PeriodDaily, PeriodWeekly, PeriodMonthly:
+		f.Period = period
+	default:
+		return f, fmt.Errorf("Unknown period: %s", period)
+	}
+	if since != "" {
+		if f.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return f, err
+		}
+	}
+	if until != "" {
+		if f.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// exportArgs are the arguments to export.
+type exportArgs struct {
+	Filter RecordFilter
+	Format string
+	Out    string
+}
+
+func parseExportArgs() (exportArgs, error) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "", "jsonl, csv or parquet, guessed from -o if not given")
+	out := fs.String("o", "-", "the file to write to, - for stdout")
+	langs := fs.String("langs", "", "comma separated list of languages to export")
+	period := fs.String("period", "", "only export this period")
+	since := fs.String("since", "", "only export scrapes taken at or after this RFC3339 time")
+	until := fs.String("until", "", "only export scrapes taken at or before this RFC3339 time")
+	fs.Parse(flag.Args()[1:])
+
+	a := exportArgs{Format: *format, Out: *out}
+	var err error
+	if a.Filter, err = parseRecordFilter(*langs, *period, *since, *until); err != nil {
+		return a, err
+	}
+	if a.Format == "" {
+		a.Format = formatFromPath(a.Out)
+	}
+	return a, nil
+}
+
+// createOutput creates the file to write to, where - is stdout.
+func createOutput(path string) (*os.File, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(path)
+}
+
+func cmdExport(c *Crawler) error {
+	a, err := parseExportArgs()
+	if err != nil {
+		return err
+	}
+	w, err := createOutput(a.Out)
+	if err != nil {
+		return err
+	}
+	if w != os.Stdout {
+		defer w.Close()
+	}
+
+	rw, err := NewRecordWriter(a.Format, w)
+	if err != nil {
+		return err
+	}
+	if err := c.ForEachRecord(a.Filter, rw.Write); err != nil {
+		return err
+	}
+	return rw.Close()
+}
+
+func remoteExport(rm *Remote) error {
+	a, err := parseExportArgs()
+	if err != nil {
+		return err
+	}
+	if _, err := NewRecordWriter(a.Format, io.Discard); err != nil {
+		return err
+	}
+	w, err := createOutput(a.Out)
+	if err != nil {
+		return err
+	}
+	if w != os.Stdout {
+		defer w.Close()
+	}
+	return rm.Export(w, a.Format, a.Filter)
+}
+
+func cmdHistory(c *Crawler) error {
+	l, ok := StoreToLang[flag.Arg(1)]
+	if !ok {
+		return fmt.Errorf("Unknown language: %s", flag.Arg(1))
+	}
+	ts, err := c.ScrapeHistory(l)
+	if err != nil && err != ErrNoScrapesForLang {
+		return err
+	}
+	for _, t := range ts {
+		fmt.Println(t.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func remoteHistory(rm *Remote) error {
+	ts, err := rm.History(flag.Arg(1))
+	if err != nil {
+		return err
+	}
+	for _, t := range ts {
+		fmt.Println(t.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func remoteFollows(rm *Remote) error {
+	fs, err := rm.Follows()
+	if err != nil {
+		return err
+	}
+	for _, f := range fs {
+		fmt.Println(f)
+	}
+	return nil
+}
+
+func remoteFollow(rm *Remote) error {
+	for i := 1; i < flag.NArg(); i++ {
+		if err := rm.Follow(flag.Arg(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func remoteUnfollow(rm *Remote) error {
+	for i := 1; i < flag.NArg(); i++ {
+		if err := rm.Unfollow(flag.Arg(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func remoteRefresh(rm *Remote) error {
+	return rm.Refresh()
+}
+
+func cmdUsers(c *Crawler) error {
+	us, err := c.Users()
+	if err != nil {
+		return err
+	}
+	for _, u := range us {
+		fmt.Printf("%-20s %s\n", u.Name, u.Role)
+	}
+	return nil
+}
+
+// cmdUser adds or removes a user. The password of a new user is read from the
+// first line of stdin, so it doesn't end up in the shell history.
+func cmdUser(c *Crawler) error {
+	fs := flag.NewFlagSet("user", flag.ExitOnError)
+	role := fs.String("role", string(RoleReader), "the role of the user, read or admin")
+	fs.Parse(flag.Args()[2:])
+	if fs.NArg() != 1 {
+		Usage()
+	}
+
+	switch flag.Arg(1) {
+	case "remove":
+		return c.DeleteUser(fs.Arg(0))
+	case "add":
+	default:
+		Usage()
+	}
+
+	r, err := parseRole(*role)
+	if err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	u, err := NewUser(fs.Arg(0), strings.TrimRight(line, "\r\n"), r)
+	if err != nil {
+		return err
+	}
+	return c.SaveUser(u)
+}
+
+func cmdImport(c *Crawler) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", "jsonl, csv or parquet, guessed from the file name if not given")
+	fs.Parse(flag.Args()[1:])
+	if fs.NArg() != 1 {
+		Usage()
+	}
+
+	in := os.Stdin
+	if fs.Arg(0) != "-" {
+		var err error
+		in, err = os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	if *format == "" {
+		*format = formatFromPath(fs.Arg(0))
+	}
+
+	next, err := NewRecordReader(*format, in)
+	if err != nil {
+		return err
+	}
+	n, err := c.ImportRecords(next)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d records\n", n)
+	return nil
+}
+
+// parseBackupArgs reads the flags of the backup command, and opens the file
+// to write to.
+func parseBackupArgs() (*os.File, bool, error) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	compress := fs.Bool("gzip", false, "gzip the backup")
+	out := fs.String("o", "-", "the file to write to, - for stdout")
+	fs.Parse(flag.Args()[1:])
+
+	w, err := createOutput(*out)
+	return w, *compress, err
+}
+
+func cmdBackup(c *Crawler) error {
+	w, compress, err := parseBackupArgs()
+	if err != nil {
+		return err
+	}
+	if w != os.Stdout {
+		defer w.Close()
+	}
+	_, err = c.Backup(w, compress)
+	return err
+}
+
+// remoteBackup has the running server write the backup, as it holds the lock
+// on the database.
+func remoteBackup(rm *Remote) error {
+	w, compress, err := parseBackupArgs()
+	if err != nil {
+		return err
+	}
+	if w != os.Stdout {
+		defer w.Close()
+	}
+	return rm.Backup(w, compress)
+}
+
+func cmdRestore() error {
+	kind, path := splitStoreSpec(*dbPath)
+	if kind != "bolt" {
+		return fmt.Errorf("Can only restore bolt databases, not %s", kind)
+	}
+	return Restore(path, flag.Arg(1))
+}
+
+func cmdMigrateStore() error {
+	src, err := OpenStore(flag.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := OpenStore(flag.Arg(2))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	n, err := CopyStore(dst, src)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Copied %d items\n", n)
+	return nil
+}
+
+func cmdMigrate() error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only show the migrations that would be applied")
+	fs.Parse(flag.Args()[1:])
+
+	ms, err := MigrateStore(*dbPath, *dryRun)
+	if err != nil {
+		return err
+	}
+	if len(ms) == 0 {
+		fmt.Println("The database is up to date")
+		return nil
+	}
+	for _, m := range ms {
+		if *dryRun {
+			fmt.Printf("Would migrate to version %d: %s\n", m.Version, m.Description)
+		} else {
+			fmt.Printf("Migrated to version %d: %s\n", m.Version, m.Description)
+		}
+	}
+	return nil
+}
+
+func cmdDBStats(c *Crawler) error {
+	bs, ok := c.Store.(*BoltStore)
+	if !ok {
+		return ErrNotSupported
+	}
+	st, err := bs.Stats()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("File size:   %d bytes\n", st.FileSize)
+	fmt.Printf("Scrapes:     %d\n", st.Scrapes)
+	fmt.Printf("Items:       %d, %d bytes\n", st.Items, st.ItemBytes)
+	fmt.Printf("Repos:       %d, %d bytes\n", st.Repos, st.RepoBytes)
+	fmt.Printf("As JSON:     %d bytes\n", st.JSONBytes)
+	if st.JSONBytes > 0 {
+		stored := st.ItemBytes + st.RepoBytes
+		fmt.Printf("Saved:       %d bytes, %.1f%%\n", st.JSONBytes-stored,
+			100*float64(st.JSONBytes-stored)/float64(st.JSONBytes))
+	}
+	return nil
+}
+
+func cmdDoctor(c *Crawler) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "remove the data that can't be read")
+	fs.Parse(flag.Args()[1:])
+
+	bs, ok := c.Store.(*BoltStore)
+	if !ok {
+		return ErrNotSupported
+	}
+	rep, err := bs.Doctor(DoctorOptions{
+		Interval:  *interval,
+		GapsSince: time.Now().Add(-retentionPolicy().KeepAll),
+		Repair:    *repair,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, lh := range rep.Langs {
+		fmt.Printf("%-10s %5d scrapes from %s to %s\n", lh.Lang, lh.Scrapes,
+			lh.First.Format(time.RFC3339), lh.Last.Format(time.RFC3339))
+	}
+	if len(rep.Problems) == 0 {
+		fmt.Println("No problems found")
+		return nil
+	}
+	fmt.Printf("\n%d problems found:\n", len(rep.Problems))
+	for _, p := range rep.Problems {
+		fmt.Println(p)
+	}
+	return nil
+}
+
+func cmdSearch(c *Crawler) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	langs := fs.String("langs", "", "comma separated list of languages whose feeds to search, the followed ones if empty")
+	period := fs.String("period", "", "only search this period")
+	since := fs.String("since", "", "only repos trending at or after this RFC3339 time")
+	until := fs.String("until", "", "only repos trending at or before this RFC3339 time")
+	limit := fs.Int("limit", 20, "the most results to show, 0 for all")
+	fs.Parse(flag.Args()[1:])
+
+	f, err := parseRecordFilter(*langs, *period, *since, *until)
+	if err != nil {
+		return err
+	}
+	rs, err := c.Search(strings.Join(fs.Args(), " "), f, *limit)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rs {
+		fmt.Printf("%-40s %-12s last seen %s\n", r.Owner+"/"+r.Name, r.Language, r.LastSeen.Format(time.RFC3339))
+		if r.Description != "" {
+			fmt.Printf("\t%s\n", r.Description)
+		}
+		var feeds []string
+		for _, fa := range r.Feeds {
+			feeds = append(feeds, fa.Lang+"/"+fa.Period)
+		}
+		fmt.Printf("\tin %s\n", strings.Join(feeds, ", "))
+	}
+	return nil
+}
+
+func cmdTrending(c *Crawler) error {
+	fs := flag.NewFlagSet("trending", flag.ExitOnError)
+	// The flags are turned into a query, so that they mean the same as they do
+	// on the website.
+	params := []struct{ name, usage string }{
+		{"langs", "comma separated list of languages to show, instead of the followed ones"},
+		{"period", "the period to show"},
+		{"only", "only show new repos with 'new'"},
+		{"dedup", "hide repos already shown in an earlier language when set"},
+		{"min_stars", "only repos with at least this many stars"},
+		{"min_increase", "only repos whose stars increased by at least this much"},
+		{"q", "only repos with this in their description"},
+		{"exclude", "comma separated list of owners to hide"},
+		{"sort", "order by rank, stars, increase or forks"},
+	}
+	vals := make([]*string, len(params))
+	for i, p := range params {
+		vals[i] = fs.String(strings.Replace(p.name, "_", "-", -1), "", p.usage)
+	}
+	fs.Parse(flag.Args()[1:])
+
+	qv := url.Values{}
+	for i, p := range params {
+		if *vals[i] != "" {
+			qv.Set(p.name, *vals[i])
+		}
+	}
+	q, err := parseTrendingQuery(qv)
+	if err != nil {
+		return err
+	}
+	ls, err := c.Trending(context.Background(), q, websiteOptions(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, l := range ls {
+		fmt.Printf("%s, scraped %s\n", l.Lang.StoreName, l.Scraped.Format(time.RFC3339))
+		tis := make([]TrendingItem, len(l.Items))
+		for i, it := range l.Items {
+			tis[i] = it.TrendingItem
+		}
+		if err := printTableOfLang(tis); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func cmdServeAndRefresh(c *Crawler) error {
 	go func(c *Crawler) {
 		for {
-			if err := c.Refresh(); err != nil {
-				log.Printf("[ERR] Couldn't refresh: %s\n", err.Error())
+			if err := c.Refresh(context.Background()); err != nil {
+				slog.Error("Couldn't refresh", "err", err)
+			}
+			if err := pruneAndCompact(c); err != nil {
+				slog.Error("Couldn't prune", "err", err)
+			}
+
+			// Languages followed in the meantime are scraped right away, so
+			// they don't sit empty until the next refresh.
+			next := time.After(*interval)
+		wait:
+			for {
+				select {
+				case <-next:
+					break wait
+				case l := <-c.followed:
+					if err := c.RefreshLangs(context.Background(), []Language{l}); err != nil {
+						slog.Error("Couldn't refresh", "language", l.StoreName, "err", err)
+					}
+				}
 			}
-			time.Sleep(4 * time.Hour)
 		}
 	}(c)
-	hh := NewWebsite(c)
-	if err := http.ListenAndServe(":8099", hh); err != nil {
-		return err
-	}
-	return nil
+	return serveWebsite(c)
 }
 
 func Usage() {
@@ -125,16 +780,61 @@ func Usage() {
 	follows
 	unfollow <lang to unfollow>+
 	refresh 
+	history <lang>
+	prune
+	export [-format jsonl|csv|parquet] [-o file] [-langs l1,l2] [-period p] [-since t] [-until t]
+	import [-format jsonl|csv|parquet] <file or ->
+	backup [-gzip] [-o file]
+	restore <backup file>
+	migrate-store <from> <to>
+	migrate [-dry-run]
+	db stats
+	doctor [-repair]
+	search [-langs l1,l2] [-period p] [-since t] [-until t] [-limit n] <words>+
+	trending [-langs l1,l2] [-period p] [-only new] [-dedup 1] [-min-stars n] [-min-increase n] [-q word] [-exclude o1,o2] [-sort s]
+	users
+	user add [-role read|admin] <name>, with the password on stdin
+	user remove <name>
 	serve
-	serveandrefresh`)
+	serveandrefresh
+
+databases are given as a path to a bolt file, sqlite:<path> or memory:
+
+follows, follow, unfollow, refresh, history, export and backup are sent to the
+server given with -server, or to the one using the database if it is running.
+
+changing things on the website needs the admin role, given by -admin-token,
+-tokens, the users of the database or -oidc-admins.`)
 	os.Exit(1)
 }
 
 func main() {
 	flag.Parse()
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := run(); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// run runs the command given. Exiting is left to main, so that the deferred
+// flushing of the spans and closing of the database happen on errors too.
+func run() error {
+	shutdownTracing, err := setupTracing(*traceExporter)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
 
 	var fx func(c *Crawler) error
-	var err error
+	// rawfx is for the commands that open the databases themselves.
+	var rawfx func() error
+	// remotefx is for the commands that can be sent to a running server
+	// instead, which they are when there is one.
+	var remotefx func(rm *Remote) error
 
 	switch strings.ToLower(flag.Arg(0)) {
 	case "follows":
@@ -142,16 +842,27 @@ func main() {
 			Usage()
 		}
 		fx = cmdFollows
+		remotefx = remoteFollows
 	case "follow":
 		if flag.NArg() < 2 {
 			Usage()
 		}
 		fx = cmdFollow
+		remotefx = remoteFollow
 	case "unfollow":
 		if flag.NArg() < 2 {
 			Usage()
 		}
 		fx = cmdUnfollow
+		remotefx = remoteUnfollow
+	case "history":
+		if flag.NArg() != 2 {
+			Usage()
+		}
+		fx = cmdHistory
+		remotefx = remoteHistory
+	case "trending":
+		fx = cmdTrending
 	case "serve":
 		if flag.NArg() != 1 {
 			Usage()
@@ -162,6 +873,58 @@ func main() {
 			Usage()
 		}
 		fx = cmdRefresh
+		remotefx = remoteRefresh
+	case "prune":
+		if flag.NArg() != 1 {
+			Usage()
+		}
+		fx = cmdPrune
+	case "export":
+		fx = cmdExport
+		remotefx = remoteExport
+	case "import":
+		if flag.NArg() < 2 {
+			Usage()
+		}
+		fx = cmdImport
+	case "backup":
+		fx = cmdBackup
+		remotefx = remoteBackup
+	case "restore":
+		if flag.NArg() != 2 {
+			Usage()
+		}
+		rawfx = cmdRestore
+	case "migrate-store":
+		if flag.NArg() != 3 {
+			Usage()
+		}
+		rawfx = cmdMigrateStore
+	case "migrate":
+		rawfx = cmdMigrate
+	case "db":
+		if flag.NArg() != 2 || flag.Arg(1) != "stats" {
+			Usage()
+		}
+		fx = cmdDBStats
+	case "doctor":
+		fx = cmdDoctor
+	case "search":
+		if flag.NArg() < 2 {
+			Usage()
+		}
+		fx = cmdSearch
+
+	case "users":
+		if flag.NArg() != 1 {
+			Usage()
+		}
+		fx = cmdUsers
+	case "user":
+		if flag.NArg() < 3 {
+			Usage()
+		}
+		fx = cmdUser
 
 	case "serveandrefresh":
 		if flag.NArg() != 1 {
@@ -172,13 +935,25 @@ func main() {
 		Usage()
 	}
 
+	if remotefx != nil {
+		rm, err := remote()
+		if err != nil {
+			return err
+		}
+		if rm != nil {
+			return remotefx(rm)
+		}
+	}
+
+	if rawfx != nil {
+		return rawfx()
+	}
+
 	c, err := NewCrawler(*dbPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer c.Close()
 
-	if err := fx(c); err != nil {
-		log.Fatal(err)
-	}
+	return fx(c)
 }
@@ -0,0 +1,59 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Mark is something a user can mark a repo as.
+type Mark string
+
+const (
+	MarkSeen       Mark = "seen"
+	MarkHidden     Mark = "hidden"
+	MarkBookmarked Mark = "bookmarked"
+)
+
+var ErrUnknownMark = errors.New("Unknown mark")
+
+// RepoMarks is how a user has marked a repo, with when it was marked.
+type RepoMarks map[Mark]time.Time
+
+// parseMark checks that s is one of the marks.
+func parseMark(s string) (Mark, error) {
+	switch m := Mark(s); m {
+	case MarkSeen, MarkHidden, MarkBookmarked:
+		return m, nil
+	default:
+		return "", ErrUnknownMark
+	}
+}
+
+// validUser checks that a user token is something we are willing to store.
+func validUser(user string) bool {
+	if len(user) == 0 || len(user) > 64 {
+		return false
+	}
+	for _, c := range user {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
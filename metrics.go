@@ -0,0 +1,142 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The metrics are served on /metrics, in the format of Prometheus.
+var (
+	refreshRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trendhub_refresh_runs_total",
+		Help: "Refresh runs, by whether they succeeded or failed.",
+	}, []string{"result"})
+	refreshDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "trendhub_refresh_duration_seconds",
+		Help:    "How long refresh runs took.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	fetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "trendhub_fetch_duration_seconds",
+		Help: "How long fetching a trending page took.",
+	}, []string{"language", "period"})
+	fetchResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trendhub_fetch_responses_total",
+		Help: "Trending page fetches, by HTTP status, or error if there was no response.",
+	}, []string{"language", "period", "code"})
+	parseFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trendhub_parse_failures_total",
+		Help: "Trending pages that couldn't be parsed.",
+	}, []string{"language", "period"})
+	pageItems = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "trendhub_page_items",
+		Help:    "How many repos were on a trending page.",
+		Buckets: prometheus.LinearBuckets(0, 5, 6),
+	}, []string{"language", "period"})
+	boltTxDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "trendhub_bolt_tx_duration_seconds",
+		Help:    "How long bolt transactions took, by view or update.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"kind"})
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trendhub_http_requests_total",
+		Help: "HTTP requests, by method, route and status.",
+	}, []string{"method", "route", "code"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "trendhub_http_request_duration_seconds",
+		Help: "How long HTTP requests took, by method and route.",
+	}, []string{"method", "route"})
+)
+
+// observeSince observes the time since start in seconds.
+func observeSince(o prometheus.Observer, start time.Time) {
+	o.Observe(time.Since(start).Seconds())
+}
+
+// dbSizeCollector reports the size of the database when scraped, so it is
+// never out of date.
+type dbSizeCollector struct {
+	s    Store
+	desc *prometheus.Desc
+}
+
+func newDBSizeCollector(s Store) *dbSizeCollector {
+	return &dbSizeCollector{
+		s:    s,
+		desc: prometheus.NewDesc("trendhub_db_size_bytes", "The size of the database.", nil, nil),
+	}
+}
+
+func (dc *dbSizeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dc.desc
+}
+
+func (dc *dbSizeCollector) Collect(ch chan<- prometheus.Metric) {
+	var n int64
+	var err error
+	switch s := dc.s.(type) {
+	case *BoltStore:
+		n, err = s.Size()
+	case *SQLiteStore:
+		n, err = s.Size()
+	default:
+		// There is no file to measure.
+		return
+	}
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(dc.desc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(dc.desc, prometheus.GaugeValue, float64(n))
+}
+
+// metricsHandler serves the metrics, including the size of the database of
+// the crawler.
+func metricsHandler(c *Crawler) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newDBSizeCollector(c.Store))
+	return promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, reg}, promhttp.HandlerOpts{})
+}
+
+// httpMetrics counts the requests and how long they took. Requests are labeled
+// by the route they matched rather than their path, so that there is a fixed
+// number of series.
+func httpMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rc := chi.RouteContext(r.Context()); rc != nil && rc.RoutePattern() != "" {
+			route = rc.RoutePattern()
+		}
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(code)).Inc()
+		observeSince(httpDuration.WithLabelValues(r.Method, route), start)
+	})
+}
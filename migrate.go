@@ -0,0 +1,468 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	MetaBucket       = []byte("meta")
+	SchemaVersionKey = []byte("schema-version")
+)
+
+// Migration is a change to how a store lays out its data. Migrations are applied
+// in order, and the version of a store is the version of the last one applied.
+type Migration struct {
+	Version     int
+	Description string
+}
+
+// ErrSchemaTooNew is returned when a database has been written by a newer
+// version of trendhub, as we can't know how to read it.
+type ErrSchemaTooNew struct {
+	Version int
+	Latest  int
+}
+
+func (e ErrSchemaTooNew) Error() string {
+	return fmt.Sprintf("The database has schema version %d, but we only know up to %d. Upgrade trendhub.", e.Version, e.Latest)
+}
+
+type boltMigration struct {
+	Migration
+	migrate func(tx *bolt.Tx) error
+}
+
+// boltMigrations must only ever be appended to. Databases from before we had
+// versions are version 0, and so are new databases.
+var boltMigrations = []boltMigration{
+	{
+		Migration{1, "create the follows and language buckets"},
+		func(tx *bolt.Tx) error {
+			if _, err := tx.CreateBucketIfNotExists(FollowsBucket); err != nil {
+				return err
+			}
+			_, err := tx.CreateBucketIfNotExists(LanguageBucket)
+			return err
+		},
+	},
+	{
+		Migration{2, "build the repo index from the stored scrapes"},
+		func(tx *bolt.Tx) error {
+			if _, err := tx.CreateBucketIfNotExists(ReposBucket); err != nil {
+				return err
+			}
+			return buildJSONRepoIndex(tx)
+		},
+	},
+	{
+		Migration{3, "store items in the compact encoding, with the repositories in a repo table"},
+		compactItems,
+	},
+	{
+		Migration{4, "record when repos were first and last seen in each feed"},
+		buildSeen,
+	},
+	{
+		Migration{5, "create the marks bucket"},
+		func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(MarksBucket)
+			return err
+		},
+	},
+	{
+		Migration{6, "create the notes bucket"},
+		func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(NotesBucket)
+			return err
+		},
+	},
+	{
+		Migration{7, "build the search index"},
+		buildSearchIndex,
+	},
+	{
+		Migration{8, "create the users bucket"},
+		func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(UsersBucket)
+			return err
+		},
+	},
+}
+
+// boltSchemaVersion returns the schema version of the database.
+func boltSchemaVersion(tx *bolt.Tx) (int, error) {
+	mb := tx.Bucket(MetaBucket)
+	if mb == nil {
+		return 0, nil
+	}
+	v := mb.Get(SchemaVersionKey)
+	if v == nil {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(string(v))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid schema version %q", v)
+	}
+	return n, nil
+}
+
+func setBoltSchemaVersion(tx *bolt.Tx, version int) error {
+	mb, err := tx.CreateBucketIfNotExists(MetaBucket)
+	if err != nil {
+		return err
+	}
+	return mb.Put(SchemaVersionKey, []byte(strconv.Itoa(version)))
+}
+
+// checkBoltSchema returns the schema version of the database, and an error if it
+// is newer than we know.
+func checkBoltSchema(tx *bolt.Tx) (int, error) {
+	version, err := boltSchemaVersion(tx)
+	if err != nil {
+		return 0, err
+	}
+	if version > len(boltMigrations) {
+		return version, ErrSchemaTooNew{Version: version, Latest: len(boltMigrations)}
+	}
+	return version, nil
+}
+
+// migrateBolt applies the migrations the database is missing, each in its own
+// transaction, and returns them. With dryRun it only returns them.
+func migrateBolt(db *bolt.DB, dryRun bool) ([]Migration, error) {
+	var version int
+	if err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = checkBoltSchema(tx)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, m := range boltMigrations[version:] {
+		if !dryRun {
+			slog.Info("Migrating database", "version", m.Version, "description", m.Description)
+			if err := db.Update(func(tx *bolt.Tx) error {
+				if err := m.migrate(tx); err != nil {
+					return err
+				}
+				return setBoltSchemaVersion(tx, m.Version)
+			}); err != nil {
+				return applied, fmt.Errorf("Migration to version %d failed: %s", m.Version, err.Error())
+			}
+		}
+		applied = append(applied, m.Migration)
+	}
+	return applied, nil
+}
+
+type sqliteMigration struct {
+	Migration
+	sql string
+}
+
+// sqliteMigrations must only ever be appended to. The version is kept in
+// PRAGMA user_version.
+var sqliteMigrations = []sqliteMigration{
+	{Migration{1, "create the tables"}, sqliteSchema},
+	{Migration{2, "record when repos were first and last seen in each feed"}, `
+CREATE TABLE seen (
+	language   TEXT NOT NULL,
+	period     TEXT NOT NULL,
+	repo_owner TEXT NOT NULL,
+	repo_name  TEXT NOT NULL,
+	first_seen TEXT NOT NULL,
+	last_seen  TEXT NOT NULL,
+	PRIMARY KEY (language, period, repo_owner, repo_name)
+);
+
+INSERT INTO seen
+	SELECT language, period, repo_owner, repo_name, MIN(scraped_at), MAX(scraped_at)
+	FROM items GROUP BY language, period, repo_owner, repo_name;
+`},
+	{Migration{3, "create the marks table"}, `
+CREATE TABLE marks (
+	user       TEXT NOT NULL,
+	mark       TEXT NOT NULL,
+	repo_owner TEXT NOT NULL,
+	repo_name  TEXT NOT NULL,
+	marked_at  TEXT NOT NULL,
+	PRIMARY KEY (user, mark, repo_owner, repo_name)
+);
+`},
+	{Migration{4, "create the notes table"}, `
+CREATE TABLE notes (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	repo_owner TEXT NOT NULL,
+	repo_name  TEXT NOT NULL,
+	text       TEXT NOT NULL,
+	tags       TEXT NOT NULL,
+	author     TEXT NOT NULL,
+	edited_at  TEXT NOT NULL
+);
+
+CREATE INDEX notes_repo ON notes (repo_owner, repo_name, id);
+`},
+	{Migration{5, "build the search index"}, `
+CREATE VIRTUAL TABLE repos_fts USING fts5(
+	owner, name, description, language,
+	content = 'repos', tokenize = 'unicode61'
+);
+
+INSERT INTO repos_fts (repos_fts) VALUES ('rebuild');
+
+CREATE TRIGGER repos_fts_insert AFTER INSERT ON repos BEGIN
+	INSERT INTO repos_fts (rowid, owner, name, description, language)
+		VALUES (new.rowid, new.owner, new.name, new.description, new.language);
+END;
+
+CREATE TRIGGER repos_fts_delete AFTER DELETE ON repos BEGIN
+	INSERT INTO repos_fts (repos_fts, rowid, owner, name, description, language)
+		VALUES ('delete', old.rowid, old.owner, old.name, old.description, old.language);
+END;
+
+CREATE TRIGGER repos_fts_update AFTER UPDATE ON repos BEGIN
+	INSERT INTO repos_fts (repos_fts, rowid, owner, name, description, language)
+		VALUES ('delete', old.rowid, old.owner, old.name, old.description, old.language);
+	INSERT INTO repos_fts (rowid, owner, name, description, language)
+		VALUES (new.rowid, new.owner, new.name, new.description, new.language);
+END;
+`},
+	{Migration{6, "create the users table"}, `
+CREATE TABLE users (
+	name          TEXT PRIMARY KEY,
+	password_hash TEXT NOT NULL,
+	role          TEXT NOT NULL
+);
+`},
+	// The triggers write to repos_fts by name, so they carry on with the new
+	// table.
+	{Migration{7, "keep diacritics in the search index, like the other stores"}, `
+DROP TABLE repos_fts;
+
+CREATE VIRTUAL TABLE repos_fts USING fts5(
+	owner, name, description, language,
+	content = 'repos', tokenize = 'unicode61 remove_diacritics 0'
+);
+
+INSERT INTO repos_fts (repos_fts) VALUES ('rebuild');
+`},
+}
+
+// migrateSQLite does the same as migrateBolt, for SQLite.
+func migrateSQLite(db *sql.DB, dryRun bool) ([]Migration, error) {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return nil, err
+	}
+	if version > len(sqliteMigrations) {
+		return nil, ErrSchemaTooNew{Version: version, Latest: len(sqliteMigrations)}
+	}
+
+	var applied []Migration
+	for _, m := range sqliteMigrations[version:] {
+		if !dryRun {
+			slog.Info("Migrating database", "version", m.Version, "description", m.Description)
+			if err := migrateSQLiteOne(db, m); err != nil {
+				return applied, fmt.Errorf("Migration to version %d failed: %s", m.Version, err.Error())
+			}
+		}
+		applied = append(applied, m.Migration)
+	}
+	return applied, nil
+}
+
+func migrateSQLiteOne(db *sql.DB, m sqliteMigration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.sql); err != nil {
+		return err
+	}
+	// PRAGMA doesn't take parameters, but this is our own number.
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, m.Version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MigrateStore brings the store described by spec up to the latest schema, and
+// returns the migrations that were needed. With dryRun nothing is changed.
+func MigrateStore(spec string, dryRun bool) ([]Migration, error) {
+	kind, path := splitStoreSpec(spec)
+	switch kind {
+	case "bolt":
+		db, err := openBolt(path)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		return migrateBolt(db, dryRun)
+	case "sqlite":
+		db, err := openSQLite(path)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		return migrateSQLite(db, dryRun)
+	default:
+		// Nothing to migrate in memory.
+		return nil, nil
+	}
+}
+
+// buildJSONRepoIndex fills the repo index as it was in version 2, where the
+// repos bucket held JSON keyed by owner/name, from the JSON items.
+func buildJSONRepoIndex(tx *bolt.Tx) error {
+	rb := tx.Bucket(ReposBucket)
+	return forEachScrapeBucket(tx, func(lang, k []byte, hlb *bolt.Bucket) error {
+		// Scrapes with broken keys are skipped.
+		ts, err := time.Parse(time.RFC3339, string(k))
+		if err != nil {
+			return nil
+		}
+		return hlb.ForEach(func(ik, iv []byte) error {
+			var ti TrendingItem
+			if err := json.Unmarshal(iv, &ti); err != nil {
+				return nil
+			}
+
+			rk := []byte(ti.RepoOwner + "/" + ti.RepoName)
+			if v := rb.Get(rk); v != nil {
+				var old RepoInfo
+				if err := json.Unmarshal(v, &old); err != nil {
+					return err
+				}
+				if old.LastSeen.After(ts) {
+					return nil
+				}
+			}
+			j, err := json.Marshal(RepoInfo{
+				Owner:       ti.RepoOwner,
+				Name:        ti.RepoName,
+				Description: ti.Description,
+				Language:    ti.Language,
+				LastSeen:    ts,
+			})
+			if err != nil {
+				return err
+			}
+			return rb.Put(rk, j)
+		})
+	})
+}
+
+// compactItems rewrites the JSON items into the compact encoding, replacing the
+// JSON repo index with the repo table.
+func compactItems(tx *bolt.Tx) error {
+	if err := tx.DeleteBucket(ReposBucket); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	if _, err := tx.CreateBucket(ReposBucket); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucketIfNotExists(RepoIDsBucket); err != nil {
+		return err
+	}
+
+	type item struct {
+		k  []byte
+		ti TrendingItem
+	}
+	return forEachScrapeBucket(tx, func(lang, k []byte, hlb *bolt.Bucket) error {
+		// A broken key only means we don't know when the repo was seen.
+		ts, _ := time.Parse(time.RFC3339, string(k))
+
+		// We can't write to a bucket while iterating over it. Items we can't
+		// decode are left as they are, rather than making the database
+		// impossible to open.
+		var items []item
+		if err := hlb.ForEach(func(ik, iv []byte) error {
+			var ti TrendingItem
+			if err := json.Unmarshal(iv, &ti); err != nil {
+				return nil
+			}
+			items = append(items, item{k: append([]byte(nil), ik...), ti: ti})
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, it := range items {
+			id, err := putRepo(tx, it.ti, ts)
+			if err != nil {
+				return err
+			}
+			if err := hlb.Put(it.k, encodeItem(id, it.ti)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// buildSeen fills the seen bucket from the stored scrapes.
+func buildSeen(tx *bolt.Tx) error {
+	if _, err := tx.CreateBucketIfNotExists(SeenBucket); err != nil {
+		return err
+	}
+	rc := newRepoCache(tx)
+	return forEachScrapeBucket(tx, func(lang, k []byte, hlb *bolt.Bucket) error {
+		// Scrapes with broken keys and items we can't read are skipped, the
+		// doctor can tell about them.
+		ts, err := time.Parse(time.RFC3339, string(k))
+		if err != nil {
+			return nil
+		}
+		return hlb.ForEach(func(ik, iv []byte) error {
+			period, _, err := splitItemKey(ik)
+			if err != nil {
+				return nil
+			}
+			ti, err := rc.item(iv)
+			if err != nil {
+				return nil
+			}
+			return putSeen(tx, string(lang), period, ti, ts)
+		})
+	})
+}
+
+// buildSearchIndex indexes the words of every repository in the repo table.
+func buildSearchIndex(tx *bolt.Tx) error {
+	if _, err := tx.CreateBucketIfNotExists(SearchBucket); err != nil {
+		return err
+	}
+	return tx.Bucket(ReposBucket).ForEach(func(k, v []byte) error {
+		ri, err := decodeRepo(v)
+		if err != nil {
+			return err
+		}
+		return indexRepo(tx, k, nil, repoTerms(ri))
+	})
+}
@@ -0,0 +1,197 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// migrateTo makes a database of the kind at path with the migrations up to
+// version applied. Past the latest it only claims to have the version.
+func migrateTo(t *testing.T, kind, path string, version int) {
+	t.Helper()
+	switch kind {
+	case "bolt":
+		db, err := openBolt(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, m := range boltMigrations[:min(version, len(boltMigrations))] {
+				if err := m.migrate(tx); err != nil {
+					return err
+				}
+			}
+			return setBoltSchemaVersion(tx, version)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "sqlite":
+		db, err := openSQLite(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for _, m := range sqliteMigrations[:min(version, len(sqliteMigrations))] {
+			if err := migrateSQLiteOne(db, m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrateStore(t *testing.T) {
+	latest := map[string]int{"bolt": len(boltMigrations), "sqlite": len(sqliteMigrations)}
+
+	tests := []struct {
+		name    string
+		kind    string
+		version int
+		dryRun  bool
+		// applied is how many migrations we want applied, with -1 for all.
+		applied int
+		tooNew  bool
+	}{
+		{"bolt new", "bolt", 0, false, -1, false},
+		{"bolt dry run", "bolt", 0, true, -1, false},
+		{"bolt halfway", "bolt", 4, false, len(boltMigrations) - 4, false},
+		{"bolt latest", "bolt", len(boltMigrations), false, 0, false},
+		{"bolt too new", "bolt", len(boltMigrations) + 1, false, 0, true},
+		{"sqlite new", "sqlite", 0, false, -1, false},
+		{"sqlite dry run", "sqlite", 0, true, -1, false},
+		{"sqlite halfway", "sqlite", 3, false, len(sqliteMigrations) - 3, false},
+		{"sqlite latest", "sqlite", len(sqliteMigrations), false, 0, false},
+		{"sqlite too new", "sqlite", len(sqliteMigrations) + 1, false, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			if tt.version != 0 {
+				migrateTo(t, tt.kind, path, tt.version)
+			}
+			spec := tt.kind + ":" + path
+
+			ms, err := MigrateStore(spec, tt.dryRun)
+			var tooNew ErrSchemaTooNew
+			if got := errors.As(err, &tooNew); got != tt.tooNew {
+				t.Fatalf("got error %v, want too new: %v", err, tt.tooNew)
+			}
+			if tt.tooNew {
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.applied
+			if want < 0 {
+				want = latest[tt.kind]
+			}
+			if len(ms) != want {
+				t.Fatalf("got %d migrations, want %d", len(ms), want)
+			}
+			if want > 0 && ms[want-1].Version != latest[tt.kind] {
+				t.Errorf("got last migration %d, want %d", ms[want-1].Version, latest[tt.kind])
+			}
+
+			// Only a dry run leaves something to do.
+			ms, err = MigrateStore(spec, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.dryRun != (len(ms) != 0) {
+				t.Errorf("got %d migrations on the second run", len(ms))
+			}
+		})
+	}
+}
+
+// TestMigrateBoltJSONItems checks that the JSON items of a database from before
+// the versions are rewritten, and that the indexes are built from them.
+func TestMigrateBoltJSONItems(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	ts := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	ti := TrendingItem{RepoOwner: "o", RepoName: "r", Description: "A parser", Language: "Go", Stars: 10, StarsIncrease: 2}
+
+	db, err := openBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		lb, err := tx.CreateBucket(LanguageBucket)
+		if err != nil {
+			return err
+		}
+		llb, err := lb.CreateBucket([]byte("go"))
+		if err != nil {
+			return err
+		}
+		hlb, err := llb.CreateBucket([]byte(ts.Format(time.RFC3339)))
+		if err != nil {
+			return err
+		}
+		j, err := json.Marshal(ti)
+		if err != nil {
+			return err
+		}
+		return hlb.Put([]byte(itemKey(PeriodDaily, 0)), j)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tis, err := s.GetScrape(StoreToLang["go"], PeriodDaily, ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tis) != 1 || tis[0] != ti {
+		t.Errorf("got items %+v, want %+v", tis, ti)
+	}
+	ri, err := s.Repo("o", "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ri.LastSeen.Equal(ts) || ri.Description != ti.Description {
+		t.Errorf("got repo %+v, want it last seen at %s", ri, ts)
+	}
+	seen, err := s.Seen(StoreToLang["go"], PeriodDaily)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs := seen["o/r"]; !fs.FirstSeen.Equal(ts) || !fs.LastSeen.Equal(ts) {
+		t.Errorf("got seen %+v, want %s", fs, ts)
+	}
+	if rs, err := s.SearchRepos([]string{"pars"}); err != nil || len(rs) != 1 {
+		t.Errorf("got search results %v and %v, want o/r", rs, err)
+	}
+}
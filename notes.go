@@ -0,0 +1,112 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Note is a version of the note on a repo. Every edit is kept, so the versions
+// of a repo make up its history. A note without text or tags is deleted.
+type Note struct {
+	Owner    string
+	Name     string
+	Text     string
+	Tags     []string
+	Author   string
+	EditedAt time.Time
+}
+
+// validRepoName checks that owner and name could be a repo on GitHub. Owners
+// are letters, digits and dashes, and names may have dots and underscores too.
+func validRepoName(owner, name string) bool {
+	if len(owner) == 0 || len(owner) > 39 || len(name) == 0 || len(name) > 100 || name == "." || name == ".." {
+		return false
+	}
+	for _, c := range owner {
+		if !nameChar(c) {
+			return false
+		}
+	}
+	for _, c := range name {
+		if !nameChar(c) && c != '.' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func nameChar(c rune) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-'
+}
+
+// Empty is true for a deleted note.
+func (n Note) Empty() bool {
+	return n.Text == "" && len(n.Tags) == 0
+}
+
+// normalizeTags lowercases the tags, and removes empty and repeated ones. Tags
+// can't contain spaces or commas, as that is how they are given.
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, t := range tags {
+		for _, f := range strings.FieldsFunc(t, func(r rune) bool { return r == ',' || r == ' ' }) {
+			f = strings.ToLower(f)
+			if !seen[f] {
+				seen[f] = true
+				out = append(out, f)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// matchNote says if the note has the tag, if given, and all the words of q in
+// its repo, text or tags.
+func matchNote(n Note, q, tag string) bool {
+	if tag != "" {
+		found := false
+		for _, t := range n.Tags {
+			if t == strings.ToLower(tag) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	hay := strings.ToLower(n.Owner + "/" + n.Name + " " + n.Text + " " + strings.Join(n.Tags, " "))
+	for _, w := range strings.Fields(strings.ToLower(q)) {
+		if !strings.Contains(hay, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortNotes sorts notes by owner and name.
+func sortNotes(ns []Note) {
+	sort.Slice(ns, func(i, j int) bool {
+		if ns[i].Owner != ns[j].Owner {
+			return ns[i].Owner < ns[j].Owner
+		}
+		return ns[i].Name < ns[j].Name
+	})
+}
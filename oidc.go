@@ -0,0 +1,199 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcCookie holds the state of a login while the user is at the provider.
+const oidcCookie = "trendhub-oidc"
+
+type OIDCOptions struct {
+	// Issuer is the URL of the provider, where its discovery document is.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is /auth/callback on this server, as the provider sees it.
+	RedirectURL string
+	// Admins are the emails or subjects given the admin role. Everyone else
+	// logging in can only read.
+	Admins []string
+}
+
+// OIDC logs people in with an OpenID Connect provider, with the authorization
+// code flow. Those who do get a session.
+type OIDC struct {
+	config   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	admins   map[string]bool
+	sessions *Sessions
+}
+
+// NewOIDC sets up the login, asking the provider how to talk to it.
+func NewOIDC(ctx context.Context, opts OIDCOptions, sessions *Sessions) (*OIDC, error) {
+	p, err := oidc.NewProvider(ctx, opts.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	o := &OIDC{
+		config: oauth2.Config{
+			ClientID:     opts.ClientID,
+			ClientSecret: opts.ClientSecret,
+			RedirectURL:  opts.RedirectURL,
+			Endpoint:     p.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+		verifier: p.Verifier(&oidc.Config{ClientID: opts.ClientID}),
+		admins:   make(map[string]bool),
+		sessions: sessions,
+	}
+	for _, a := range opts.Admins {
+		o.admins[a] = true
+	}
+	return o, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// localPath only lets through paths on this server, so the login can't be
+// used to send people elsewhere.
+func localPath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		return "/"
+	}
+	return p
+}
+
+// login sends the user to the provider, remembering where they were going.
+func (o *OIDC) login(w http.ResponseWriter, r *http.Request) {
+	state, err := randomHex(16)
+	if err != nil {
+		http.Error(w, "Couldn't start the login: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		http.Error(w, "Couldn't start the login: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    strings.Join([]string{state, nonce, verifier, localPath(r.URL.Query().Get("next"))}, " "),
+		Path:     "/auth/",
+		MaxAge:   10 * 60,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	u := o.config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// callback is where the provider sends the user back to, with a code we trade
+// for who they are.
+func (o *OIDC) callback(w http.ResponseWriter, r *http.Request) {
+	ck, err := r.Cookie(oidcCookie)
+	if err != nil {
+		http.Error(w, "The login has expired, try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Value: "", Path: "/auth/", MaxAge: -1})
+	parts := strings.SplitN(ck.Value, " ", 4)
+	if len(parts) != 4 {
+		http.Error(w, "The login has expired, try again", http.StatusBadRequest)
+		return
+	}
+	state, nonce, verifier, next := parts[0], parts[1], parts[2], parts[3]
+
+	qv := r.URL.Query()
+	if e := qv.Get("error"); e != "" {
+		http.Error(w, "The login failed: "+e+" "+qv.Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+	if qv.Get("state") != state {
+		http.Error(w, "The login doesn't match, try again", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	tok, err := o.config.Exchange(ctx, qv.Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		http.Error(w, "Couldn't get the token: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "The provider didn't send an id token", http.StatusUnauthorized)
+		return
+	}
+	idt, err := o.verifier.Verify(ctx, raw)
+	if err != nil {
+		http.Error(w, "Invalid id token: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if idt.Nonce != nonce {
+		http.Error(w, "The id token is for another login", http.StatusUnauthorized)
+		return
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified *bool  `json:"email_verified"`
+	}
+	if err := idt.Claims(&claims); err != nil {
+		http.Error(w, "Invalid id token: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	// An email the provider hasn't said it checked could be anyone's.
+	if claims.EmailVerified == nil || !*claims.EmailVerified {
+		claims.Email = ""
+	}
+
+	p := Principal{Name: idt.Subject, Role: RoleReader}
+	if claims.Email != "" {
+		p.Name = claims.Email
+	}
+	if o.admins[idt.Subject] || (claims.Email != "" && o.admins[claims.Email]) {
+		p.Role = RoleAdmin
+	}
+	if err := o.sessions.Issue(w, r, p); err != nil {
+		http.Error(w, "Couldn't make a session: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (o *OIDC) logout(w http.ResponseWriter, r *http.Request) {
+	o.sessions.Clear(w)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
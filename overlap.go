@@ -0,0 +1,72 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+)
+
+// FeedRank is where a repo is in a feed. Rank starts at 1.
+type FeedRank struct {
+	Lang   string
+	Period string
+	Rank   int
+}
+
+// RepoFeeds is a repo with all the latest feeds it is in.
+type RepoFeeds struct {
+	TrendingItem
+	Feeds []FeedRank
+}
+
+// Overlap groups the repos in the latest scrapes of the languages, so that each
+// repo is there once with all the feeds it is in. Repos in the most feeds come
+// first.
+func (c *Crawler) Overlap(langs []Language) ([]RepoFeeds, error) {
+	byRepo := make(map[string]*RepoFeeds)
+	var order []string
+	for _, l := range langs {
+		for _, p := range []string{PeriodDaily, PeriodWeekly, PeriodMonthly} {
+			tis, _, err := c.Latest(l, p)
+			if err == ErrNoScrapesForLang || err == ErrNoScrapesForPeriod {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			for i, ti := range tis {
+				k := ti.RepoOwner + "/" + ti.RepoName
+				rf, ok := byRepo[k]
+				if !ok {
+					rf = &RepoFeeds{TrendingItem: ti}
+					byRepo[k] = rf
+					order = append(order, k)
+				}
+				rf.Feeds = append(rf.Feeds, FeedRank{Lang: l.StoreName, Period: p, Rank: i + 1})
+			}
+		}
+	}
+
+	rfs := make([]RepoFeeds, len(order))
+	for i, k := range order {
+		rfs[i] = *byRepo[k]
+	}
+	// Stable, so that repos in as many feeds stay in the order they were first
+	// seen in.
+	sort.SliceStable(rfs, func(i, j int) bool {
+		return len(rfs[i].Feeds) > len(rfs[j].Feeds)
+	})
+	return rfs, nil
+}
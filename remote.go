@@ -0,0 +1,300 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Remote runs commands against a running server over its API. Bolt only lets
+// one process open the database, so while the server runs this is the only
+// way to reach it.
+type Remote struct {
+	base  string
+	token string
+	c     http.Client
+}
+
+// NewRemote talks to the server at the URL, using the token for the admin
+// endpoints.
+func NewRemote(server, token string) (*Remote, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Invalid server, it must be a http or https URL: %s", server)
+	}
+	return &Remote{base: strings.TrimRight(server, "/"), token: token}, nil
+}
+
+// DialControlSocket talks to the server listening on the unix socket. Nobody
+// else can open the socket, so no token is needed.
+func DialControlSocket(path string) (*Remote, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+
+	rm := &Remote{base: "http://control"}
+	rm.c.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	return rm, nil
+}
+
+// do sends the request, and turns error responses into errors.
+func (rm *Remote) do(method, path string, query url.Values) (*http.Response, error) {
+	u := rm.base + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rm.token != "" {
+		req.Header.Set("Authorization", "Bearer "+rm.token)
+	}
+	res, err := rm.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 400 {
+		defer res.Body.Close()
+		return nil, remoteError(res)
+	}
+	return res, nil
+}
+
+// getJSON decodes the response to a GET into v.
+func (rm *Remote) getJSON(path string, query url.Values, v interface{}) error {
+	res, err := rm.do(http.MethodGet, path, query)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// remoteError makes an error out of an error response from either version of
+// the API, or from something else entirely.
+func remoteError(res *http.Response) error {
+	bb, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+
+	var v2 V2Error
+	if json.Unmarshal(bb, &v2) == nil && v2.Error.Message != "" {
+		return fmt.Errorf("Server said %s: %s", res.Status, v2.Error.Message)
+	}
+	var v1 ApiError
+	if json.Unmarshal(bb, &v1) == nil && v1.Error != "" {
+		return fmt.Errorf("Server said %s: %s", res.Status, v1.Error)
+	}
+	if msg := strings.TrimSpace(string(bb)); msg != "" {
+		return fmt.Errorf("Server said %s: %s", res.Status, msg)
+	}
+	return fmt.Errorf("Server said %s", res.Status)
+}
+
+func (rm *Remote) Follows() ([]string, error) {
+	var fs []string
+	err := rm.getJSON("/api/v1/follows", nil, &fs)
+	return fs, err
+}
+
+func (rm *Remote) Follow(lang string) error {
+	res, err := rm.do(http.MethodPut, "/api/v1/follows/"+url.PathEscape(lang), nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (rm *Remote) Unfollow(lang string) error {
+	res, err := rm.do(http.MethodDelete, "/api/v1/follows/"+url.PathEscape(lang), nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Refresh refreshes the followed languages, and returns when it is done.
+func (rm *Remote) Refresh() error {
+	res, err := rm.do(http.MethodPost, "/api/v1/refresh", nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// History returns the times of all scrapes for the language, oldest first.
+func (rm *Remote) History(lang string) ([]time.Time, error) {
+	var ts []time.Time
+	q := url.Values{"language": {lang}, "limit": {fmt.Sprint(MaxPageLimit)}}
+	for {
+		var page struct {
+			Data       []V2Scrape `json:"data"`
+			NextCursor string     `json:"next_cursor"`
+		}
+		if err := rm.getJSON("/api/v2/scrapes", q, &page); err != nil {
+			return nil, err
+		}
+		for _, s := range page.Data {
+			ts = append(ts, s.ScrapedAt)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Set("cursor", page.NextCursor)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Before(ts[j]) })
+	return ts, nil
+}
+
+// Export writes the records matching the filter to w, in the format.
+func (rm *Remote) Export(w io.Writer, format string, f RecordFilter) error {
+	q := url.Values{"format": {format}}
+	var langs []string
+	for _, l := range f.Langs {
+		langs = append(langs, l.StoreName)
+	}
+	if len(langs) != 0 {
+		q.Set("langs", strings.Join(langs, ","))
+	}
+	if f.Period != "" {
+		q.Set("period", f.Period)
+	}
+	if !f.Since.IsZero() {
+		q.Set("since", f.Since.Format(time.RFC3339))
+	}
+	if !f.Until.IsZero() {
+		q.Set("until", f.Until.Format(time.RFC3339))
+	}
+
+	res, err := rm.do(http.MethodGet, "/api/v1/export", q)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// Backup writes a backup of the database of the server to w, gzipped with
+// compress.
+func (rm *Remote) Backup(w io.Writer, compress bool) error {
+	var q url.Values
+	if compress {
+		q = url.Values{"gzip": {"1"}}
+	}
+	res, err := rm.do(http.MethodGet, "/admin/backup", q)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// controlSocketPath is where the server listens for the command line, or
+// empty if it doesn't.
+func controlSocketPath() string {
+	switch *controlSocket {
+	case "none":
+		return ""
+	case "":
+	default:
+		return *controlSocket
+	}
+	kind, path := splitStoreSpec(*dbPath)
+	if kind == "memory" {
+		return ""
+	}
+	return path + ".sock"
+}
+
+// listenControlSocket serves the website on the control socket as well, to
+// the command line. Requests coming through it are trusted, as only the user
+// running the server can open it. It returns the server listening, if any.
+func listenControlSocket(hh http.Handler) *http.Server {
+	path := controlSocketPath()
+	if path == "" {
+		return nil
+	}
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			slog.Error("Another server is listening on the control socket, not making one", "path", path)
+			return nil
+		}
+		// Left behind by a server that didn't get to clean up.
+		os.Remove(path)
+	}
+
+	l, err := listenPrivate(path)
+	if err != nil {
+		slog.Error("Couldn't make the control socket", "path", path, "err", err)
+		return nil
+	}
+
+	srv := &http.Server{
+		Handler: hh,
+		ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+			return context.WithValue(ctx, ctxControl, true)
+		},
+	}
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			slog.Error("The control socket stopped", "path", path, "err", err)
+		}
+	}()
+	return srv
+}
+
+// remote returns the server the command line should talk to, if any. It is
+// the one given with -server, or the one listening on the control socket.
+func remote() (*Remote, error) {
+	if *server != "" {
+		return NewRemote(*server, *adminToken)
+	}
+	path := controlSocketPath()
+	if path == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil
+	}
+	rm, err := DialControlSocket(path)
+	if err != nil {
+		// Nobody is listening, so the database should be free.
+		return nil, nil
+	}
+	return rm, nil
+}
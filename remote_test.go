@@ -0,0 +1,116 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestControlSocketPath(t *testing.T) {
+	oldDB, oldSocket := *dbPath, *controlSocket
+	defer func() { *dbPath, *controlSocket = oldDB, oldSocket }()
+
+	tests := []struct {
+		db, socket, want string
+	}{
+		{"trendhub.db", "", "trendhub.db.sock"},
+		{"bolt:data/trendhub.db", "", "data/trendhub.db.sock"},
+		{"sqlite:trendhub.sqlite", "", "trendhub.sqlite.sock"},
+		{"memory:", "", ""},
+		{"trendhub.db", "none", ""},
+		{"memory:", "/run/trendhub.sock", "/run/trendhub.sock"},
+	}
+	for _, tt := range tests {
+		*dbPath, *controlSocket = tt.db, tt.socket
+		if got := controlSocketPath(); got != tt.want {
+			t.Errorf("with %q and %q: got %q, want %q", tt.db, tt.socket, got, tt.want)
+		}
+	}
+}
+
+func TestListenPrivate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the mode of a socket means nothing on windows")
+	}
+	path := filepath.Join(t.TempDir(), "test.sock")
+	l, err := listenPrivate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		t.Errorf("got mode %s, want only the owner to have access", fi.Mode().Perm())
+	}
+}
+
+func TestRemoteBackup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the control socket is a unix socket")
+	}
+	oldDB, oldSocket := *dbPath, *controlSocket
+	defer func() { *dbPath, *controlSocket = oldDB, oldSocket }()
+
+	// The server holds the lock on the database, so the backup has to go
+	// through it.
+	s := openTestBolt(t)
+	goLang := StoreToLang["go"]
+	t1 := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	saveTestScrape(t, s, goLang, t1, "o", "r")
+	c := &Crawler{Store: s, followed: make(chan Language, 16), events: newScrapeEvents()}
+
+	*controlSocket = filepath.Join(t.TempDir(), "test.sock")
+	srv := listenControlSocket(NewWebsite(c, WebsiteOptions{}))
+	if srv == nil {
+		t.Fatal("the control socket wasn't made")
+	}
+	defer srv.Shutdown(context.Background())
+
+	rm, err := DialControlSocket(*controlSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := rm.Backup(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "backup.db")
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	tis, ts, err := b.Latest(goLang, PeriodDaily)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ts.Equal(t1) || len(tis) != 1 || tis[0].RepoOwner != "o" || tis[0].RepoName != "r" {
+		t.Errorf("got %v at %s, want o/r at %s", tis, ts, t1)
+	}
+}
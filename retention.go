@@ -0,0 +1,110 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// RetentionPolicy decides which scrapes we keep as they get older. Everything
+// younger than KeepAll is kept, then one scrape per day is kept until KeepDaily,
+// and after that one scrape per week.
+type RetentionPolicy struct {
+	KeepAll   time.Duration
+	KeepDaily time.Duration
+}
+
+var DefaultRetention = RetentionPolicy{
+	KeepAll:   7 * 24 * time.Hour,
+	KeepDaily: 90 * 24 * time.Hour,
+}
+
+// PruneStats is a summary of what a prune did.
+type PruneStats struct {
+	Kept    int
+	Removed int
+}
+
+// Expired returns the scrape times that the policy does not want to keep, as seen
+// from now. We always keep the earliest scrape in a day or week, so that the
+// choice doesn't change as more scrapes age into the same slot.
+func (p RetentionPolicy) Expired(times []time.Time, now time.Time) []time.Time {
+	sorted := make([]time.Time, len(times))
+	copy(sorted, times)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Before(sorted[j]) })
+
+	type slot struct {
+		weekly bool
+		year   int
+		n      int
+	}
+	seen := make(map[slot]struct{})
+
+	var expired []time.Time
+	for _, ts := range sorted {
+		age := now.Sub(ts)
+		if age < p.KeepAll {
+			continue
+		}
+
+		var s slot
+		if age < p.KeepDaily {
+			s = slot{year: ts.UTC().Year(), n: ts.UTC().YearDay()}
+		} else {
+			y, w := ts.UTC().ISOWeek()
+			s = slot{weekly: true, year: y, n: w}
+		}
+
+		if _, ok := seen[s]; ok {
+			expired = append(expired, ts)
+			continue
+		}
+		seen[s] = struct{}{}
+	}
+	return expired
+}
+
+// Prune removes the scrapes the policy doesn't want to keep.
+func (c *Crawler) Prune(p RetentionPolicy, now time.Time) (PruneStats, error) {
+	var stats PruneStats
+
+	for _, lang := range StoreToLang {
+		times, err := c.ScrapeHistory(lang)
+		if err != nil {
+			return stats, err
+		}
+
+		expired := p.Expired(times, now)
+		for _, ts := range expired {
+			if err := c.DeleteScrape(lang, ts); err != nil {
+				return stats, err
+			}
+		}
+		stats.Removed += len(expired)
+		stats.Kept += len(times) - len(expired)
+	}
+	return stats, nil
+}
+
+// Compact gives the space freed by pruning back to the filesystem, if the store
+// supports it. It returns the size before and after.
+func (c *Crawler) Compact() (int64, int64, error) {
+	cp, ok := c.Store.(Compacter)
+	if !ok {
+		return 0, 0, ErrNotSupported
+	}
+	return cp.Compact()
+}
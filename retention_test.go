@@ -0,0 +1,108 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	testPolicy = RetentionPolicy{KeepAll: 24 * time.Hour, KeepDaily: 10 * 24 * time.Hour}
+	testNow    = time.Date(2026, 9, 30, 12, 0, 0, 0, time.UTC)
+)
+
+func TestExpired(t *testing.T) {
+	day := time.Date(2026, 9, 27, 8, 0, 0, 0, time.UTC)
+	// Tuesday and Thursday of the same week, both older than KeepDaily.
+	tue := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	thu := time.Date(2026, 9, 3, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		times []time.Time
+		want  []time.Time
+	}{
+		{"empty", nil, nil},
+		{"young", []time.Time{testNow.Add(-time.Hour), testNow.Add(-2 * time.Hour)}, nil},
+		{"one a day", []time.Time{day, day.Add(6 * time.Hour), day.Add(24 * time.Hour)}, []time.Time{day.Add(6 * time.Hour)}},
+		{"earliest is kept", []time.Time{day.Add(6 * time.Hour), day}, []time.Time{day.Add(6 * time.Hour)}},
+		{"one a week", []time.Time{tue, thu, thu.Add(7 * 24 * time.Hour)}, []time.Time{thu}},
+		{"all of them", []time.Time{testNow, day, day.Add(time.Hour), tue, thu}, []time.Time{thu, day.Add(time.Hour)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := testPolicy.Expired(tt.times, testNow)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	goLang := StoreToLang["go"]
+	day := time.Date(2026, 9, 27, 8, 0, 0, 0, time.UTC)
+	times := []time.Time{testNow.Add(-time.Hour), day, day.Add(6 * time.Hour)}
+	want := []time.Time{day, testNow.Add(-time.Hour)}
+
+	for _, kind := range storeKinds {
+		t.Run(kind, func(t *testing.T) {
+			c := &Crawler{Store: openTestStore(t, kind)}
+			for _, ts := range times {
+				saveTestScrape(t, c, goLang, ts, "o", "r")
+			}
+
+			stats, err := c.Prune(testPolicy, testNow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats != (PruneStats{Kept: 2, Removed: 1}) {
+				t.Errorf("got stats %+v, want 2 kept and 1 removed", stats)
+			}
+			got, err := c.ScrapeHistory(goLang)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got history %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestPruneSkipsBadKeys(t *testing.T) {
+	s := openTestBolt(t)
+	goLang := StoreToLang["go"]
+	saveTestScrape(t, s, goLang, testNow.Add(-time.Hour), "o", "r")
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket(LanguageBucket).Bucket([]byte(goLang.StoreName)).CreateBucket([]byte("not a time"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := (&Crawler{Store: s}).Prune(testPolicy, testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (PruneStats{Kept: 1}) {
+		t.Errorf("got stats %+v, want 1 kept", stats)
+	}
+}
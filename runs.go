@@ -0,0 +1,91 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// maxRuns is how many refresh runs are remembered.
+const maxRuns = 100
+
+var ErrUnknownRun = errors.New("Unknown run")
+
+// Run is a refresh of the followed languages. Runs are only kept in memory, so
+// they are lost on restart.
+type Run struct {
+	ID         int
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Langs are the languages that were saved.
+	Langs []string
+	// Error is why the run stopped early, if it did.
+	Error string
+}
+
+// runLog remembers the latest runs of a crawler.
+type runLog struct {
+	mu   sync.Mutex
+	next int
+	runs []Run
+}
+
+// start adds a run that started now and returns its id.
+func (rl *runLog) start() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.next++
+	rl.runs = append(rl.runs, Run{ID: rl.next, StartedAt: time.Now().UTC()})
+	if len(rl.runs) > maxRuns {
+		rl.runs = rl.runs[len(rl.runs)-maxRuns:]
+	}
+	return rl.next
+}
+
+// update changes the run with the id, if it is still remembered.
+func (rl *runLog) update(id int, fn func(r *Run)) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for i := range rl.runs {
+		if rl.runs[i].ID == id {
+			fn(&rl.runs[i])
+			return
+		}
+	}
+}
+
+// Runs returns the remembered refresh runs, newest first.
+func (c *Crawler) Runs() []Run {
+	c.runs.mu.Lock()
+	defer c.runs.mu.Unlock()
+	rs := make([]Run, len(c.runs.runs))
+	for i, r := range c.runs.runs {
+		r.Langs = append([]string(nil), r.Langs...)
+		rs[len(rs)-1-i] = r
+	}
+	return rs
+}
+
+// Run returns the refresh run with the id.
+func (c *Crawler) Run(id int) (Run, error) {
+	for _, r := range c.Runs() {
+		if r.ID == id {
+			return r, nil
+		}
+	}
+	return Run{}, ErrUnknownRun
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var ErrEmptyQuery = errors.New("Nothing to search for")
+
+// FeedAppearance is when a repo was in a feed.
+type FeedAppearance struct {
+	Lang      string
+	Period    string
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// SearchResult is a repo matching a search, with the feeds it was in.
+type SearchResult struct {
+	RepoInfo
+	Feeds []FeedAppearance
+}
+
+// searchTerms splits text into the lowercased words we index and search for.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// repoTerms returns the words of a repo that are indexed, without repeats.
+func repoTerms(ri RepoInfo) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, t := range searchTerms(ri.Owner + " " + ri.Name + " " + ri.Description + " " + ri.Language) {
+		if !seen[t] {
+			seen[t] = true
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// matchTerms says if every term is the start of one of the words.
+func matchTerms(words, terms []string) bool {
+	for _, t := range terms {
+		found := false
+		for _, w := range words {
+			if strings.HasPrefix(w, t) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Search finds the repos matching all the words in q that were in a feed
+// matching the filter, or in a feed of a followed language if it has none. The
+// latest seen come first, and there are at most limit of them, unless it is 0.
+func (c *Crawler) Search(q string, f RecordFilter, limit int) ([]SearchResult, error) {
+	terms := searchTerms(q)
+	if len(terms) == 0 {
+		return nil, ErrEmptyQuery
+	}
+	rs, err := c.SearchRepos(terms)
+	if err != nil {
+		return nil, err
+	}
+
+	byRepo := make(map[string]*SearchResult, len(rs))
+	for _, ri := range rs {
+		byRepo[ri.Owner+"/"+ri.Name] = &SearchResult{RepoInfo: ri}
+	}
+
+	// Each feed we look in is read whole, so we only look in those asked for.
+	langs := f.Langs
+	if len(langs) == 0 {
+		if langs, err = c.Follows(); err != nil {
+			return nil, err
+		}
+	}
+	periods := []string{PeriodDaily, PeriodWeekly, PeriodMonthly}
+	if f.Period != "" {
+		periods = []string{f.Period}
+	}
+
+	// A repo matches the dates if it was in the feed at some point between
+	// them, as far as we can tell from when it was first and last seen.
+	for _, l := range langs {
+		for _, p := range periods {
+			seen, err := c.Seen(l, p)
+			if err != nil {
+				return nil, err
+			}
+			for k, res := range byRepo {
+				fs, ok := seen[k]
+				if !ok {
+					continue
+				}
+				if !f.Since.IsZero() && fs.LastSeen.Before(f.Since) {
+					continue
+				}
+				if !f.Until.IsZero() && fs.FirstSeen.After(f.Until) {
+					continue
+				}
+				res.Feeds = append(res.Feeds, FeedAppearance{
+					Lang:      l.StoreName,
+					Period:    p,
+					FirstSeen: fs.FirstSeen,
+					LastSeen:  fs.LastSeen,
+				})
+			}
+		}
+	}
+
+	results := []SearchResult{}
+	for _, res := range byRepo {
+		if len(res.Feeds) != 0 {
+			results = append(results, *res)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if !a.LastSeen.Equal(b.LastSeen) {
+			return a.LastSeen.After(b.LastSeen)
+		}
+		if a.Owner != b.Owner {
+			return a.Owner < b.Owner
+		}
+		return a.Name < b.Name
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", []string{}},
+		{"  ,.- ", []string{}},
+		{"Hello World", []string{"hello", "world"}},
+		{"node.js, C++ & v2", []string{"node", "js", "c", "v2"}},
+		{"rhermes/trend-hub", []string{"rhermes", "trend", "hub"}},
+		{"Über schnelle Daten", []string{"über", "schnelle", "daten"}},
+		{"日本語 text", []string{"日本語", "text"}},
+	}
+	for _, tt := range tests {
+		if got := searchTerms(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("searchTerms(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSearchReposAgree(t *testing.T) {
+	goLang := StoreToLang["go"]
+	t1 := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	scrapes := []Scrape{
+		{Lang: goLang, TakenAt: t1, Periods: map[string][]TrendingItem{PeriodDaily: {
+			{RepoOwner: "o", RepoName: "json-parser", Description: "A fast JSON parser", Language: "Go"},
+			{RepoOwner: "o", RepoName: "web", Description: "Web framework for Go, v2", Language: "Go"},
+			{RepoOwner: "p", RepoName: "db", Description: "Über schnelle Datenbank", Language: "Rust"},
+		}}},
+		// The description of web changes, and the old words go.
+		{Lang: goLang, TakenAt: t1.Add(time.Hour), Periods: map[string][]TrendingItem{PeriodDaily: {
+			{RepoOwner: "o", RepoName: "web", Description: "Web toolkit", Language: "Go"},
+		}}},
+	}
+	tests := []struct {
+		terms []string
+		want  []string
+	}{
+		{[]string{"fast"}, []string{"o/json-parser"}},
+		{[]string{"json", "pars"}, []string{"o/json-parser"}},
+		{[]string{"pars", "web"}, nil},
+		{[]string{"go"}, []string{"o/json-parser", "o/web"}},
+		{[]string{"o"}, []string{"o/json-parser", "o/web"}},
+		{[]string{"web", "tool"}, []string{"o/web"}},
+		{[]string{"framework"}, nil},
+		{[]string{"v2"}, nil},
+		{[]string{"über"}, []string{"p/db"}},
+		{[]string{"uber"}, nil},
+		{[]string{"rust", "daten"}, []string{"p/db"}},
+		{[]string{"x"}, nil},
+	}
+
+	for _, kind := range storeKinds {
+		s := openTestStore(t, kind)
+		for _, sc := range scrapes {
+			if err := s.SaveScrape(sc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, tt := range tests {
+			rs, err := s.SearchRepos(tt.terms)
+			if err != nil {
+				t.Fatalf("%s %q: %v", kind, tt.terms, err)
+			}
+			var got []string
+			for _, ri := range rs {
+				got = append(got, ri.Owner+"/"+ri.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s %q: got %v, want %v", kind, tt.terms, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestSearchFollowed(t *testing.T) {
+	c, err := NewCrawler("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Follow(LangGo); err != nil {
+		t.Fatal(err)
+	}
+	t1 := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	saveTestScrape(t, c, LangGo, t1, "o", "go-parser")
+	saveTestScrape(t, c, LangRust, t1.Add(time.Hour), "o", "rust-parser")
+
+	tests := []struct {
+		f    RecordFilter
+		want []string
+	}{
+		// Unfollowed languages are only searched when asked for.
+		{RecordFilter{}, []string{"go-parser daily"}},
+		{RecordFilter{Langs: []Language{LangRust}}, []string{"rust-parser daily"}},
+		{RecordFilter{Langs: []Language{LangGo, LangRust}}, []string{"rust-parser daily", "go-parser daily"}},
+		{RecordFilter{Period: PeriodWeekly}, nil},
+		{RecordFilter{Since: t1.Add(time.Minute)}, nil},
+	}
+	for _, tt := range tests {
+		rs, err := c.Search("pars", tt.f, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range rs {
+			for _, fa := range r.Feeds {
+				got = append(got, r.Name+" "+fa.Period)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.f, got, tt.want)
+		}
+	}
+
+	if _, err := c.Search(" -- ", RecordFilter{}, 0); err != ErrEmptyQuery {
+		t.Errorf("got %v for an empty query, want %v", err, ErrEmptyQuery)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivate listens on a unix socket at path that only we can connect to.
+// The socket is made with the umask tightened, as changing its mode after it
+// is made leaves a moment where anyone could connect. The umask belongs to the
+// whole process, but files made meanwhile only end up more private.
+func listenPrivate(path string) (net.Listener, error) {
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
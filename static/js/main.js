@@ -19,6 +19,79 @@ function langTitleClick(lang) {
   b.classList.toggle("cloaked");
 }
 
+// markRepo toggles the mark of the button for its repo. Hidden repos are
+// removed from the page right away.
+function markRepo(button) {
+  const mark = button.dataset.mark;
+  const on = !button.classList.contains("mark-on");
+  const url = "/api/v1/marks/" + mark + "/" + button.dataset.repo;
+
+  fetch(url, { method: on ? "PUT" : "DELETE", credentials: "same-origin" })
+    .then((res) => {
+      if (!res.ok) {
+        throw new Error(res.statusText);
+      }
+      if (mark === "hidden") {
+        document.querySelectorAll('.mark[data-repo="' + button.dataset.repo + '"]')
+          .forEach((x) => x.closest(".trending-item").remove());
+        return;
+      }
+      button.classList.toggle("mark-on", on);
+    })
+    .catch((err) => console.error("Couldn't mark " + button.dataset.repo + ": " + err));
+}
+
+// updateLangs replaces the sections of the languages with those of the page as
+// it is now, keeping the ones that were folded away folded. Only the sections
+// are fetched, not the whole page.
+function updateLangs(langs) {
+  const url = new URL("/fragments/trending-langs" + window.location.search, window.location.origin);
+  url.searchParams.set("fragment", langs.join(","));
+  fetch(url, { credentials: "same-origin" })
+    .then((res) => {
+      if (!res.ok) {
+        throw new Error(res.statusText);
+      }
+      return res.text();
+    })
+    .then((html) => {
+      const doc = new DOMParser().parseFromString(html, "text/html");
+      langs.forEach((lang) => {
+        const old = document.getElementById("lang-" + lang);
+        const fresh = doc.getElementById("lang-" + lang);
+        if (!old || !fresh) {
+          return;
+        }
+        const folded = old.querySelector(".trending-item-list").classList.contains("cloaked");
+        fresh.querySelector(".trending-item-list").classList.toggle("cloaked", folded);
+        fresh.classList.add("trending-lang-updated");
+        old.replaceWith(fresh);
+      });
+    })
+    .catch((err) => console.error("Couldn't update " + langs.join(", ") + ": " + err));
+}
+
+// listenForScrapes updates the languages on the page as they are scraped. A
+// refresh scrapes them one after the other, so they are gathered up for a
+// moment to fetch them all at once.
+function listenForScrapes() {
+  if (LANGUAGES.length === 0 || !window.EventSource) {
+    return;
+  }
+  const pending = new Set();
+  const es = new EventSource("/api/v1/events?langs=" + LANGUAGES.map(encodeURIComponent).join(","));
+  es.addEventListener("scrape", (e) => {
+    const ev = JSON.parse(e.data);
+    if (pending.size === 0) {
+      setTimeout(() => {
+        updateLangs(Array.from(pending));
+        pending.clear();
+      }, 1000);
+    }
+    pending.add(ev.language);
+  });
+}
+
 function isScrolledIntoView(el) {
     var rect = el.getBoundingClientRect();
     var elemTop = rect.top;
@@ -55,4 +128,5 @@ function isScrolledIntoView(el) {
 
   // Initial setup
   document.addEventListener("scroll", sidebarHighlightFunc);
+  listenForScrapes();
 })();
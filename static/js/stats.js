@@ -0,0 +1,37 @@
+/**
+ * Copyright 2019 Teodor Spæren
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// sortTable sorts the table of the clicked header by its column. Clicking the
+// same header again reverses the order.
+function sortTable(th) {
+  const table = th.closest("table");
+  const tbody = table.querySelector("tbody");
+  const col = Array.from(th.parentNode.children).indexOf(th);
+  const numeric = th.hasAttribute("data-numeric");
+  const desc = th.dataset.order !== "desc";
+
+  table.querySelectorAll("th").forEach((x) => delete x.dataset.order);
+  th.dataset.order = desc ? "desc" : "asc";
+
+  const rows = Array.from(tbody.rows);
+  rows.sort((a, b) => {
+    let x = a.cells[col].textContent.trim();
+    let y = b.cells[col].textContent.trim();
+    let r = numeric ? parseFloat(x) - parseFloat(y) : x.localeCompare(y);
+    return desc ? -r : r;
+  });
+  rows.forEach((row) => tbody.appendChild(row));
+}
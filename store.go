@@ -0,0 +1,272 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownRepo  = errors.New("Unknown repository")
+	ErrUnknownUser  = errors.New("Unknown user")
+	ErrNotSupported = errors.New("The store doesn't support this")
+)
+
+// Scrape is the trending pages for a language, taken at the same time.
+type Scrape struct {
+	Lang    Language
+	TakenAt time.Time
+	// Periods maps from the period to the items on its page, in order.
+	Periods map[string][]TrendingItem
+}
+
+// RepoInfo is what we know about a repository from the last time it was trending.
+type RepoInfo struct {
+	Owner       string
+	Name        string
+	Description string
+	Language    string
+	LastSeen    time.Time
+}
+
+// FeedSeen is when a repo was first and last in a feed, the list of a language
+// and period. It is kept when scrapes are pruned.
+type FeedSeen struct {
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// Store is where the crawler keeps follows and scrapes.
+type Store interface {
+	Follows() ([]Language, error)
+	Follow(lang Language) error
+	Unfollow(lang Language) error
+
+	// SaveScrape stores the items of a scrape. Items already stored for the same
+	// language, time, period and rank are replaced, so saving a scrape twice is
+	// harmless. Items without an owner are skipped, which lets a scrape hold
+	// only some of the ranks. The repo index and when repos were seen in each
+	// feed are updated as well.
+	SaveScrape(s Scrape) error
+	// DeleteScrape removes a scrape and all its items.
+	DeleteScrape(lang Language, ts time.Time) error
+
+	// Latest returns the latest scrape for the period, with the time of the scrape.
+	Latest(lang Language, period string) ([]TrendingItem, time.Time, error)
+	// ScrapeHistory returns the times of all scrapes for the language, oldest
+	// first. Scrapes stored under a time that doesn't parse are logged and
+	// skipped, so they don't stop a prune.
+	ScrapeHistory(lang Language) ([]time.Time, error)
+	// GetScrape returns a specific scrape from history.
+	GetScrape(lang Language, period string, ts time.Time) ([]TrendingItem, error)
+	// ForEachRecord calls fn for every stored item matching the filter, in order
+	// of language, scrape time, period and rank.
+	ForEachRecord(f RecordFilter, fn func(ScrapeRecord) error) error
+
+	// Repo looks up a repository in the repo index.
+	Repo(owner, name string) (RepoInfo, error)
+	// Repos returns the whole repo index, sorted by owner and name.
+	Repos() ([]RepoInfo, error)
+	// SearchRepos returns the repos where every term is the start of a word in
+	// the owner, name, description or language, sorted by owner and name. The
+	// terms are lowercase letters and digits, see searchTerms.
+	SearchRepos(terms []string) ([]RepoInfo, error)
+	// Seen returns when the repos of a feed were first and last seen, keyed by
+	// owner/name.
+	Seen(lang Language, period string) (map[string]FeedSeen, error)
+
+	// Marks returns how the user has marked repos, keyed by owner/name.
+	Marks(user string) (map[string]RepoMarks, error)
+	// SetMark marks a repo for the user, or removes the mark if on is false.
+	SetMark(user string, m Mark, owner, name string, on bool) error
+	// AllMarks returns the marks of every user, keyed by user and owner/name.
+	AllMarks() (map[string]map[string]RepoMarks, error)
+	// SaveMarks adds marks for the user, keeping the times they were marked.
+	SaveMarks(user string, marks map[string]RepoMarks) error
+
+	// SaveNote adds a version to the note of a repo.
+	SaveNote(n Note) error
+	// NoteHistory returns every version of the note of a repo, oldest first.
+	NoteHistory(owner, name string) ([]Note, error)
+	// Notes returns the latest version of the notes that aren't deleted,
+	// sorted by owner and name.
+	Notes() ([]Note, error)
+	// ForEachNote calls fn for every version of every note, deleted ones
+	// included. The versions of a repo come after each other, oldest first.
+	ForEachNote(fn func(Note) error) error
+
+	// Users returns the users that log in with a password, sorted by name.
+	Users() ([]User, error)
+	// User looks up a user, or returns ErrUnknownUser.
+	User(name string) (User, error)
+	// SaveUser adds a user, or replaces the one with the same name.
+	SaveUser(u User) error
+	// DeleteUser removes a user, or returns ErrUnknownUser.
+	DeleteUser(name string) error
+
+	Close() error
+}
+
+// Compacter is implemented by stores that can give unused space back to the
+// filesystem. It returns the size before and after.
+type Compacter interface {
+	Compact() (int64, int64, error)
+}
+
+// Backuper is implemented by stores that can write a consistent snapshot of
+// themselves while in use.
+type Backuper interface {
+	Backup(w io.Writer, compress bool) (int64, error)
+}
+
+// splitStoreSpec splits a store spec like "sqlite:trendhub.sqlite" into the kind
+// and the path. Anything without a known prefix is a path to a bolt database.
+func splitStoreSpec(spec string) (string, string) {
+	for _, kind := range []string{"bolt", "sqlite", "memory"} {
+		if strings.HasPrefix(spec, kind+":") {
+			return kind, strings.TrimPrefix(spec, kind+":")
+		}
+	}
+	return "bolt", spec
+}
+
+// OpenStore opens the store described by spec, see splitStoreSpec.
+func OpenStore(spec string) (Store, error) {
+	kind, path := splitStoreSpec(spec)
+	switch kind {
+	case "bolt":
+		return OpenBoltStore(path)
+	case "sqlite":
+		return OpenSQLiteStore(path)
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("Unknown store: %s", kind)
+	}
+}
+
+// skipScrape logs that the scrape stored under key is skipped, as the key isn't
+// a time.
+func skipScrape(lang Language, key string, err error) {
+	slog.Warn("Skipping scrape with a bad time", "language", lang.StoreName, "key", key, "err", err)
+}
+
+// maxRank is the highest rank a scrape can hold, as itemKey has two digits.
+const maxRank = 99
+
+// itemKey is the key of an item within a scrape, like "daily-03". The rank
+// starts at 0, and sorting the keys puts a period in rank order.
+func itemKey(period string, rank int) string {
+	return fmt.Sprintf("%s-%02d", period, rank)
+}
+
+// scrapeWriter groups records into scrapes and saves them. Records that belong to
+// the same scrape should come after each other, but it is only slower if not.
+type scrapeWriter struct {
+	s   Store
+	cur Scrape
+	n   int
+}
+
+func (sw *scrapeWriter) add(r ScrapeRecord) error {
+	if err := validateRecord(r); err != nil {
+		return err
+	}
+	if sw.cur.Lang.StoreName != r.Language || !sw.cur.TakenAt.Equal(r.ScrapedAt) {
+		if err := sw.flush(); err != nil {
+			return err
+		}
+		sw.cur = Scrape{
+			Lang:    StoreToLang[r.Language],
+			TakenAt: r.ScrapedAt,
+			Periods: make(map[string][]TrendingItem),
+		}
+	}
+
+	tis := sw.cur.Periods[r.Period]
+	for len(tis) < r.Rank {
+		tis = append(tis, TrendingItem{})
+	}
+	tis[r.Rank-1] = r.TrendingItem()
+	sw.cur.Periods[r.Period] = tis
+	sw.n++
+	return nil
+}
+
+func (sw *scrapeWriter) flush() error {
+	if len(sw.cur.Periods) == 0 {
+		return nil
+	}
+	err := sw.s.SaveScrape(sw.cur)
+	sw.cur = Scrape{}
+	return err
+}
+
+// CopyStore copies the follows, users, marks, notes and all scrapes from src to dst,
+// returning the number of items copied.
+func CopyStore(dst, src Store) (int, error) {
+	fs, err := src.Follows()
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range fs {
+		if err := dst.Follow(f); err != nil {
+			return 0, err
+		}
+	}
+	us, err := src.Users()
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range us {
+		if err := dst.SaveUser(u); err != nil {
+			return 0, err
+		}
+	}
+	ms, err := src.AllMarks()
+	if err != nil {
+		return 0, err
+	}
+	for user, marks := range ms {
+		if err := dst.SaveMarks(user, marks); err != nil {
+			return 0, err
+		}
+	}
+	if err := src.ForEachNote(dst.SaveNote); err != nil {
+		return 0, err
+	}
+
+	sw := &scrapeWriter{s: dst}
+	if err := src.ForEachRecord(RecordFilter{}, sw.add); err != nil {
+		return sw.n, err
+	}
+	return sw.n, sw.flush()
+}
+
+// sortRepos sorts repos by owner and name.
+func sortRepos(rs []RepoInfo) {
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].Owner != rs[j].Owner {
+			return rs[i].Owner < rs[j].Owner
+		}
+		return rs[i].Name < rs[j].Name
+	})
+}
@@ -0,0 +1,1006 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	FollowsBucket  = []byte("follows")
+	LanguageBucket = []byte("language")
+	ReposBucket    = []byte("repos")
+	RepoIDsBucket  = []byte("repo-ids")
+	SeenBucket     = []byte("seen")
+	MarksBucket    = []byte("marks")
+	NotesBucket    = []byte("notes")
+	SearchBucket   = []byte("search")
+	UsersBucket    = []byte("users")
+)
+
+// dbOpenTimeout is how long we wait for the lock on the database, which is held
+// by any other trendhub process using it.
+const dbOpenTimeout = 2 * time.Second
+
+// BoltStore keeps everything in a bolt database. Scrapes are stored in
+// language/<lang>/<RFC3339 time>/<period>-<rank>, with the items in the compact
+// encoding and the repositories in repos/<id>. repo-ids/<owner>/<name> holds the
+// id of a repository, and seen/<lang>/<period>/<owner>/<name> when it was seen
+// in a feed. marks/<user>/<mark>/<owner>/<name> holds when a user marked a repo,
+// and notes/<owner>/<name>/<seq> the versions of its note as JSON. The search
+// index is search/<word>\x00<id>, for every word of a repository.
+type BoltStore struct {
+	// mu guards db, which is swapped out when the file is compacted.
+	mu   sync.RWMutex
+	db   *bolt.DB
+	path string
+}
+
+// OpenBoltStore opens, and creates if needed, the bolt database at path.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := openDB(path)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db, path: path}, nil
+}
+
+// openDB opens the bolt database and migrates it to the latest schema, so that
+// we don't have to check for the existance of buckets everywhere.
+func openDB(dbpath string) (*bolt.DB, error) {
+	db, err := openBolt(dbpath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrateBolt(db, false); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openBolt opens the bolt database as is.
+func openBolt(dbpath string) (*bolt.DB, error) {
+	db, err := bolt.Open(dbpath, 0600, &bolt.Options{Timeout: dbOpenTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("Couldn't lock %s, is trendhub already running?", dbpath)
+	}
+	return db, err
+}
+
+// Close closes the database
+func (s *BoltStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.Close()
+}
+
+// view runs fn in a read only transaction.
+func (s *BoltStore) view(fn func(tx *bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	defer observeSince(boltTxDuration.WithLabelValues("view"), time.Now())
+	return s.db.View(fn)
+}
+
+// update runs fn in a read-write transaction.
+func (s *BoltStore) update(fn func(tx *bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	defer observeSince(boltTxDuration.WithLabelValues("update"), time.Now())
+	return s.db.Update(fn)
+}
+
+// Follows() returns the languages we are following
+func (s *BoltStore) Follows() ([]Language, error) {
+	var following []Language
+
+	if err := s.view(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(FollowsBucket)
+
+		if err := bk.ForEach(func(k, v []byte) error {
+			following = append(following, StoreToLang[string(k)])
+			return nil
+		}); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return following, nil
+}
+
+func (s *BoltStore) Follow(lang Language) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(FollowsBucket)
+		return bk.Put([]byte(lang.StoreName), nil)
+	})
+}
+
+func (s *BoltStore) Unfollow(lang Language) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(FollowsBucket)
+		return bk.Delete([]byte(lang.StoreName))
+	})
+}
+
+func (s *BoltStore) SaveScrape(sc Scrape) error {
+	takenAt := sc.TakenAt.UTC().Format(time.RFC3339)
+
+	return s.update(func(tx *bolt.Tx) error {
+		lb := tx.Bucket(LanguageBucket)
+		llb, err := lb.CreateBucketIfNotExists([]byte(sc.Lang.StoreName))
+		if err != nil {
+			return err
+		}
+		hlb, err := llb.CreateBucketIfNotExists([]byte(takenAt))
+		if err != nil {
+			return err
+		}
+
+		// We put these into the buckets
+		for p, tis := range sc.Periods {
+			for i, ti := range tis {
+				if ti.RepoOwner == "" {
+					continue
+				}
+
+				id, err := putRepo(tx, ti, sc.TakenAt)
+				if err != nil {
+					return err
+				}
+				if err := hlb.Put([]byte(itemKey(p, i)), encodeItem(id, ti)); err != nil {
+					return err
+				}
+				if err := putSeen(tx, sc.Lang.StoreName, p, ti, sc.TakenAt); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) DeleteScrape(lang Language, ts time.Time) error {
+	return s.update(func(tx *bolt.Tx) error {
+		llb := tx.Bucket(LanguageBucket).Bucket([]byte(lang.StoreName))
+		if llb == nil {
+			return nil
+		}
+		err := llb.DeleteBucket([]byte(ts.UTC().Format(time.RFC3339)))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s *BoltStore) ScrapeHistory(lang Language) ([]time.Time, error) {
+	var times []time.Time
+	err := s.view(func(tx *bolt.Tx) error {
+		lb := tx.Bucket(LanguageBucket).Bucket([]byte(lang.StoreName))
+		if lb == nil {
+			return nil
+		}
+
+		err := lb.ForEach(func(k, v []byte) error {
+			ts, err := time.Parse(time.RFC3339, string(k))
+			if err != nil {
+				skipScrape(lang, string(k), err)
+				return nil
+			}
+			times = append(times, ts)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return times, nil
+}
+
+// Latest returns the latest scrape, with the time of the scrape
+func (s *BoltStore) Latest(lang Language, period string) ([]TrendingItem, time.Time, error) {
+	var tis []TrendingItem
+	var ts time.Time
+	var err error
+
+	err = s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(LanguageBucket).Bucket([]byte(lang.StoreName))
+		if b == nil {
+			return ErrNoScrapesForLang
+		}
+		c := b.Cursor()
+		rc := newRepoCache(tx)
+
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			kts, err := time.Parse(time.RFC3339, string(k))
+			if err != nil {
+				skipScrape(lang, string(k), err)
+				continue
+			}
+			ts = kts
+			tis, err = scrapeItems(rc, b.Bucket(k), period)
+			if err != nil {
+				return err
+			}
+
+			if len(tis) != 0 {
+				break
+			}
+		}
+		if ts.IsZero() {
+			return ErrNoScrapesForLang
+		}
+		if len(tis) == 0 {
+			return ErrNoScrapesForPeriod
+		}
+		return nil
+	})
+
+	return tis, ts, err
+}
+
+// GetScrape returns a specific scrape from history
+func (s *BoltStore) GetScrape(lang Language, period string, ts time.Time) ([]TrendingItem, error) {
+	var tis []TrendingItem
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(LanguageBucket).Bucket([]byte(lang.StoreName))
+		if b == nil {
+			return ErrNoScrapesForLang
+		}
+		hb := b.Bucket([]byte(ts.UTC().Format(time.RFC3339)))
+		if hb == nil {
+			return ErrNoScrapesForLang
+		}
+
+		var err error
+		tis, err = scrapeItems(newRepoCache(tx), hb, period)
+		if err != nil {
+			return err
+		}
+		if len(tis) == 0 {
+			return ErrNoScrapesForPeriod
+		}
+		return nil
+	})
+	return tis, err
+}
+
+// scrapeItems reads the items for a period out of a scrape bucket.
+func scrapeItems(rc *repoCache, b *bolt.Bucket, period string) ([]TrendingItem, error) {
+	var tis []TrendingItem
+
+	nc := b.Cursor()
+	prefix := []byte(period + "-")
+	for nk, nv := nc.Seek(prefix); nk != nil && bytes.HasPrefix(nk, prefix); nk, nv = nc.Next() {
+		ti, err := rc.item(nv)
+		if err != nil {
+			return nil, err
+		}
+		tis = append(tis, ti)
+	}
+	return tis, nil
+}
+
+// repoCache looks up repositories in the repo table for the items. Most scrapes
+// have the same repositories, so it remembers them.
+type repoCache struct {
+	b     *bolt.Bucket
+	repos map[uint64]RepoInfo
+}
+
+func newRepoCache(tx *bolt.Tx) *repoCache {
+	return &repoCache{
+		b:     tx.Bucket(ReposBucket),
+		repos: make(map[uint64]RepoInfo),
+	}
+}
+
+// item decodes a stored item and fills in the repository.
+func (rc *repoCache) item(v []byte) (TrendingItem, error) {
+	id, ti, err := decodeItem(v)
+	if err != nil {
+		return ti, err
+	}
+
+	ri, ok := rc.repos[id]
+	if !ok {
+		rv := rc.b.Get(repoIDKey(id))
+		if rv == nil {
+			return ti, ErrCorruptRecord
+		}
+		if ri, err = decodeRepo(rv); err != nil {
+			return ti, err
+		}
+		rc.repos[id] = ri
+	}
+
+	ti.RepoOwner = ri.Owner
+	ti.RepoName = ri.Name
+	ti.Description = ri.Description
+	ti.Language = ri.Language
+	return ti, nil
+}
+
+// putRepo returns the id of the repository in the item, adding it to the repo
+// table if needed. The stored description and language are updated, unless we
+// already know of a later sighting.
+func putRepo(tx *bolt.Tx, ti TrendingItem, seen time.Time) (uint64, error) {
+	ib := tx.Bucket(RepoIDsBucket)
+	rb := tx.Bucket(ReposBucket)
+	name := []byte(ti.RepoOwner + "/" + ti.RepoName)
+	ri := RepoInfo{
+		Owner:       ti.RepoOwner,
+		Name:        ti.RepoName,
+		Description: ti.Description,
+		Language:    ti.Language,
+		LastSeen:    seen.UTC(),
+	}
+
+	if k := ib.Get(name); k != nil {
+		old, err := decodeRepo(rb.Get(k))
+		if err != nil {
+			return 0, err
+		}
+		if old.LastSeen.After(seen) {
+			return binary.BigEndian.Uint64(k), nil
+		}
+		if err := indexRepo(tx, k, repoTerms(old), repoTerms(ri)); err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(k), rb.Put(k, encodeRepo(ri))
+	}
+
+	id, err := rb.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	k := repoIDKey(id)
+	if err := ib.Put(name, k); err != nil {
+		return 0, err
+	}
+	if err := indexRepo(tx, k, nil, repoTerms(ri)); err != nil {
+		return 0, err
+	}
+	return id, rb.Put(k, encodeRepo(ri))
+}
+
+func searchKey(term string, id []byte) []byte {
+	return append(append([]byte(term), 0), id...)
+}
+
+// indexRepo updates the search index for a repository whose words changed from
+// old to terms. Databases from before the search index get it in a migration,
+// so there is nothing to do while migrating to the versions before that.
+func indexRepo(tx *bolt.Tx, id []byte, old, terms []string) error {
+	sb := tx.Bucket(SearchBucket)
+	if sb == nil {
+		return nil
+	}
+
+	keep := make(map[string]bool, len(terms))
+	for _, t := range terms {
+		keep[t] = true
+	}
+	for _, t := range old {
+		if !keep[t] {
+			if err := sb.Delete(searchKey(t, id)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, t := range terms {
+		if err := sb.Put(searchKey(t, id), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putSeen records that the repository in the item was in the feed at ts.
+func putSeen(tx *bolt.Tx, lang, period string, ti TrendingItem, ts time.Time) error {
+	lb, err := tx.Bucket(SeenBucket).CreateBucketIfNotExists([]byte(lang))
+	if err != nil {
+		return err
+	}
+	pb, err := lb.CreateBucketIfNotExists([]byte(period))
+	if err != nil {
+		return err
+	}
+
+	name := []byte(ti.RepoOwner + "/" + ti.RepoName)
+	ts = ts.UTC()
+	fs := FeedSeen{FirstSeen: ts, LastSeen: ts}
+	if v := pb.Get(name); v != nil {
+		old, err := decodeSeen(v)
+		if err != nil {
+			return err
+		}
+		if !old.FirstSeen.After(ts) && !old.LastSeen.Before(ts) {
+			return nil
+		}
+		if old.FirstSeen.Before(fs.FirstSeen) {
+			fs.FirstSeen = old.FirstSeen
+		}
+		if old.LastSeen.After(fs.LastSeen) {
+			fs.LastSeen = old.LastSeen
+		}
+	}
+	return pb.Put(name, encodeSeen(fs))
+}
+
+// forEachScrapeBucket calls fn for every scrape bucket, with its language and
+// key.
+func forEachScrapeBucket(tx *bolt.Tx, fn func(lang, k []byte, hlb *bolt.Bucket) error) error {
+	lb := tx.Bucket(LanguageBucket)
+	return lb.ForEach(func(lang, v []byte) error {
+		llb := lb.Bucket(lang)
+		if llb == nil {
+			return nil
+		}
+		return llb.ForEach(func(k, v []byte) error {
+			hlb := llb.Bucket(k)
+			if hlb == nil {
+				return nil
+			}
+			return fn(lang, k, hlb)
+		})
+	})
+}
+
+func (s *BoltStore) ForEachRecord(f RecordFilter, fn func(ScrapeRecord) error) error {
+	return s.view(func(tx *bolt.Tx) error {
+		rc := newRepoCache(tx)
+		lb := tx.Bucket(LanguageBucket)
+		return lb.ForEach(func(lang, v []byte) error {
+			llb := lb.Bucket(lang)
+			if llb == nil || !f.matchLang(string(lang)) {
+				return nil
+			}
+			return llb.ForEach(func(k, v []byte) error {
+				ts, err := time.Parse(time.RFC3339, string(k))
+				if err != nil {
+					skipScrape(Language{StoreName: string(lang)}, string(k), err)
+					return nil
+				}
+				if !f.matchTime(ts) {
+					return nil
+				}
+				hlb := llb.Bucket(k)
+				if hlb == nil {
+					return nil
+				}
+				return hlb.ForEach(func(ik, iv []byte) error {
+					period, rank, err := splitItemKey(ik)
+					if err != nil {
+						return err
+					}
+					if f.Period != "" && f.Period != period {
+						return nil
+					}
+					ti, err := rc.item(iv)
+					if err != nil {
+						return err
+					}
+					return fn(newScrapeRecord(string(lang), period, ts, rank, ti))
+				})
+			})
+		})
+	})
+}
+
+func (s *BoltStore) Repo(owner, name string) (RepoInfo, error) {
+	var ri RepoInfo
+	err := s.view(func(tx *bolt.Tx) error {
+		k := tx.Bucket(RepoIDsBucket).Get([]byte(owner + "/" + name))
+		if k == nil {
+			return ErrUnknownRepo
+		}
+		var err error
+		ri, err = decodeRepo(tx.Bucket(ReposBucket).Get(k))
+		return err
+	})
+	return ri, err
+}
+
+func (s *BoltStore) Repos() ([]RepoInfo, error) {
+	var rs []RepoInfo
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(ReposBucket).ForEach(func(k, v []byte) error {
+			ri, err := decodeRepo(v)
+			if err != nil {
+				return err
+			}
+			rs = append(rs, ri)
+			return nil
+		})
+	})
+	sortRepos(rs)
+	return rs, err
+}
+
+func (s *BoltStore) Seen(lang Language, period string) (map[string]FeedSeen, error) {
+	seen := make(map[string]FeedSeen)
+	err := s.view(func(tx *bolt.Tx) error {
+		lb := tx.Bucket(SeenBucket).Bucket([]byte(lang.StoreName))
+		if lb == nil {
+			return nil
+		}
+		pb := lb.Bucket([]byte(period))
+		if pb == nil {
+			return nil
+		}
+		return pb.ForEach(func(k, v []byte) error {
+			fs, err := decodeSeen(v)
+			if err != nil {
+				return err
+			}
+			seen[string(k)] = fs
+			return nil
+		})
+	})
+	return seen, err
+}
+
+func (s *BoltStore) Marks(user string) (map[string]RepoMarks, error) {
+	marks := make(map[string]RepoMarks)
+	err := s.view(func(tx *bolt.Tx) error {
+		ub := tx.Bucket(MarksBucket).Bucket([]byte(user))
+		if ub == nil {
+			return nil
+		}
+		return readMarks(ub, marks)
+	})
+	return marks, err
+}
+
+func (s *BoltStore) AllMarks() (map[string]map[string]RepoMarks, error) {
+	all := make(map[string]map[string]RepoMarks)
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(MarksBucket)
+		return b.ForEach(func(user, v []byte) error {
+			ub := b.Bucket(user)
+			if ub == nil {
+				return nil
+			}
+			marks := make(map[string]RepoMarks)
+			if err := readMarks(ub, marks); err != nil {
+				return err
+			}
+			if len(marks) != 0 {
+				all[string(user)] = marks
+			}
+			return nil
+		})
+	})
+	return all, err
+}
+
+// readMarks adds the marks in the bucket of a user to marks.
+func readMarks(ub *bolt.Bucket, marks map[string]RepoMarks) error {
+	return ub.ForEach(func(m, v []byte) error {
+		mb := ub.Bucket(m)
+		if mb == nil {
+			return nil
+		}
+		return mb.ForEach(func(k, v []byte) error {
+			ts, n := binary.Varint(v)
+			if n <= 0 {
+				return ErrCorruptRecord
+			}
+			rm, ok := marks[string(k)]
+			if !ok {
+				rm = make(RepoMarks)
+				marks[string(k)] = rm
+			}
+			rm[Mark(m)] = time.Unix(ts, 0).UTC()
+			return nil
+		})
+	})
+}
+
+func (s *BoltStore) SetMark(user string, m Mark, owner, name string, on bool) error {
+	return s.update(func(tx *bolt.Tx) error {
+		ub, err := tx.Bucket(MarksBucket).CreateBucketIfNotExists([]byte(user))
+		if err != nil {
+			return err
+		}
+		mb, err := ub.CreateBucketIfNotExists([]byte(m))
+		if err != nil {
+			return err
+		}
+		k := []byte(owner + "/" + name)
+		if !on {
+			return mb.Delete(k)
+		}
+		return mb.Put(k, binary.AppendVarint(nil, time.Now().Unix()))
+	})
+}
+
+func (s *BoltStore) SaveMarks(user string, marks map[string]RepoMarks) error {
+	return s.update(func(tx *bolt.Tx) error {
+		ub, err := tx.Bucket(MarksBucket).CreateBucketIfNotExists([]byte(user))
+		if err != nil {
+			return err
+		}
+		for k, rm := range marks {
+			for m, ts := range rm {
+				mb, err := ub.CreateBucketIfNotExists([]byte(m))
+				if err != nil {
+					return err
+				}
+				if err := mb.Put([]byte(k), binary.AppendVarint(nil, ts.Unix())); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) SaveNote(n Note) error {
+	j, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		nb, err := tx.Bucket(NotesBucket).CreateBucketIfNotExists([]byte(n.Owner + "/" + n.Name))
+		if err != nil {
+			return err
+		}
+		seq, err := nb.NextSequence()
+		if err != nil {
+			return err
+		}
+		return nb.Put(repoIDKey(seq), j)
+	})
+}
+
+func (s *BoltStore) NoteHistory(owner, name string) ([]Note, error) {
+	var ns []Note
+	err := s.view(func(tx *bolt.Tx) error {
+		nb := tx.Bucket(NotesBucket).Bucket([]byte(owner + "/" + name))
+		if nb == nil {
+			return nil
+		}
+		return nb.ForEach(func(k, v []byte) error {
+			var n Note
+			if err := json.Unmarshal(v, &n); err != nil {
+				return err
+			}
+			ns = append(ns, n)
+			return nil
+		})
+	})
+	return ns, err
+}
+
+func (s *BoltStore) Notes() ([]Note, error) {
+	var ns []Note
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(NotesBucket)
+		return b.ForEach(func(k, v []byte) error {
+			nb := b.Bucket(k)
+			if nb == nil {
+				return nil
+			}
+			_, lv := nb.Cursor().Last()
+			if lv == nil {
+				return nil
+			}
+			var n Note
+			if err := json.Unmarshal(lv, &n); err != nil {
+				return err
+			}
+			if !n.Empty() {
+				ns = append(ns, n)
+			}
+			return nil
+		})
+	})
+	sortNotes(ns)
+	return ns, err
+}
+
+func (s *BoltStore) ForEachNote(fn func(Note) error) error {
+	return s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(NotesBucket)
+		return b.ForEach(func(k, v []byte) error {
+			nb := b.Bucket(k)
+			if nb == nil {
+				return nil
+			}
+			return nb.ForEach(func(k, v []byte) error {
+				var n Note
+				if err := json.Unmarshal(v, &n); err != nil {
+					return err
+				}
+				return fn(n)
+			})
+		})
+	})
+}
+
+func (s *BoltStore) Users() ([]User, error) {
+	var us []User
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(UsersBucket).ForEach(func(k, v []byte) error {
+			var u User
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			us = append(us, u)
+			return nil
+		})
+	})
+	return us, err
+}
+
+func (s *BoltStore) User(name string) (User, error) {
+	var u User
+	err := s.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(UsersBucket).Get([]byte(name))
+		if v == nil {
+			return ErrUnknownUser
+		}
+		return json.Unmarshal(v, &u)
+	})
+	return u, err
+}
+
+func (s *BoltStore) SaveUser(u User) error {
+	j, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(UsersBucket).Put([]byte(u.Name), j)
+	})
+}
+
+func (s *BoltStore) DeleteUser(name string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(UsersBucket)
+		if b.Get([]byte(name)) == nil {
+			return ErrUnknownUser
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+func (s *BoltStore) SearchRepos(terms []string) ([]RepoInfo, error) {
+	var rs []RepoInfo
+	err := s.view(func(tx *bolt.Tx) error {
+		var ids map[string]bool
+		c := tx.Bucket(SearchBucket).Cursor()
+		for _, t := range terms {
+			found := make(map[string]bool)
+			prefix := []byte(t)
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				id := string(k[len(k)-8:])
+				if ids == nil || ids[id] {
+					found[id] = true
+				}
+			}
+			ids = found
+			if len(ids) == 0 {
+				return nil
+			}
+		}
+
+		rb := tx.Bucket(ReposBucket)
+		for id := range ids {
+			ri, err := decodeRepo(rb.Get([]byte(id)))
+			if err != nil {
+				return err
+			}
+			rs = append(rs, ri)
+		}
+		return nil
+	})
+	sortRepos(rs)
+	return rs, err
+}
+
+// DBStats describes how much space the bolt store takes.
+type DBStats struct {
+	FileSize int64
+	Scrapes  int
+	Items    int
+	Repos    int
+	// ItemBytes and RepoBytes are the size of the stored items and repos, and
+	// JSONBytes what the items would take stored as JSON, like we used to.
+	ItemBytes int64
+	RepoBytes int64
+	JSONBytes int64
+}
+
+// Size returns how many bytes the database takes.
+func (s *BoltStore) Size() (int64, error) {
+	var n int64
+	err := s.view(func(tx *bolt.Tx) error {
+		n = tx.Size()
+		return nil
+	})
+	return n, err
+}
+
+// Stats walks the database and sums up how much space it takes.
+func (s *BoltStore) Stats() (DBStats, error) {
+	var st DBStats
+	err := s.view(func(tx *bolt.Tx) error {
+		st.FileSize = tx.Size()
+
+		if err := tx.Bucket(ReposBucket).ForEach(func(k, v []byte) error {
+			st.Repos++
+			st.RepoBytes += int64(len(k) + len(v))
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := tx.Bucket(RepoIDsBucket).ForEach(func(k, v []byte) error {
+			st.RepoBytes += int64(len(k) + len(v))
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		rc := newRepoCache(tx)
+		return forEachScrapeBucket(tx, func(lang, k []byte, hlb *bolt.Bucket) error {
+			st.Scrapes++
+			return hlb.ForEach(func(ik, iv []byte) error {
+				st.Items++
+				st.ItemBytes += int64(len(iv))
+
+				ti, err := rc.item(iv)
+				if err != nil {
+					return err
+				}
+				j, err := json.Marshal(ti)
+				if err != nil {
+					return err
+				}
+				st.JSONBytes += int64(len(j))
+				return nil
+			})
+		})
+	})
+	return st, err
+}
+
+// Compact rewrites the database into a new file and swaps it in, giving the
+// space freed by pruning back to the filesystem. It returns the size of the file
+// before and after.
+func (s *BoltStore) Compact() (int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before, err := fileSize(s.path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tmpPath := s.path + ".compact"
+	os.Remove(tmpPath)
+
+	dst, err := bolt.Open(tmpPath, 0600, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = s.db.View(func(stx *bolt.Tx) error {
+		return dst.Update(func(dtx *bolt.Tx) error {
+			return stx.ForEach(func(name []byte, sb *bolt.Bucket) error {
+				db, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(db, sb)
+			})
+		})
+	})
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, 0, err
+	}
+
+	if err := s.db.Close(); err != nil {
+		os.Remove(tmpPath)
+		return 0, 0, err
+	}
+	if err = os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+	}
+	// Even if the rename failed we have to reopen, as the store has no database
+	// otherwise.
+	db, oerr := openDB(s.path)
+	if oerr != nil {
+		return 0, 0, oerr
+	}
+	s.db = db
+	if err != nil {
+		return 0, 0, err
+	}
+
+	after, err := fileSize(s.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return before, after, nil
+}
+
+// copyBucket copies all keys, nested buckets and sequences from src into dst.
+func copyBucket(dst, src *bolt.Bucket) error {
+	// Scrapes are only ever appended, so we pack the pages full.
+	dst.FillPercent = 1.0
+	// Repo ids and note versions come from the sequences, so starting them
+	// over would overwrite what is there.
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if sb := src.Bucket(k); v == nil && sb != nil {
+			db, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copyBucket(db, sb)
+		}
+		return dst.Put(k, v)
+	})
+}
+
+func fileSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Backup writes a consistent snapshot of the database to w. It runs in a read
+// transaction, so refreshes and the website keep going while it runs.
+func (s *BoltStore) Backup(w io.Writer, compress bool) (int64, error) {
+	var n int64
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		if !compress {
+			n, err = tx.WriteTo(w)
+			return err
+		}
+
+		zw := gzip.NewWriter(w)
+		if n, err = tx.WriteTo(zw); err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+	return n, err
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestBolt(t *testing.T) *BoltStore {
+	t.Helper()
+	s, err := OpenBoltStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestCompactKeepsRepoIDs(t *testing.T) {
+	s := openTestBolt(t)
+	goLang := StoreToLang["go"]
+	t1 := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	saveTestScrape(t, s, goLang, t1, "a", "repo")
+	if _, _, err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	saveTestScrape(t, s, goLang, t2, "b", "repo")
+
+	for _, c := range []struct {
+		ts    time.Time
+		owner string
+	}{{t1, "a"}, {t2, "b"}} {
+		tis, err := s.GetScrape(goLang, PeriodDaily, c.ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tis) != 1 || tis[0].RepoOwner != c.owner {
+			t.Errorf("scrape at %s: got %+v, want the repo of %s", c.ts, tis, c.owner)
+		}
+	}
+}
+
+func TestCompactKeepsNoteHistory(t *testing.T) {
+	s := openTestBolt(t)
+	t1 := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	if err := s.SaveNote(Note{Owner: "o", Name: "r", Text: "first", Author: "alice", EditedAt: t1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveNote(Note{Owner: "o", Name: "r", Text: "second", Author: "bob", EditedAt: t1.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	ns, err := s.NoteHistory("o", "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ns) != 2 || ns[0].Text != "first" || ns[1].Text != "second" {
+		t.Errorf("got history %+v, want first and second", ns)
+	}
+}
+
+func TestBadScrapeKeysSkipped(t *testing.T) {
+	s := openTestBolt(t)
+	goLang := StoreToLang["go"]
+	t1 := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	saveTestScrape(t, s, goLang, t1, "o", "r")
+
+	// A scrape under a key that isn't a time, sorting after the good one.
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket(LanguageBucket).Bucket([]byte(goLang.StoreName)).CreateBucket([]byte("zzz"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tis, ts, err := s.Latest(goLang, PeriodDaily)
+	if err != nil {
+		t.Fatalf("Latest: %v", err)
+	}
+	if !ts.Equal(t1) || len(tis) != 1 {
+		t.Errorf("Latest: got %d items at %s, want 1 at %s", len(tis), ts, t1)
+	}
+
+	var n int
+	err = s.ForEachRecord(RecordFilter{}, func(ScrapeRecord) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEachRecord: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("ForEachRecord: got %d records, want 1", n)
+	}
+
+	times, err := s.ScrapeHistory(goLang)
+	if err != nil {
+		t.Fatalf("ScrapeHistory: %v", err)
+	}
+	if len(times) != 1 || !times[0].Equal(t1) {
+		t.Errorf("ScrapeHistory: got %v, want [%s]", times, t1)
+	}
+}
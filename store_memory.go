@@ -0,0 +1,460 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in memory, laid out like the bolt store. It is
+// meant for tests and trying things out.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	follows map[string]struct{}
+	// scrapes maps from language to RFC3339 time to item key.
+	scrapes map[string]map[string]map[string]TrendingItem
+	repos   map[string]RepoInfo
+	// seen maps from language/period to owner/name.
+	seen map[string]map[string]FeedSeen
+	// marks maps from user to owner/name.
+	marks map[string]map[string]RepoMarks
+	// notes maps from owner/name to the versions of its note.
+	notes map[string][]Note
+	users map[string]User
+}
+
+// NewMemoryStore returns an empty store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		follows: make(map[string]struct{}),
+		scrapes: make(map[string]map[string]map[string]TrendingItem),
+		repos:   make(map[string]RepoInfo),
+		seen:    make(map[string]map[string]FeedSeen),
+		marks:   make(map[string]map[string]RepoMarks),
+		notes:   make(map[string][]Note),
+		users:   make(map[string]User),
+	}
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) Follows() ([]Language, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var following []Language
+	for _, k := range sortedKeys(s.follows) {
+		following = append(following, StoreToLang[k])
+	}
+	return following, nil
+}
+
+func (s *MemoryStore) Follow(lang Language) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.follows[lang.StoreName] = struct{}{}
+	return nil
+}
+
+func (s *MemoryStore) Unfollow(lang Language) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.follows, lang.StoreName)
+	return nil
+}
+
+func (s *MemoryStore) SaveScrape(sc Scrape) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ls, ok := s.scrapes[sc.Lang.StoreName]
+	if !ok {
+		ls = make(map[string]map[string]TrendingItem)
+		s.scrapes[sc.Lang.StoreName] = ls
+	}
+	takenAt := sc.TakenAt.UTC().Format(time.RFC3339)
+	items, ok := ls[takenAt]
+	if !ok {
+		items = make(map[string]TrendingItem)
+		ls[takenAt] = items
+	}
+
+	for p, tis := range sc.Periods {
+		for i, ti := range tis {
+			if ti.RepoOwner == "" {
+				continue
+			}
+			items[itemKey(p, i)] = ti
+			s.putSeen(sc.Lang.StoreName+"/"+p, ti, sc.TakenAt.UTC())
+
+			k := ti.RepoOwner + "/" + ti.RepoName
+			if old, ok := s.repos[k]; ok && old.LastSeen.After(sc.TakenAt) {
+				continue
+			}
+			s.repos[k] = RepoInfo{
+				Owner:       ti.RepoOwner,
+				Name:        ti.RepoName,
+				Description: ti.Description,
+				Language:    ti.Language,
+				LastSeen:    sc.TakenAt.UTC(),
+			}
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteScrape(lang Language, ts time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.scrapes[lang.StoreName], ts.UTC().Format(time.RFC3339))
+	return nil
+}
+
+func (s *MemoryStore) ScrapeHistory(lang Language) ([]time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var times []time.Time
+	for _, k := range sortedKeys(s.scrapes[lang.StoreName]) {
+		ts, err := time.Parse(time.RFC3339, k)
+		if err != nil {
+			skipScrape(lang, k, err)
+			continue
+		}
+		times = append(times, ts)
+	}
+	return times, nil
+}
+
+func (s *MemoryStore) Latest(lang Language, period string) ([]TrendingItem, time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ls := s.scrapes[lang.StoreName]
+	keys := sortedKeys(ls)
+	if len(keys) == 0 {
+		return nil, time.Time{}, ErrNoScrapesForLang
+	}
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		tis := memoryItems(ls[keys[i]], period)
+		if len(tis) == 0 {
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339, keys[i])
+		return tis, ts, err
+	}
+	return nil, time.Time{}, ErrNoScrapesForPeriod
+}
+
+func (s *MemoryStore) GetScrape(lang Language, period string, ts time.Time) ([]TrendingItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	items, ok := s.scrapes[lang.StoreName][ts.UTC().Format(time.RFC3339)]
+	if !ok {
+		return nil, ErrNoScrapesForLang
+	}
+	tis := memoryItems(items, period)
+	if len(tis) == 0 {
+		return nil, ErrNoScrapesForPeriod
+	}
+	return tis, nil
+}
+
+// memoryItems returns the items for a period in rank order.
+func memoryItems(items map[string]TrendingItem, period string) []TrendingItem {
+	var tis []TrendingItem
+	for _, k := range sortedKeys(items) {
+		if strings.HasPrefix(k, period+"-") {
+			tis = append(tis, items[k])
+		}
+	}
+	return tis
+}
+
+func (s *MemoryStore) ForEachRecord(f RecordFilter, fn func(ScrapeRecord) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, lang := range sortedKeys(s.scrapes) {
+		if !f.matchLang(lang) {
+			continue
+		}
+		ls := s.scrapes[lang]
+		for _, k := range sortedKeys(ls) {
+			ts, err := time.Parse(time.RFC3339, k)
+			if err != nil {
+				return err
+			}
+			if !f.matchTime(ts) {
+				continue
+			}
+			items := ls[k]
+			for _, ik := range sortedKeys(items) {
+				period, rank, err := splitItemKey([]byte(ik))
+				if err != nil {
+					return err
+				}
+				if f.Period != "" && f.Period != period {
+					continue
+				}
+				if err := fn(newScrapeRecord(lang, period, ts, rank, items[ik])); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Repo(owner, name string) (RepoInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ri, ok := s.repos[owner+"/"+name]
+	if !ok {
+		return ri, ErrUnknownRepo
+	}
+	return ri, nil
+}
+
+func (s *MemoryStore) Repos() ([]RepoInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rs := make([]RepoInfo, 0, len(s.repos))
+	for _, ri := range s.repos {
+		rs = append(rs, ri)
+	}
+	sortRepos(rs)
+	return rs, nil
+}
+
+func (s *MemoryStore) putSeen(feed string, ti TrendingItem, ts time.Time) {
+	fss, ok := s.seen[feed]
+	if !ok {
+		fss = make(map[string]FeedSeen)
+		s.seen[feed] = fss
+	}
+	k := ti.RepoOwner + "/" + ti.RepoName
+	fs, ok := fss[k]
+	if !ok || ts.Before(fs.FirstSeen) {
+		fs.FirstSeen = ts
+	}
+	if ts.After(fs.LastSeen) {
+		fs.LastSeen = ts
+	}
+	fss[k] = fs
+}
+
+func (s *MemoryStore) Seen(lang Language, period string) (map[string]FeedSeen, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := make(map[string]FeedSeen, len(s.seen[lang.StoreName+"/"+period]))
+	for k, fs := range s.seen[lang.StoreName+"/"+period] {
+		seen[k] = fs
+	}
+	return seen, nil
+}
+
+func (s *MemoryStore) Marks(user string) (map[string]RepoMarks, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return copyMarks(s.marks[user]), nil
+}
+
+func (s *MemoryStore) AllMarks() (map[string]map[string]RepoMarks, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	all := make(map[string]map[string]RepoMarks, len(s.marks))
+	for user, um := range s.marks {
+		if len(um) != 0 {
+			all[user] = copyMarks(um)
+		}
+	}
+	return all, nil
+}
+
+// copyMarks makes a deep copy of the marks of a user.
+func copyMarks(um map[string]RepoMarks) map[string]RepoMarks {
+	marks := make(map[string]RepoMarks, len(um))
+	for k, rm := range um {
+		c := make(RepoMarks, len(rm))
+		for m, ts := range rm {
+			c[m] = ts
+		}
+		marks[k] = c
+	}
+	return marks
+}
+
+func (s *MemoryStore) SetMark(user string, m Mark, owner, name string, on bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	um, ok := s.marks[user]
+	if !ok {
+		um = make(map[string]RepoMarks)
+		s.marks[user] = um
+	}
+	k := owner + "/" + name
+	if !on {
+		delete(um[k], m)
+		if len(um[k]) == 0 {
+			delete(um, k)
+		}
+		return nil
+	}
+	if um[k] == nil {
+		um[k] = make(RepoMarks)
+	}
+	um[k][m] = time.Now().UTC().Truncate(time.Second)
+	return nil
+}
+
+func (s *MemoryStore) SaveMarks(user string, marks map[string]RepoMarks) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	um, ok := s.marks[user]
+	if !ok {
+		um = make(map[string]RepoMarks)
+		s.marks[user] = um
+	}
+	for k, rm := range marks {
+		if um[k] == nil {
+			um[k] = make(RepoMarks)
+		}
+		for m, ts := range rm {
+			um[k][m] = ts.UTC().Truncate(time.Second)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) SaveNote(n Note) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n.Tags = append([]string(nil), n.Tags...)
+	s.notes[n.Owner+"/"+n.Name] = append(s.notes[n.Owner+"/"+n.Name], n)
+	return nil
+}
+
+func (s *MemoryStore) NoteHistory(owner, name string) ([]Note, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Note(nil), s.notes[owner+"/"+name]...), nil
+}
+
+func (s *MemoryStore) Notes() ([]Note, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ns []Note
+	for _, h := range s.notes {
+		if n := h[len(h)-1]; !n.Empty() {
+			ns = append(ns, n)
+		}
+	}
+	sortNotes(ns)
+	return ns, nil
+}
+
+func (s *MemoryStore) ForEachNote(fn func(Note) error) error {
+	s.mu.RLock()
+	var ns []Note
+	for _, k := range sortedKeys(s.notes) {
+		ns = append(ns, s.notes[k]...)
+	}
+	s.mu.RUnlock()
+
+	for _, n := range ns {
+		if err := fn(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) SearchRepos(terms []string) ([]RepoInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var rs []RepoInfo
+	for _, ri := range s.repos {
+		if matchTerms(repoTerms(ri), terms) {
+			rs = append(rs, ri)
+		}
+	}
+	sortRepos(rs)
+	return rs, nil
+}
+
+// Users returns the users sorted by name, as the map keeps no order.
+func (s *MemoryStore) Users() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var us []User
+	for _, k := range sortedKeys(s.users) {
+		us = append(us, s.users[k])
+	}
+	return us, nil
+}
+
+func (s *MemoryStore) User(name string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[name]
+	if !ok {
+		return u, ErrUnknownUser
+	}
+	return u, nil
+}
+
+func (s *MemoryStore) SaveUser(u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[u.Name] = u
+	return nil
+}
+
+func (s *MemoryStore) DeleteUser(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[name]; !ok {
+		return ErrUnknownUser
+	}
+	delete(s.users, name)
+	return nil
+}
+
+// sortedKeys returns the keys of a map with string keys, sorted.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
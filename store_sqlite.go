@@ -0,0 +1,606 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema is the first migration, and is made to be easy to query by hand. Times are stored as RFC3339
+// text in UTC, so they sort and compare as expected.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS follows (
+	language TEXT PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS scrapes (
+	language   TEXT NOT NULL,
+	scraped_at TEXT NOT NULL,
+	PRIMARY KEY (language, scraped_at)
+);
+
+CREATE TABLE IF NOT EXISTS items (
+	language       TEXT NOT NULL,
+	scraped_at     TEXT NOT NULL,
+	period         TEXT NOT NULL,
+	rank           INTEGER NOT NULL,
+	repo_owner     TEXT NOT NULL,
+	repo_name      TEXT NOT NULL,
+	description    TEXT NOT NULL,
+	repo_language  TEXT NOT NULL,
+	forks          INTEGER NOT NULL,
+	stars          INTEGER NOT NULL,
+	stars_increase INTEGER NOT NULL,
+	PRIMARY KEY (language, scraped_at, period, rank),
+	FOREIGN KEY (language, scraped_at) REFERENCES scrapes (language, scraped_at) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS items_repo ON items (repo_owner, repo_name);
+
+CREATE TABLE IF NOT EXISTS repos (
+	owner       TEXT NOT NULL,
+	name        TEXT NOT NULL,
+	description TEXT NOT NULL,
+	language    TEXT NOT NULL,
+	last_seen   TEXT NOT NULL,
+	PRIMARY KEY (owner, name)
+);
+`
+
+// SQLiteStore keeps everything in a SQLite database, so that the history can be
+// queried with plain SQL. Rank is stored starting at 1, like in exports.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLiteStore opens, and creates if needed, the SQLite database at path.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrateSQLite(db, false); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// openSQLite opens the SQLite database as is.
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) Follows() ([]Language, error) {
+	rows, err := s.db.Query(`SELECT language FROM follows ORDER BY language`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var following []Language
+	for rows.Next() {
+		var l string
+		if err := rows.Scan(&l); err != nil {
+			return nil, err
+		}
+		following = append(following, StoreToLang[l])
+	}
+	return following, rows.Err()
+}
+
+func (s *SQLiteStore) Follow(lang Language) error {
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO follows (language) VALUES (?)`, lang.StoreName)
+	return err
+}
+
+func (s *SQLiteStore) Unfollow(lang Language) error {
+	_, err := s.db.Exec(`DELETE FROM follows WHERE language = ?`, lang.StoreName)
+	return err
+}
+
+func (s *SQLiteStore) SaveScrape(sc Scrape) error {
+	takenAt := sc.TakenAt.UTC().Format(time.RFC3339)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO scrapes (language, scraped_at) VALUES (?, ?)`,
+		sc.Lang.StoreName, takenAt); err != nil {
+		return err
+	}
+
+	itemStmt, err := tx.Prepare(`INSERT OR REPLACE INTO items
+		(language, scraped_at, period, rank, repo_owner, repo_name, description, repo_language, forks, stars, stars_increase)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer itemStmt.Close()
+
+	repoStmt, err := tx.Prepare(`INSERT INTO repos (owner, name, description, language, last_seen)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (owner, name) DO UPDATE SET
+			description = excluded.description,
+			language = excluded.language,
+			last_seen = excluded.last_seen
+		WHERE excluded.last_seen >= repos.last_seen`)
+	if err != nil {
+		return err
+	}
+	defer repoStmt.Close()
+
+	seenStmt, err := tx.Prepare(`INSERT INTO seen (language, period, repo_owner, repo_name, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (language, period, repo_owner, repo_name) DO UPDATE SET
+			first_seen = MIN(first_seen, excluded.first_seen),
+			last_seen = MAX(last_seen, excluded.last_seen)`)
+	if err != nil {
+		return err
+	}
+	defer seenStmt.Close()
+
+	for p, tis := range sc.Periods {
+		for i, ti := range tis {
+			if ti.RepoOwner == "" {
+				continue
+			}
+			if _, err := itemStmt.Exec(sc.Lang.StoreName, takenAt, p, i+1,
+				ti.RepoOwner, ti.RepoName, ti.Description, ti.Language,
+				ti.Forks, ti.Stars, ti.StarsIncrease); err != nil {
+				return err
+			}
+			if _, err := repoStmt.Exec(ti.RepoOwner, ti.RepoName, ti.Description, ti.Language, takenAt); err != nil {
+				return err
+			}
+			if _, err := seenStmt.Exec(sc.Lang.StoreName, p, ti.RepoOwner, ti.RepoName, takenAt, takenAt); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) DeleteScrape(lang Language, ts time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM scrapes WHERE language = ? AND scraped_at = ?`,
+		lang.StoreName, ts.UTC().Format(time.RFC3339))
+	return err
+}
+
+func (s *SQLiteStore) ScrapeHistory(lang Language) ([]time.Time, error) {
+	rows, err := s.db.Query(`SELECT scraped_at FROM scrapes WHERE language = ? ORDER BY scraped_at`, lang.StoreName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var times []time.Time
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		ts, err := time.Parse(time.RFC3339, k)
+		if err != nil {
+			skipScrape(lang, k, err)
+			continue
+		}
+		times = append(times, ts)
+	}
+	return times, rows.Err()
+}
+
+func (s *SQLiteStore) Latest(lang Language, period string) ([]TrendingItem, time.Time, error) {
+	var k sql.NullString
+	err := s.db.QueryRow(`SELECT MAX(scraped_at) FROM items WHERE language = ? AND period = ?`,
+		lang.StoreName, period).Scan(&k)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !k.Valid {
+		var n int
+		if err := s.db.QueryRow(`SELECT COUNT(*) FROM scrapes WHERE language = ?`, lang.StoreName).Scan(&n); err != nil {
+			return nil, time.Time{}, err
+		}
+		if n == 0 {
+			return nil, time.Time{}, ErrNoScrapesForLang
+		}
+		return nil, time.Time{}, ErrNoScrapesForPeriod
+	}
+
+	ts, err := time.Parse(time.RFC3339, k.String)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	tis, err := s.GetScrape(lang, period, ts)
+	return tis, ts, err
+}
+
+func (s *SQLiteStore) GetScrape(lang Language, period string, ts time.Time) ([]TrendingItem, error) {
+	var tis []TrendingItem
+	err := s.forEachItem(`WHERE language = ? AND scraped_at = ? AND period = ?`,
+		[]interface{}{lang.StoreName, ts.UTC().Format(time.RFC3339), period},
+		func(r ScrapeRecord) error {
+			tis = append(tis, r.TrendingItem())
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	if len(tis) == 0 {
+		var n int
+		if err := s.db.QueryRow(`SELECT COUNT(*) FROM scrapes WHERE language = ? AND scraped_at = ?`,
+			lang.StoreName, ts.UTC().Format(time.RFC3339)).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, ErrNoScrapesForLang
+		}
+		return nil, ErrNoScrapesForPeriod
+	}
+	return tis, nil
+}
+
+func (s *SQLiteStore) ForEachRecord(f RecordFilter, fn func(ScrapeRecord) error) error {
+	where := `WHERE 1 = 1`
+	var args []interface{}
+	if len(f.Langs) != 0 {
+		where += ` AND language IN (?` + strings.Repeat(`, ?`, len(f.Langs)-1) + `)`
+		for _, l := range f.Langs {
+			args = append(args, l.StoreName)
+		}
+	}
+	if f.Period != "" {
+		where += ` AND period = ?`
+		args = append(args, f.Period)
+	}
+	if !f.Since.IsZero() {
+		where += ` AND scraped_at >= ?`
+		args = append(args, f.Since.UTC().Format(time.RFC3339))
+	}
+	if !f.Until.IsZero() {
+		where += ` AND scraped_at <= ?`
+		args = append(args, f.Until.UTC().Format(time.RFC3339))
+	}
+	return s.forEachItem(where, args, fn)
+}
+
+// forEachItem calls fn for the items matching the where clause, in the same
+// order as the other stores.
+func (s *SQLiteStore) forEachItem(where string, args []interface{}, fn func(ScrapeRecord) error) error {
+	rows, err := s.db.Query(`SELECT language, period, scraped_at, rank, repo_owner, repo_name,
+		description, repo_language, forks, stars, stars_increase
+		FROM items `+where+` ORDER BY language, scraped_at, period, rank`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r ScrapeRecord
+		var k string
+		if err := rows.Scan(&r.Language, &r.Period, &k, &r.Rank, &r.RepoOwner, &r.RepoName,
+			&r.Description, &r.RepoLanguage, &r.Forks, &r.Stars, &r.StarsIncrease); err != nil {
+			return err
+		}
+		if r.ScrapedAt, err = time.Parse(time.RFC3339, k); err != nil {
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteStore) Repo(owner, name string) (RepoInfo, error) {
+	rs, err := s.queryRepos(`WHERE owner = ? AND name = ?`, owner, name)
+	if err != nil {
+		return RepoInfo{}, err
+	}
+	if len(rs) == 0 {
+		return RepoInfo{}, ErrUnknownRepo
+	}
+	return rs[0], nil
+}
+
+func (s *SQLiteStore) Repos() ([]RepoInfo, error) {
+	return s.queryRepos(``)
+}
+
+func (s *SQLiteStore) queryRepos(where string, args ...interface{}) ([]RepoInfo, error) {
+	rows, err := s.db.Query(`SELECT owner, name, description, language, last_seen
+		FROM repos `+where+` ORDER BY owner, name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rs []RepoInfo
+	for rows.Next() {
+		var ri RepoInfo
+		var k string
+		if err := rows.Scan(&ri.Owner, &ri.Name, &ri.Description, &ri.Language, &k); err != nil {
+			return nil, err
+		}
+		if ri.LastSeen, err = time.Parse(time.RFC3339, k); err != nil {
+			return nil, err
+		}
+		rs = append(rs, ri)
+	}
+	return rs, rows.Err()
+}
+
+func (s *SQLiteStore) Seen(lang Language, period string) (map[string]FeedSeen, error) {
+	rows, err := s.db.Query(`SELECT repo_owner, repo_name, first_seen, last_seen
+		FROM seen WHERE language = ? AND period = ?`, lang.StoreName, period)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]FeedSeen)
+	for rows.Next() {
+		var owner, name, first, last string
+		if err := rows.Scan(&owner, &name, &first, &last); err != nil {
+			return nil, err
+		}
+		var fs FeedSeen
+		if fs.FirstSeen, err = time.Parse(time.RFC3339, first); err != nil {
+			return nil, err
+		}
+		if fs.LastSeen, err = time.Parse(time.RFC3339, last); err != nil {
+			return nil, err
+		}
+		seen[owner+"/"+name] = fs
+	}
+	return seen, rows.Err()
+}
+
+func (s *SQLiteStore) Marks(user string) (map[string]RepoMarks, error) {
+	all, err := s.queryMarks(`WHERE user = ?`, user)
+	if err != nil {
+		return nil, err
+	}
+	if marks, ok := all[user]; ok {
+		return marks, nil
+	}
+	return make(map[string]RepoMarks), nil
+}
+
+func (s *SQLiteStore) AllMarks() (map[string]map[string]RepoMarks, error) {
+	return s.queryMarks(``)
+}
+
+// queryMarks returns the marks matching where, keyed by user and owner/name.
+func (s *SQLiteStore) queryMarks(where string, args ...interface{}) (map[string]map[string]RepoMarks, error) {
+	rows, err := s.db.Query(`SELECT user, mark, repo_owner, repo_name, marked_at FROM marks `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := make(map[string]map[string]RepoMarks)
+	for rows.Next() {
+		var user, m, owner, name, k string
+		if err := rows.Scan(&user, &m, &owner, &name, &k); err != nil {
+			return nil, err
+		}
+		ts, err := time.Parse(time.RFC3339, k)
+		if err != nil {
+			return nil, err
+		}
+		marks, ok := all[user]
+		if !ok {
+			marks = make(map[string]RepoMarks)
+			all[user] = marks
+		}
+		rm, ok := marks[owner+"/"+name]
+		if !ok {
+			rm = make(RepoMarks)
+			marks[owner+"/"+name] = rm
+		}
+		rm[Mark(m)] = ts
+	}
+	return all, rows.Err()
+}
+
+func (s *SQLiteStore) SetMark(user string, m Mark, owner, name string, on bool) error {
+	if !on {
+		_, err := s.db.Exec(`DELETE FROM marks WHERE user = ? AND mark = ? AND repo_owner = ? AND repo_name = ?`,
+			user, string(m), owner, name)
+		return err
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO marks (user, mark, repo_owner, repo_name, marked_at)
+		VALUES (?, ?, ?, ?, ?)`, user, string(m), owner, name, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func (s *SQLiteStore) SaveMarks(user string, marks map[string]RepoMarks) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO marks (user, mark, repo_owner, repo_name, marked_at)
+		VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for k, rm := range marks {
+		owner, name, ok := strings.Cut(k, "/")
+		if !ok {
+			return fmt.Errorf("Not a repo: %s", k)
+		}
+		for m, ts := range rm {
+			if _, err := stmt.Exec(user, string(m), owner, name, ts.UTC().Format(time.RFC3339)); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// SaveNote stores the tags comma separated, which they can't contain.
+func (s *SQLiteStore) SaveNote(n Note) error {
+	_, err := s.db.Exec(`INSERT INTO notes (repo_owner, repo_name, text, tags, author, edited_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, n.Owner, n.Name, n.Text, strings.Join(n.Tags, ","), n.Author,
+		n.EditedAt.UTC().Format(time.RFC3339))
+	return err
+}
+
+func (s *SQLiteStore) NoteHistory(owner, name string) ([]Note, error) {
+	return s.queryNotes(`WHERE repo_owner = ? AND repo_name = ? ORDER BY id`, owner, name)
+}
+
+func (s *SQLiteStore) Notes() ([]Note, error) {
+	return s.queryNotes(`WHERE id IN (SELECT MAX(id) FROM notes GROUP BY repo_owner, repo_name)
+		AND (text != '' OR tags != '') ORDER BY repo_owner, repo_name`)
+}
+
+func (s *SQLiteStore) ForEachNote(fn func(Note) error) error {
+	ns, err := s.queryNotes(`ORDER BY repo_owner, repo_name, id`)
+	if err != nil {
+		return err
+	}
+	for _, n := range ns {
+		if err := fn(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) queryNotes(where string, args ...interface{}) ([]Note, error) {
+	rows, err := s.db.Query(`SELECT repo_owner, repo_name, text, tags, author, edited_at
+		FROM notes `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ns []Note
+	for rows.Next() {
+		var n Note
+		var tags, k string
+		if err := rows.Scan(&n.Owner, &n.Name, &n.Text, &tags, &n.Author, &k); err != nil {
+			return nil, err
+		}
+		if tags != "" {
+			n.Tags = strings.Split(tags, ",")
+		}
+		if n.EditedAt, err = time.Parse(time.RFC3339, k); err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	return ns, rows.Err()
+}
+
+func (s *SQLiteStore) Users() ([]User, error) {
+	return s.queryUsers(`ORDER BY name`)
+}
+
+func (s *SQLiteStore) User(name string) (User, error) {
+	us, err := s.queryUsers(`WHERE name = ?`, name)
+	if err != nil {
+		return User{}, err
+	}
+	if len(us) == 0 {
+		return User{}, ErrUnknownUser
+	}
+	return us[0], nil
+}
+
+func (s *SQLiteStore) queryUsers(where string, args ...interface{}) ([]User, error) {
+	rows, err := s.db.Query(`SELECT name, password_hash, role FROM users `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var us []User
+	for rows.Next() {
+		var u User
+		var hash, role string
+		if err := rows.Scan(&u.Name, &hash, &role); err != nil {
+			return nil, err
+		}
+		u.PasswordHash = []byte(hash)
+		u.Role = Role(role)
+		us = append(us, u)
+	}
+	return us, rows.Err()
+}
+
+func (s *SQLiteStore) SaveUser(u User) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO users (name, password_hash, role) VALUES (?, ?, ?)`,
+		u.Name, string(u.PasswordHash), string(u.Role))
+	return err
+}
+
+func (s *SQLiteStore) DeleteUser(name string) error {
+	res, err := s.db.Exec(`DELETE FROM users WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+func (s *SQLiteStore) SearchRepos(terms []string) ([]RepoInfo, error) {
+	// The terms are only letters and digits, so they can be quoted as is.
+	q := make([]string, len(terms))
+	for i, t := range terms {
+		q[i] = `"` + t + `"*`
+	}
+	return s.queryRepos(`WHERE rowid IN (SELECT rowid FROM repos_fts WHERE repos_fts MATCH ?)`,
+		strings.Join(q, " AND "))
+}
+
+// Size returns how many bytes the database takes.
+func (s *SQLiteStore) Size() (int64, error) {
+	var n int64
+	err := s.db.QueryRow(`SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`).Scan(&n)
+	return n, err
+}
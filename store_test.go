@@ -0,0 +1,335 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// storeKinds are the kinds of store the tests are run against.
+var storeKinds = []string{"memory", "bolt", "sqlite"}
+
+// openTestStore opens an empty store of the kind, removed when the test ends.
+func openTestStore(t *testing.T, kind string) Store {
+	t.Helper()
+	s, err := OpenStore(kind + ":" + filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// saveTestScrape saves a scrape with one daily item.
+func saveTestScrape(t *testing.T, s Store, lang Language, ts time.Time, owner, name string) {
+	t.Helper()
+	err := s.SaveScrape(Scrape{Lang: lang, TakenAt: ts, Periods: map[string][]TrendingItem{
+		PeriodDaily: {{RepoOwner: owner, RepoName: name, Language: "Go", Stars: 1}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyStoreMarks(t *testing.T) {
+	t1 := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+	want := map[string]map[string]RepoMarks{
+		"alice": {
+			"o/a": {MarkSeen: t1, MarkBookmarked: t1.Add(time.Hour)},
+			"o/b": {MarkHidden: t1},
+		},
+		"bob": {"o/a": {MarkSeen: t1.Add(2 * time.Hour)}},
+	}
+
+	for _, from := range storeKinds {
+		for _, to := range storeKinds {
+			t.Run(from+"-"+to, func(t *testing.T) {
+				src, dst := openTestStore(t, from), openTestStore(t, to)
+				for user, marks := range want {
+					if err := src.SaveMarks(user, marks); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if _, err := CopyStore(dst, src); err != nil {
+					t.Fatal(err)
+				}
+				got, err := dst.AllMarks()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("got marks %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestCopyStoreNotes(t *testing.T) {
+	t1 := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+	want := map[string][]Note{
+		"o/a": {
+			{Owner: "o", Name: "a", Text: "first", Tags: []string{"go"}, Author: "alice", EditedAt: t1},
+			{Owner: "o", Name: "a", Text: "second", Author: "bob", EditedAt: t1.Add(time.Hour)},
+		},
+		// A deleted note still has its history.
+		"o/b": {
+			{Owner: "o", Name: "b", Text: "gone soon", Author: "alice", EditedAt: t1},
+			{Owner: "o", Name: "b", Author: "alice", EditedAt: t1.Add(time.Minute)},
+		},
+	}
+
+	for _, from := range storeKinds {
+		for _, to := range storeKinds {
+			t.Run(from+"-"+to, func(t *testing.T) {
+				src, dst := openTestStore(t, from), openTestStore(t, to)
+				for _, k := range sortedKeys(want) {
+					for _, n := range want[k] {
+						if err := src.SaveNote(n); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+				if _, err := CopyStore(dst, src); err != nil {
+					t.Fatal(err)
+				}
+				for k, h := range want {
+					got, err := dst.NoteHistory(h[0].Owner, h[0].Name)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !reflect.DeepEqual(got, h) {
+						t.Errorf("got history of %s %+v, want %+v", k, got, h)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestStores runs the same checks against every kind of store.
+func TestStores(t *testing.T) {
+	goLang, rust := StoreToLang["go"], StoreToLang["rust"]
+	t1 := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s Store)
+	}{
+		{"follows", func(t *testing.T, s Store) {
+			for _, l := range []Language{rust, goLang, rust} {
+				if err := s.Follow(l); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Unfollow(rust); err != nil {
+				t.Fatal(err)
+			}
+			fs, err := s.Follows()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fs, []Language{goLang}) {
+				t.Errorf("got follows %v, want go", fs)
+			}
+		}},
+		{"scrapes", func(t *testing.T, s Store) {
+			if _, _, err := s.Latest(goLang, PeriodDaily); err != ErrNoScrapesForLang {
+				t.Errorf("got %v for no scrapes, want %v", err, ErrNoScrapesForLang)
+			}
+			saveTestScrape(t, s, goLang, t2, "o", "b")
+			saveTestScrape(t, s, goLang, t1, "o", "a")
+
+			tis, ts, err := s.Latest(goLang, PeriodDaily)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ts.Equal(t2) || len(tis) != 1 || tis[0].RepoName != "b" {
+				t.Errorf("got latest %v at %s, want o/b at %s", tis, ts, t2)
+			}
+			tis, err = s.GetScrape(goLang, PeriodDaily, t1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tis) != 1 || tis[0].RepoName != "a" {
+				t.Errorf("got scrape %v, want o/a", tis)
+			}
+
+			if err := s.DeleteScrape(goLang, t2); err != nil {
+				t.Fatal(err)
+			}
+			times, err := s.ScrapeHistory(goLang)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(times) != 1 || !times[0].Equal(t1) {
+				t.Errorf("got history %v, want only %s", times, t1)
+			}
+		}},
+		{"records", func(t *testing.T, s Store) {
+			saveTestScrape(t, s, goLang, t1, "o", "a")
+			saveTestScrape(t, s, rust, t1, "o", "r")
+			var got []string
+			err := s.ForEachRecord(RecordFilter{}, func(r ScrapeRecord) error {
+				got = append(got, r.Language+" "+r.Period+" "+r.RepoOwner+"/"+r.RepoName)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"go daily o/a", "rust daily o/r"}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got records %v, want %v", got, want)
+			}
+		}},
+		{"repos", func(t *testing.T, s Store) {
+			saveTestScrape(t, s, goLang, t1, "o", "first-repo")
+			saveTestScrape(t, s, goLang, t2, "o", "second")
+
+			ri, err := s.Repo("o", "second")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ri.LastSeen.Equal(t2) {
+				t.Errorf("got last seen %s, want %s", ri.LastSeen, t2)
+			}
+			if _, err := s.Repo("o", "missing"); err != ErrUnknownRepo {
+				t.Errorf("got %v for a missing repo, want %v", err, ErrUnknownRepo)
+			}
+			rs, err := s.Repos()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rs) != 2 || rs[0].Name != "first-repo" || rs[1].Name != "second" {
+				t.Errorf("got repos %v, want first-repo and second", rs)
+			}
+			rs, err = s.SearchRepos([]string{"fir"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rs) != 1 || rs[0].Name != "first-repo" {
+				t.Errorf("got search results %v, want first-repo", rs)
+			}
+		}},
+		{"seen", func(t *testing.T, s Store) {
+			saveTestScrape(t, s, goLang, t1, "o", "a")
+			saveTestScrape(t, s, goLang, t2, "o", "a")
+			seen, err := s.Seen(goLang, PeriodDaily)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs := seen["o/a"]
+			if !fs.FirstSeen.Equal(t1) || !fs.LastSeen.Equal(t2) {
+				t.Errorf("got seen %+v, want from %s to %s", fs, t1, t2)
+			}
+		}},
+		{"marks", func(t *testing.T, s Store) {
+			if err := s.SetMark("alice", MarkSeen, "o", "a", true); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SetMark("alice", MarkHidden, "o", "a", true); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SetMark("alice", MarkSeen, "o", "a", false); err != nil {
+				t.Fatal(err)
+			}
+			marks, err := s.Marks("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rm := marks["o/a"]; len(marks) != 1 || len(rm) != 1 || rm[MarkHidden].IsZero() {
+				t.Errorf("got marks %v, want o/a hidden", marks)
+			}
+			if marks, err := s.Marks("bob"); err != nil || len(marks) != 0 {
+				t.Errorf("got marks %v and %v for bob, want none", marks, err)
+			}
+		}},
+		{"notes", func(t *testing.T, s Store) {
+			for _, n := range []Note{
+				{Owner: "o", Name: "b", Text: "b", Author: "alice", EditedAt: t1},
+				{Owner: "o", Name: "a", Text: "a1", Author: "alice", EditedAt: t1},
+				{Owner: "o", Name: "a", Text: "a2", Tags: []string{"x", "y"}, Author: "bob", EditedAt: t2},
+				{Owner: "o", Name: "c", Text: "c", Author: "alice", EditedAt: t1},
+				{Owner: "o", Name: "c", Author: "alice", EditedAt: t2},
+			} {
+				if err := s.SaveNote(n); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ns, err := s.Notes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, n := range ns {
+				got = append(got, n.Name+":"+n.Text)
+			}
+			if want := []string{"a:a2", "b:b"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got notes %v, want %v", got, want)
+			}
+			h, err := s.NoteHistory("o", "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(h) != 2 || h[0].Text != "a1" || !reflect.DeepEqual(h[1].Tags, []string{"x", "y"}) {
+				t.Errorf("got history %+v, want a1 then a2", h)
+			}
+		}},
+		{"users", func(t *testing.T, s Store) {
+			for _, u := range []User{
+				{Name: "bob", PasswordHash: []byte("h1"), Role: RoleReader},
+				{Name: "alice", PasswordHash: []byte("h2"), Role: RoleAdmin},
+			} {
+				if err := s.SaveUser(u); err != nil {
+					t.Fatal(err)
+				}
+			}
+			us, err := s.Users()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(us) != 2 || us[0].Name != "alice" || us[1].Name != "bob" {
+				t.Errorf("got users %v, want alice and bob", us)
+			}
+			if err := s.DeleteUser("bob"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.User("bob"); err != ErrUnknownUser {
+				t.Errorf("got %v for a deleted user, want %v", err, ErrUnknownUser)
+			}
+			if err := s.DeleteUser("bob"); err != ErrUnknownUser {
+				t.Errorf("got %v deleting a deleted user, want %v", err, ErrUnknownUser)
+			}
+			u, err := s.User("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Role != RoleAdmin || string(u.PasswordHash) != "h2" {
+				t.Errorf("got user %+v, want alice as admin", u)
+			}
+		}},
+	}
+	for _, kind := range storeKinds {
+		for _, tt := range tests {
+			t.Run(kind+"/"+tt.name, func(t *testing.T) {
+				tt.run(t, openTestStore(t, kind))
+			})
+		}
+	}
+}
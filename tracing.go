@@ -0,0 +1,128 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer makes the spans. Until setupTracing is called they go nowhere.
+var tracer = otel.Tracer("github.com/rhermes/trendhub")
+
+// setupTracing sends the spans to exporter, which is none, otlp or file:<path>.
+// otlp is configured by the OTEL_EXPORTER_OTLP_* environment variables, and
+// file writes the spans as JSON. The returned function flushes the spans not
+// yet sent, and must be called before exiting.
+func setupTracing(exporter string) (func(context.Context) error, error) {
+	var exp sdktrace.SpanExporter
+	switch {
+	case exporter == "none":
+		return func(context.Context) error { return nil }, nil
+	case exporter == "otlp":
+		var err error
+		if exp, err = otlptracehttp.New(context.Background()); err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(exporter, "file:"):
+		f, err := os.OpenFile(strings.TrimPrefix(exporter, "file:"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if exp, err = stdouttrace.New(stdouttrace.WithWriter(f)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown trace exporter: %s", exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName("trendhub")))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// endSpan ends the span, marking it as failed if err is set.
+func endSpan(sp trace.Span, err error) {
+	if err != nil {
+		sp.RecordError(err)
+		sp.SetStatus(codes.Error, err.Error())
+	}
+	sp.End()
+}
+
+// storeSpan starts a span around a call to the store of the crawler. For bolt
+// each call is a transaction, so this is where their time shows up.
+func (c *Crawler) storeSpan(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	system := "memory"
+	switch c.Store.(type) {
+	case *BoltStore:
+		system = "bolt"
+	case *SQLiteStore:
+		system = "sqlite"
+	}
+	attrs = append(attrs, attribute.String("db.system", system), attribute.String("db.operation", op))
+	return tracer.Start(ctx, "store."+op, trace.WithAttributes(attrs...))
+}
+
+// httpTracing makes a span of each request, continuing the trace of the caller
+// if it sent one. Spans are named by the route they matched, like the metrics.
+func httpTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, sp := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+		))
+		defer sp.End()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		if rc := chi.RouteContext(r.Context()); rc != nil && rc.RoutePattern() != "" {
+			sp.SetName(r.Method + " " + rc.RoutePattern())
+			sp.SetAttributes(semconv.HTTPRoute(rc.RoutePattern()))
+		}
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		sp.SetAttributes(semconv.HTTPResponseStatusCode(code))
+		if code >= 500 {
+			sp.SetStatus(codes.Error, http.StatusText(code))
+		}
+	})
+}
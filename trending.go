@@ -0,0 +1,294 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// QueryError is a query parameter with a value we don't understand. It is the
+// fault of whoever asked, not ours.
+type QueryError struct {
+	Param string
+	Value string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("Invalid %s: %s", e.Param, e.Value)
+}
+
+// IndexItem is a trending item with what we know about it from the history.
+type IndexItem struct {
+	TrendingItem
+	Breakout *Breakout `json:",omitempty"`
+	// FirstSeen is when the repo was first in this feed, and New is set if
+	// that was within the new window.
+	FirstSeen time.Time
+	New       bool
+	// How the user has marked the repo. Collapsed is set for seen repos when
+	// they are collapsed.
+	Seen       bool
+	Bookmarked bool
+	Collapsed  bool
+	Note       *Note `json:",omitempty"`
+}
+
+type LanguageScrape struct {
+	Lang    Language
+	Items   []IndexItem
+	Scraped time.Time
+}
+
+func indexItems(tis []TrendingItem) []IndexItem {
+	its := make([]IndexItem, len(tis))
+	for i, ti := range tis {
+		its[i].TrendingItem = ti
+	}
+	return its
+}
+
+// TrendingQuery asks for the latest scrape of some languages. The website, the
+// API and the command line all ask through it, so they agree on what is shown.
+type TrendingQuery struct {
+	// Langs are the languages to show, or the followed ones if empty.
+	Langs  []Language
+	Period string
+	// OnlyNew removes the repos that aren't new.
+	OnlyNew bool
+	// Dedup hides repos already shown in an earlier language.
+	Dedup bool
+	// Collapse shows only the names of the repos the user has seen.
+	Collapse bool
+	// User is whose marks to apply, if anyone's.
+	User   string
+	Filter ItemFilter
+}
+
+// parseTrendingQuery reads the query from the langs, period, only, dedup and
+// collapse query parameters, along with those of the filter. Bad values give a
+// QueryError.
+func parseTrendingQuery(qv url.Values) (TrendingQuery, error) {
+	q := TrendingQuery{
+		Period:   qv.Get("period"),
+		OnlyNew:  qv.Get("only") == "new",
+		Dedup:    qv.Get("dedup") != "",
+		Collapse: qv.Get("collapse") == "seen",
+	}
+
+	switch q.Period {
+	case "":
+		q.Period = PeriodDaily
+	case PeriodDaily, PeriodWeekly, PeriodMonthly:
+	default:
+		return q, &QueryError{"period", q.Period}
+	}
+
+	if s := qv.Get("langs"); s != "" {
+		seen := make(map[string]bool)
+		for _, n := range strings.Split(s, ",") {
+			if seen[n] {
+				continue
+			}
+			l, ok := StoreToLang[n]
+			if !ok {
+				return q, &QueryError{"langs", n}
+			}
+			seen[n] = true
+			q.Langs = append(q.Langs, l)
+		}
+	}
+
+	var err error
+	q.Filter, err = parseItemFilter(qv)
+	return q, err
+}
+
+// Trending answers the query with the latest scrape of each of its languages
+// that has one.
+func (c *Crawler) Trending(ctx context.Context, q TrendingQuery, opts WebsiteOptions, now time.Time) (ls []LanguageScrape, err error) {
+	ctx, sp := tracer.Start(ctx, "trending", trace.WithAttributes(attribute.String("period", q.Period)))
+	defer func() { endSpan(sp, err) }()
+
+	fs := q.Langs
+	if len(fs) == 0 {
+		_, ssp := c.storeSpan(ctx, "follows")
+		fs, err = c.Follows()
+		endSpan(ssp, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range fs {
+		_, ssp := c.storeSpan(ctx, "latest", attribute.String("language", f.StoreName))
+		tis, ts, err := c.Latest(f, q.Period)
+		endSpan(ssp, err)
+		if err != nil {
+			// TODO(rHermes): Create some kind of blank page when we have no scrape?
+			if err == ErrNoScrapesForLang || err == ErrNoScrapesForPeriod {
+				continue
+			}
+			return nil, err
+		}
+		ls = append(ls, LanguageScrape{
+			Lang:    f,
+			Items:   indexItems(tis),
+			Scraped: ts,
+		})
+	}
+
+	if err := c.markNew(ctx, ls, q.Period, q.OnlyNew, opts.NewWindow, now); err != nil {
+		return nil, err
+	}
+	if q.User != "" {
+		if err := c.markUser(ctx, ls, q.User, q.Collapse); err != nil {
+			return nil, err
+		}
+	}
+	for i := range ls {
+		ls[i].Items = q.Filter.Apply(ls[i].Items)
+	}
+	if q.Dedup {
+		dedupLangs(ls)
+	}
+	if err := c.markNotes(ctx, ls); err != nil {
+		return nil, err
+	}
+	if err := c.markBreakouts(ctx, ls, opts.Breakouts, now); err != nil {
+		return nil, err
+	}
+	return ls, nil
+}
+
+// markNew sets FirstSeen and New on the items, and with onlyNew removes the
+// items that aren't new.
+func (c *Crawler) markNew(ctx context.Context, ls []LanguageScrape, period string, onlyNew bool, window time.Duration, now time.Time) error {
+	for i := range ls {
+		_, sp := c.storeSpan(ctx, "seen", attribute.String("language", ls[i].Lang.StoreName))
+		seen, err := c.Seen(ls[i].Lang, period)
+		endSpan(sp, err)
+		if err != nil {
+			return err
+		}
+		var its []IndexItem
+		for _, it := range ls[i].Items {
+			it.FirstSeen = seen[it.RepoOwner+"/"+it.RepoName].FirstSeen
+			it.New = !it.FirstSeen.IsZero() && now.Sub(it.FirstSeen) <= window
+			if it.New || !onlyNew {
+				its = append(its, it)
+			}
+		}
+		ls[i].Items = its
+	}
+	return nil
+}
+
+// markUser sets how the user has marked the items, and removes the hidden ones.
+func (c *Crawler) markUser(ctx context.Context, ls []LanguageScrape, user string, collapse bool) error {
+	_, sp := c.storeSpan(ctx, "marks")
+	marks, err := c.Marks(user)
+	endSpan(sp, err)
+	if err != nil {
+		return err
+	}
+
+	for i := range ls {
+		var its []IndexItem
+		for _, it := range ls[i].Items {
+			rm := marks[it.RepoOwner+"/"+it.RepoName]
+			if _, ok := rm[MarkHidden]; ok {
+				continue
+			}
+			_, it.Seen = rm[MarkSeen]
+			_, it.Bookmarked = rm[MarkBookmarked]
+			it.Collapsed = it.Seen && collapse
+			its = append(its, it)
+		}
+		ls[i].Items = its
+	}
+	return nil
+}
+
+// markNotes sets the notes of the items.
+func (c *Crawler) markNotes(ctx context.Context, ls []LanguageScrape) error {
+	_, sp := c.storeSpan(ctx, "notes")
+	ns, err := c.Notes()
+	endSpan(sp, err)
+	if err != nil {
+		return err
+	}
+
+	byRepo := make(map[string]*Note, len(ns))
+	for i := range ns {
+		byRepo[ns[i].Owner+"/"+ns[i].Name] = &ns[i]
+	}
+	for _, l := range ls {
+		for i := range l.Items {
+			l.Items[i].Note = byRepo[l.Items[i].RepoOwner+"/"+l.Items[i].RepoName]
+		}
+	}
+	return nil
+}
+
+// markBreakouts sets Breakout on the items that are breakouts.
+func (c *Crawler) markBreakouts(ctx context.Context, ls []LanguageScrape, opts BreakoutOptions, now time.Time) error {
+	langs := make([]Language, len(ls))
+	for i, l := range ls {
+		langs[i] = l.Lang
+	}
+	if len(langs) == 0 {
+		return nil
+	}
+	_, sp := tracer.Start(ctx, "breakouts")
+	bs, err := c.Breakouts(langs, opts, now)
+	endSpan(sp, err)
+	if err != nil {
+		return err
+	}
+
+	byRepo := make(map[string]*Breakout, len(bs))
+	for i := range bs {
+		byRepo[bs[i].Owner+"/"+bs[i].Name] = &bs[i]
+	}
+	for _, l := range ls {
+		for i := range l.Items {
+			l.Items[i].Breakout = byRepo[l.Items[i].RepoOwner+"/"+l.Items[i].RepoName]
+		}
+	}
+	return nil
+}
+
+// dedupLangs removes the repos already shown in an earlier language.
+func dedupLangs(ls []LanguageScrape) {
+	shown := make(map[string]bool)
+	for i := range ls {
+		var its []IndexItem
+		for _, it := range ls[i].Items {
+			k := it.RepoOwner + "/" + it.RepoName
+			if !shown[k] {
+				shown[k] = true
+				its = append(its, it)
+			}
+		}
+		ls[i].Items = its
+	}
+}
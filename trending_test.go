@@ -0,0 +1,165 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTrendingQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  TrendingQuery
+		// bad is the parameter of the QueryError, if any.
+		bad string
+	}{
+		{"", TrendingQuery{Period: PeriodDaily, Filter: ItemFilter{Sort: SortRank}}, ""},
+		{"period=weekly&only=new&dedup=1&collapse=seen", TrendingQuery{
+			Period: PeriodWeekly, OnlyNew: true, Dedup: true, Collapse: true, Filter: ItemFilter{Sort: SortRank},
+		}, ""},
+		{"only=old&collapse=all", TrendingQuery{Period: PeriodDaily, Filter: ItemFilter{Sort: SortRank}}, ""},
+		{"langs=rust,go,rust", TrendingQuery{
+			Langs: []Language{LangRust, LangGo}, Period: PeriodDaily, Filter: ItemFilter{Sort: SortRank},
+		}, ""},
+		{"period=yearly", TrendingQuery{}, "period"},
+		{"langs=go,cobol", TrendingQuery{}, "langs"},
+		{"langs=go,", TrendingQuery{}, "langs"},
+		{"sort=name", TrendingQuery{}, "sort"},
+		{"min_stars=x", TrendingQuery{}, "min_stars"},
+	}
+	for _, tt := range tests {
+		qv, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := parseTrendingQuery(qv)
+		if tt.bad != "" {
+			var qe *QueryError
+			if !errors.As(err, &qe) || qe.Param != tt.bad {
+				t.Errorf("%q: got error %v, want a QueryError for %s", tt.query, err, tt.bad)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(q, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.query, q, tt.want)
+		}
+	}
+}
+
+func TestTrending(t *testing.T) {
+	c, err := NewCrawler("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	now := time.Date(2026, 9, 10, 12, 0, 0, 0, time.UTC)
+	item := func(owner string, stars int) TrendingItem {
+		return TrendingItem{RepoOwner: owner, RepoName: "r", Stars: stars}
+	}
+	save := func(lang Language, ago time.Duration, periods map[string][]TrendingItem) {
+		t.Helper()
+		if err := c.SaveScrape(Scrape{Lang: lang, TakenAt: now.Add(-ago), Periods: periods}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// old has been trending in Go for long, but is new in Rust. boom breaks
+	// out in Rust.
+	save(LangGo, 10*24*time.Hour, map[string][]TrendingItem{PeriodDaily: {item("old", 5)}})
+	for i, stars := range []int{0, 1, 2} {
+		save(LangRust, time.Duration(4-i)*time.Hour, map[string][]TrendingItem{PeriodDaily: {item("boom", stars)}})
+	}
+	save(LangGo, time.Hour, map[string][]TrendingItem{
+		PeriodDaily:  {item("old", 5), item("hidden", 1), item("noted", 1), item("shared", 200)},
+		PeriodWeekly: {item("shared", 200), item("only", 1)},
+	})
+	save(LangRust, time.Hour, map[string][]TrendingItem{
+		PeriodDaily:  {item("old", 100), item("shared", 200), item("boom", 100)},
+		PeriodWeekly: {item("shared", 200), item("only", 1)},
+	})
+	if err := c.SetMark("tester", MarkHidden, "hidden", "r", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetMark("tester", MarkSeen, "noted", "r", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SaveNote(Note{Owner: "noted", Name: "r", Text: "A note", Author: "tester", EditedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	opts := WebsiteOptions{NewWindow: 48 * time.Hour, Breakouts: DefaultBreakouts}
+
+	tests := []struct {
+		query        string
+		golang, rust []string
+	}{
+		{"", []string{"old", "noted", "shared"}, []string{"old", "shared", "boom"}},
+		{"dedup=1", []string{"old", "noted", "shared"}, []string{"boom"}},
+		// Newness is per feed, and decided before the repeats are hidden.
+		{"only=new&dedup=1", []string{"noted", "shared"}, []string{"old", "boom"}},
+		// So is the filter.
+		{"min_stars=50&dedup=1", []string{"shared"}, []string{"old", "boom"}},
+		{"period=weekly", []string{"shared", "only"}, []string{"shared", "only"}},
+		{"period=weekly&dedup=1", []string{"shared", "only"}, nil},
+		{"period=monthly", nil, nil},
+	}
+	for _, tt := range tests {
+		qv, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := parseTrendingQuery(qv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.Langs = []Language{LangGo, LangRust}
+		q.User = "tester"
+		ls, err := c.Trending(context.Background(), q, opts, now)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.query, err)
+		}
+
+		got := make(map[string][]string)
+		for _, l := range ls {
+			got[l.Lang.StoreName] = nil
+			for _, it := range l.Items {
+				got[l.Lang.StoreName] = append(got[l.Lang.StoreName], it.RepoOwner)
+
+				// Those left have their notes, marks and breakouts.
+				if (it.Note != nil) != (it.RepoOwner == "noted") || it.Seen != (it.RepoOwner == "noted") {
+					t.Errorf("%q: %s in %s: got note %v and seen %v", tt.query, it.RepoOwner, l.Lang.StoreName, it.Note, it.Seen)
+				}
+				if (it.Breakout != nil) != (it.RepoOwner == "boom") {
+					t.Errorf("%q: %s in %s: got breakout %v", tt.query, it.RepoOwner, l.Lang.StoreName, it.Breakout)
+				}
+			}
+		}
+		want := map[string][]string{"go": tt.golang, "rust": tt.rust}
+		if tt.golang == nil && tt.rust == nil {
+			want = map[string][]string{}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %v, want %v", tt.query, got, want)
+		}
+	}
+}
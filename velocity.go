@@ -0,0 +1,235 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minBreakoutVelocity keeps repos that go from no stars to a couple from being
+// breakouts, as any growth is infinitely faster than none.
+const minBreakoutVelocity = 1.0
+
+// BreakoutOptions decides which repos are breakouts.
+type BreakoutOptions struct {
+	// Factor is how many times faster than its baseline a repo must be getting
+	// stars to be a breakout.
+	Factor float64
+	// Window is how far back we look for the baseline.
+	Window time.Duration
+}
+
+// DefaultBreakouts is used when nothing else is given.
+var DefaultBreakouts = BreakoutOptions{
+	Factor: 3,
+	Window: 7 * 24 * time.Hour,
+}
+
+// Breakout is a repo getting stars a lot faster than it used to. Velocities are
+// in stars per hour.
+type Breakout struct {
+	Owner string
+	Name  string
+	Stars int
+	At    time.Time
+	// Velocity is since the scrape before the latest.
+	Velocity float64
+	// Acceleration is the change in velocity per hour, from the two latest
+	// velocities.
+	Acceleration float64
+	// Baseline is the average velocity over the window, up to the scrape
+	// before the latest.
+	Baseline float64
+}
+
+type starPoint struct {
+	at    time.Time
+	stars int
+	lang  string
+}
+
+// breakoutCache keeps the breakouts found, as finding them reads every scrape
+// in the window. They only change with the scrapes, and as the window moves
+// on, which we let happen by the hour.
+type breakoutCache struct {
+	mu sync.Mutex
+	// gen counts the changes to the scrapes, so that breakouts found from
+	// scrapes that changed while we looked aren't kept.
+	gen  int
+	hour time.Time
+	bs   map[string][]Breakout
+}
+
+func (bc *breakoutCache) get(key string, hour time.Time) ([]Breakout, int, bool) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bs, ok := bc.bs[key]
+	return bs, bc.gen, ok && bc.hour.Equal(hour)
+}
+
+func (bc *breakoutCache) put(key string, hour time.Time, gen int, bs []Breakout) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if gen != bc.gen {
+		return
+	}
+	if bc.bs == nil || !bc.hour.Equal(hour) {
+		bc.bs = make(map[string][]Breakout)
+		bc.hour = hour
+	}
+	bc.bs[key] = bs
+}
+
+// clear forgets the breakouts, as the scrapes have changed.
+func (bc *breakoutCache) clear() {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.gen++
+	bc.bs = nil
+}
+
+// SaveScrape saves the scrape, and forgets the breakouts.
+func (c *Crawler) SaveScrape(sc Scrape) error {
+	defer c.breakouts.clear()
+	return c.Store.SaveScrape(sc)
+}
+
+// DeleteScrape removes the scrape, and forgets the breakouts.
+func (c *Crawler) DeleteScrape(lang Language, ts time.Time) error {
+	defer c.breakouts.clear()
+	return c.Store.DeleteScrape(lang, ts)
+}
+
+// Breakouts finds the repos in the latest scrapes of the languages that are
+// breakouts, sorted by how much faster than their baseline they are. They are
+// kept until the scrapes change, or for the hour.
+func (c *Crawler) Breakouts(langs []Language, opts BreakoutOptions, now time.Time) ([]Breakout, error) {
+	names := make([]string, len(langs))
+	for i, l := range langs {
+		names[i] = l.StoreName
+	}
+	sort.Strings(names)
+	key := fmt.Sprintf("%s %v %v", strings.Join(names, ","), opts.Factor, opts.Window)
+	hour := now.Truncate(time.Hour)
+
+	bs, gen, ok := c.breakouts.get(key, hour)
+	if !ok {
+		var err error
+		if bs, err = c.findBreakouts(langs, opts, now); err != nil {
+			return nil, err
+		}
+		c.breakouts.put(key, hour, gen, bs)
+	}
+	return slices.Clone(bs), nil
+}
+
+func (c *Crawler) findBreakouts(langs []Language, opts BreakoutOptions, now time.Time) ([]Breakout, error) {
+	points := make(map[string][]starPoint)
+	latest := make(map[string]time.Time)
+
+	f := RecordFilter{Langs: langs, Since: now.Add(-opts.Window)}
+	err := c.ForEachRecord(f, func(r ScrapeRecord) error {
+		key := r.RepoOwner + "/" + r.RepoName
+		points[key] = append(points[key], starPoint{at: r.ScrapedAt, stars: r.Stars, lang: r.Language})
+		if r.ScrapedAt.After(latest[r.Language]) {
+			latest[r.Language] = r.ScrapedAt
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var bs []Breakout
+	for key, ps := range points {
+		// The points come a language at a time, and a repo is in every list
+		// of a scrape with the same stars.
+		sort.Slice(ps, func(i, j int) bool { return ps[i].at.Before(ps[j].at) })
+		var uniq []starPoint
+		for _, p := range ps {
+			if len(uniq) == 0 || !uniq[len(uniq)-1].at.Equal(p.at) {
+				uniq = append(uniq, p)
+			}
+		}
+		last := uniq[len(uniq)-1]
+		current := false
+		for _, p := range ps {
+			if p.at.Equal(last.at) && latest[p.lang].Equal(p.at) {
+				current = true
+			}
+		}
+		// The baseline needs at least two velocities to mean anything.
+		if !current || len(uniq) < 4 {
+			continue
+		}
+
+		b, ok := breakout(uniq, opts.Factor)
+		if !ok {
+			continue
+		}
+		b.Owner, b.Name, _ = strings.Cut(key, "/")
+		bs = append(bs, b)
+	}
+
+	sort.Slice(bs, func(i, j int) bool {
+		ri, rj := breakoutRatio(bs[i]), breakoutRatio(bs[j])
+		if ri != rj {
+			return ri > rj
+		}
+		if bs[i].Owner != bs[j].Owner {
+			return bs[i].Owner < bs[j].Owner
+		}
+		return bs[i].Name < bs[j].Name
+	})
+	return bs, nil
+}
+
+// breakout computes the velocities from at least 4 points in time order, and
+// says if it is a breakout.
+func breakout(ps []starPoint, factor float64) (Breakout, bool) {
+	n := len(ps)
+	velocity := func(a, b starPoint) float64 {
+		return float64(b.stars-a.stars) / b.at.Sub(a.at).Hours()
+	}
+
+	b := Breakout{
+		Stars:    ps[n-1].stars,
+		At:       ps[n-1].at,
+		Velocity: velocity(ps[n-2], ps[n-1]),
+		Baseline: velocity(ps[0], ps[n-2]),
+	}
+	prev := velocity(ps[n-3], ps[n-2])
+	// The velocities are taken at the middle of their spans.
+	mid := ps[n-1].at.Sub(ps[n-3].at).Hours() / 2
+	b.Acceleration = (b.Velocity - prev) / mid
+
+	if b.Velocity < minBreakoutVelocity || b.Velocity <= factor*b.Baseline {
+		return b, false
+	}
+	return b, true
+}
+
+// breakoutRatio is how many times faster than its baseline a breakout is.
+func breakoutRatio(b Breakout) float64 {
+	if b.Baseline <= 0 {
+		return b.Velocity / minBreakoutVelocity
+	}
+	return b.Velocity / b.Baseline
+}
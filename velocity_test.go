@@ -0,0 +1,208 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// starScrape is a scrape of Go taken hours after lbStart, with repos named
+// after their owner having the stars.
+type starScrape struct {
+	hours int
+	stars map[string]int
+}
+
+func saveStarScrapes(t *testing.T, c *Crawler, scs []starScrape) {
+	t.Helper()
+	for _, sc := range scs {
+		var tis []TrendingItem
+		for _, owner := range sortedKeys(sc.stars) {
+			tis = append(tis, lbItem(owner, "r", sc.stars[owner]))
+		}
+		err := c.SaveScrape(Scrape{Lang: LangGo, TakenAt: lbAt(sc.hours), Periods: map[string][]TrendingItem{PeriodDaily: tis}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBreakouts(t *testing.T) {
+	window := 7 * 24 * time.Hour
+	tests := []struct {
+		name    string
+		scrapes []starScrape
+		opts    BreakoutOptions
+		now     int
+		want    []Breakout
+	}{
+		{
+			name: "a jump",
+			scrapes: []starScrape{
+				{0, map[string]int{"a": 100}}, {1, map[string]int{"a": 101}},
+				{2, map[string]int{"a": 102}}, {3, map[string]int{"a": 200}},
+			},
+			opts: BreakoutOptions{Factor: 3, Window: window},
+			now:  3,
+			want: []Breakout{{Owner: "a", Name: "r", Stars: 200, At: lbAt(3), Velocity: 98, Acceleration: 97, Baseline: 1}},
+		},
+		{
+			name: "three points aren't enough",
+			scrapes: []starScrape{
+				{0, map[string]int{"a": 100}}, {1, map[string]int{"a": 101}}, {2, map[string]int{"a": 200}},
+			},
+			opts: BreakoutOptions{Factor: 3, Window: window},
+			now:  2,
+		},
+		{
+			name: "the window leaves three points",
+			scrapes: []starScrape{
+				{0, map[string]int{"a": 100}}, {1, map[string]int{"a": 101}},
+				{2, map[string]int{"a": 102}}, {3, map[string]int{"a": 200}},
+			},
+			opts: BreakoutOptions{Factor: 3, Window: 150 * time.Minute},
+			now:  3,
+		},
+		{
+			name: "slower than the minimum velocity",
+			scrapes: []starScrape{
+				{0, map[string]int{"a": 0}}, {2, map[string]int{"a": 0}},
+				{4, map[string]int{"a": 0}}, {6, map[string]int{"a": 1}},
+			},
+			opts: BreakoutOptions{Factor: 3, Window: window},
+			now:  6,
+		},
+		{
+			name: "at the minimum velocity",
+			scrapes: []starScrape{
+				{0, map[string]int{"a": 0}}, {1, map[string]int{"a": 0}},
+				{2, map[string]int{"a": 0}}, {3, map[string]int{"a": 1}},
+			},
+			opts: BreakoutOptions{Factor: 3, Window: window},
+			now:  3,
+			want: []Breakout{{Owner: "a", Name: "r", Stars: 1, At: lbAt(3), Velocity: 1, Acceleration: 1, Baseline: 0}},
+		},
+		{
+			name: "exactly the factor is not enough",
+			scrapes: []starScrape{
+				{0, map[string]int{"a": 0}}, {1, map[string]int{"a": 10}},
+				{2, map[string]int{"a": 20}}, {3, map[string]int{"a": 50}},
+			},
+			opts: BreakoutOptions{Factor: 3, Window: window},
+			now:  3,
+		},
+		{
+			name: "a lower factor",
+			scrapes: []starScrape{
+				{0, map[string]int{"a": 0}}, {1, map[string]int{"a": 10}},
+				{2, map[string]int{"a": 20}}, {3, map[string]int{"a": 50}},
+			},
+			opts: BreakoutOptions{Factor: 2, Window: window},
+			now:  3,
+			want: []Breakout{{Owner: "a", Name: "r", Stars: 50, At: lbAt(3), Velocity: 30, Acceleration: 20, Baseline: 10}},
+		},
+		{
+			name: "gone from the latest scrape",
+			scrapes: []starScrape{
+				{0, map[string]int{"a": 100}}, {1, map[string]int{"a": 101}},
+				{2, map[string]int{"a": 102}}, {3, map[string]int{"a": 200}},
+				{4, map[string]int{"b": 1}},
+			},
+			opts: BreakoutOptions{Factor: 3, Window: window},
+			now:  4,
+		},
+		{
+			name: "sorted by how many times faster",
+			scrapes: []starScrape{
+				{0, map[string]int{"a": 0, "b": 0}}, {1, map[string]int{"a": 1, "b": 2}},
+				{2, map[string]int{"a": 2, "b": 4}}, {3, map[string]int{"a": 12, "b": 14}},
+			},
+			opts: BreakoutOptions{Factor: 3, Window: window},
+			now:  3,
+			want: []Breakout{
+				{Owner: "a", Name: "r", Stars: 12, At: lbAt(3), Velocity: 10, Acceleration: 9, Baseline: 1},
+				{Owner: "b", Name: "r", Stars: 14, At: lbAt(3), Velocity: 10, Acceleration: 8, Baseline: 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		c, err := NewCrawler("memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		saveStarScrapes(t, c, tt.scrapes)
+		got, err := c.Breakouts([]Language{LangGo}, tt.opts, lbAt(tt.now))
+		c.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBreakoutsCached(t *testing.T) {
+	c, err := NewCrawler("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	saveStarScrapes(t, c, []starScrape{
+		{0, map[string]int{"a": 100}}, {1, map[string]int{"a": 101}},
+		{2, map[string]int{"a": 102}}, {3, map[string]int{"a": 200}},
+	})
+	breakouts := func(now time.Time) int {
+		t.Helper()
+		bs, err := c.Breakouts([]Language{LangGo}, DefaultBreakouts, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(bs)
+	}
+	now := lbAt(3).Add(10 * time.Minute)
+	if n := breakouts(now); n != 1 {
+		t.Fatalf("got %d breakouts, want 1", n)
+	}
+
+	// Going around the crawler isn't noticed until the hour is over.
+	if err := c.Store.DeleteScrape(LangGo, lbAt(3)); err != nil {
+		t.Fatal(err)
+	}
+	if n := breakouts(now.Add(time.Minute)); n != 1 {
+		t.Errorf("got %d breakouts from the cache, want 1", n)
+	}
+	if n := breakouts(now.Add(time.Hour)); n != 0 {
+		t.Errorf("got %d breakouts the next hour, want 0", n)
+	}
+
+	// A new scrape is noticed right away.
+	saveStarScrapes(t, c, []starScrape{{3, map[string]int{"a": 200}}})
+	if n := breakouts(now.Add(time.Hour)); n != 1 {
+		t.Errorf("got %d breakouts after a scrape, want 1", n)
+	}
+	if err := c.DeleteScrape(LangGo, lbAt(3)); err != nil {
+		t.Fatal(err)
+	}
+	if n := breakouts(now.Add(time.Hour)); n != 0 {
+		t.Errorf("got %d breakouts after a delete, want 0", n)
+	}
+}
@@ -17,12 +17,22 @@ package main
 import (
 	"bytes"
 	"compress/flate"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -30,94 +40,540 @@ import (
 )
 
 const (
-	ctxCrawler = "__crawler__"
-	ctxIdxTmpl = "__indexTemplate__"
+	ctxCrawler       = "__crawler__"
+	ctxIdxTmpl       = "__indexTemplate__"
+	ctxStatsTmpl     = "__statsTemplate__"
+	ctxOptions       = "__options__"
+	ctxOverlapTmpl   = "__overlapTemplate__"
+	ctxBookmarksTmpl = "__bookmarksTemplate__"
+	ctxRepoTmpl      = "__repoTemplate__"
+	ctxNotesTmpl     = "__notesTemplate__"
+	ctxSearchTmpl    = "__searchTemplate__"
+	ctxFollowsTmpl   = "__followsTemplate__"
+	ctxUser          = "__user__"
+	// ctxControl is set on requests through the control socket.
+	ctxControl = "__control__"
+	// ctxPrincipal is who made the request, if we know.
+	ctxPrincipal = "__principal__"
 )
 
-type LanguageScrape struct {
-	Lang    Language
-	Items   []TrendingItem
-	Scraped time.Time
+// DefaultStatsLimit is how many rows the leaderboards show when not asked for.
+const DefaultStatsLimit = 50
+
+// WebsiteOptions configures the parts of the website that are optional.
+type WebsiteOptions struct {
+	// Auth decides who may look at and change things.
+	Auth Auth
+	// Breakouts decides which repos are highlighted as breakouts.
+	Breakouts BreakoutOptions
+	// NewWindow is how long after it was first seen in a feed a repo is new.
+	NewWindow time.Duration
+	// StaleAfter is how old the newest scrape of a followed language may be
+	// before /readyz fails. Zero turns the check off.
+	StaleAfter time.Duration
 }
 
 type IndexPageCtx struct {
 	Periods []string
 	Period  string
-	Langs   []LanguageScrape
-	BoltDur time.Duration
+	OnlyNew bool
+	// Dedup hides repos already shown in an earlier language.
+	Dedup bool
+	// Collapse shows only the names of the repos the user has seen.
+	Collapse bool
+	Filter   ItemFilter
+	Sorts    []string `json:"-"`
+	Langs    []LanguageScrape
+	BoltDur  time.Duration
+	// Query is the query of the request, for building links.
+	Query url.Values `json:"-"`
+}
+
+// queryIndex answers the trending query of the request for the user.
+func queryIndex(r *http.Request) (IndexPageCtx, int, error) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	opts := r.Context().Value(ctxOptions).(WebsiteOptions)
+	qv := r.URL.Query()
+
+	pctx := IndexPageCtx{
+		Periods: []string{PeriodDaily, PeriodWeekly, PeriodMonthly},
+		Sorts:   Sorts,
+		Query:   qv,
+	}
+	q, err := parseTrendingQuery(qv)
+	if err != nil {
+		return pctx, http.StatusBadRequest, err
+	}
+	q.User = markUser(r)
+	pctx.Period = q.Period
+	pctx.OnlyNew = q.OnlyNew
+	pctx.Dedup = q.Dedup
+	pctx.Collapse = q.Collapse
+	pctx.Filter = q.Filter
+
+	tStart := time.Now()
+	if pctx.Langs, err = c.Trending(r.Context(), q, opts, tStart); err != nil {
+		return pctx, http.StatusInternalServerError, err
+	}
+	pctx.BoltDur = time.Since(tStart)
+	return pctx, http.StatusOK, nil
 }
 
-type ApiIndexRet struct {
+// With links to the index page with the same query, but with key set to value.
+// An empty value removes the key.
+func (p IndexPageCtx) With(key, value string) string {
+	qv := url.Values{}
+	for k, vs := range p.Query {
+		qv[k] = vs
+	}
+	if value == "" {
+		qv.Del(key)
+	} else {
+		qv.Set(key, value)
+	}
+	return "/?" + qv.Encode()
+}
+
+// Hidden returns the query parameters that aren't part of the filter, for the
+// filter form to keep.
+func (p IndexPageCtx) Hidden() url.Values {
+	qv := url.Values{}
+	for k, vs := range p.Query {
+		qv[k] = vs
+	}
+	for _, k := range filterParams {
+		qv.Del(k)
+	}
+	return qv
+}
+
+// Toggle is like With, but removes the key if it already has the value.
+func (p IndexPageCtx) Toggle(key, value string) string {
+	if p.Query.Get(key) == value {
+		return p.With(key, "")
+	}
+	return p.With(key, value)
+}
+
+func indexPage(w http.ResponseWriter, r *http.Request) {
+	pctx, code, err := queryIndex(r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	tmpl := r.Context().Value(ctxIdxTmpl).(*template.Template)
+	var buf bytes.Buffer
+	_, sp := tracer.Start(r.Context(), "render")
+	err = tmpl.Execute(&buf, pctx)
+	endSpan(sp, err)
+	if err != nil {
+		http.Error(w, "Some error with templates: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// trendingLangs renders only the sections of the languages in the langs of
+// the fragment parameter, as the index page with the same query has them. The
+// page updates itself with them as new scrapes come in.
+func trendingLangs(w http.ResponseWriter, r *http.Request) {
+	want := make(map[string]bool)
+	for _, n := range strings.Split(r.URL.Query().Get("fragment"), ",") {
+		want[n] = true
+	}
+	pctx, code, err := queryIndex(r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	tmpl := r.Context().Value(ctxIdxTmpl).(*template.Template)
+	var buf bytes.Buffer
+	_, sp := tracer.Start(r.Context(), "render")
+	for _, l := range pctx.Langs {
+		if !want[l.Lang.StoreName] {
+			continue
+		}
+		if err = tmpl.ExecuteTemplate(&buf, "trending-lang", l); err != nil {
+			break
+		}
+	}
+	endSpan(sp, err)
+	if err != nil {
+		http.Error(w, "Some error with templates: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+func apiIndex(w http.ResponseWriter, r *http.Request) {
+	pctx, code, err := queryIndex(r)
+	if err != nil {
+		apiError(w, err.Error(), code)
+		return
+	}
+	writeJSON(w, http.StatusOK, pctx)
+}
+
+// ApiError is the body of the error responses of the API.
+type ApiError struct {
+	Error  string
+	Status int
+}
+
+// apiError is like http.Error, but for the API, so the body is JSON.
+func apiError(w http.ResponseWriter, msg string, code int) {
+	bb, _ := json.Marshal(ApiError{Error: msg, Status: code})
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(bb)
+}
+
+// writeJSON responds with v as JSON.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	bb, err := json.Marshal(v)
+	if err != nil {
+		apiError(w, "Couldn't serialize json: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	// TODO(rHermes): Log errors here somewhere?
+	w.Write(bb)
+}
+
+type StatsPageCtx struct {
 	Periods []string
 	Period  string
-	Langs   []LanguageScrape
+	Stats   Leaderboards
 	BoltDur time.Duration
 }
 
-func indexPage(w http.ResponseWriter, r *http.Request) {
+// queryLeaderboards computes the leaderboards for the langs, period, since, until
+// and limit query parameters.
+func queryLeaderboards(r *http.Request) (StatsPageCtx, int, error) {
 	c := r.Context().Value(ctxCrawler).(*Crawler)
-
 	qv := r.URL.Query()
-	qLangs := strings.Split(qv.Get("langs"), ",")
-	qPeriod := qv.Get("period")
 
-	var pctx IndexPageCtx
+	pctx := StatsPageCtx{
+		Periods: []string{PeriodDaily, PeriodWeekly, PeriodMonthly},
+		Period:  qv.Get("period"),
+	}
+	f, err := parseRecordFilter(qv.Get("langs"), pctx.Period, qv.Get("since"), qv.Get("until"))
+	if err != nil {
+		return pctx, http.StatusBadRequest, err
+	}
+	limit := DefaultStatsLimit
+	if s := qv.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			return pctx, http.StatusBadRequest, fmt.Errorf("Invalid limit: %s", s)
+		}
+	}
+
+	tStart := time.Now()
+	if pctx.Stats, err = c.Leaderboards(f, limit); err != nil {
+		return pctx, http.StatusInternalServerError, err
+	}
+	pctx.BoltDur = time.Since(tStart)
+	return pctx, http.StatusOK, nil
+}
 
-	switch qPeriod {
-	case PeriodDaily, PeriodMonthly, PeriodWeekly:
-		pctx.Period = qPeriod
-	default:
-		pctx.Period = PeriodDaily
+func statsPage(w http.ResponseWriter, r *http.Request) {
+	pctx, code, err := queryLeaderboards(r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
 	}
-	pctx.Periods = []string{PeriodDaily, PeriodWeekly, PeriodMonthly}
 
-	var fs []Language
-	var err error
-	if qv.Get("langs") == "" {
-		fs, err = c.Follows()
+	tmpl := r.Context().Value(ctxStatsTmpl).(*template.Template)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, pctx); err != nil {
+		http.Error(w, "Some error with templates: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+func apiStats(w http.ResponseWriter, r *http.Request) {
+	pctx, code, err := queryLeaderboards(r)
+	if err != nil {
+		apiError(w, err.Error(), code)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pctx.Stats)
+}
+
+// queryLangs returns the languages in the langs query parameter, or the followed
+// ones if there is none.
+func queryLangs(r *http.Request) ([]Language, int, error) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	if s := r.URL.Query().Get("langs"); s != "" {
+		fs, err := parseLangs(s)
 		if err != nil {
-			http.Error(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
+			return nil, http.StatusBadRequest, err
+		}
+		return fs, http.StatusOK, nil
+	}
+	fs, err := c.Follows()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return fs, http.StatusOK, nil
+}
+
+// apiBreakouts returns the breakouts among the followed languages, or the ones
+// given in langs.
+func apiBreakouts(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	opts := r.Context().Value(ctxOptions).(WebsiteOptions)
+
+	fs, code, err := queryLangs(r)
+	if err != nil {
+		apiError(w, err.Error(), code)
+		return
+	}
+
+	bs := []Breakout{}
+	if len(fs) != 0 {
+		if bs, err = c.Breakouts(fs, opts.Breakouts, time.Now()); err != nil {
+			apiError(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-	} else {
-		seenLang := make(map[string]struct{}, 0)
-		for _, s := range qLangs {
-			if _, ok := seenLang[s]; ok {
-				continue
-			}
+	}
+
+	writeJSON(w, http.StatusOK, bs)
+}
+
+// Bookmark is a repo the user has bookmarked.
+type Bookmark struct {
+	RepoInfo
+	BookmarkedAt time.Time
+}
+
+type BookmarksPageCtx struct {
+	Bookmarks []Bookmark
+}
+
+// userBookmarks returns the bookmarks of the user, the latest first.
+func userBookmarks(r *http.Request) ([]Bookmark, error) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	marks, err := c.Marks(markUser(r))
+	if err != nil {
+		return nil, err
+	}
+
+	bs := []Bookmark{}
+	for k, rm := range marks {
+		at, ok := rm[MarkBookmarked]
+		if !ok {
+			continue
+		}
+		owner, name, _ := strings.Cut(k, "/")
+		ri, err := c.Repo(owner, name)
+		if err == ErrUnknownRepo {
+			ri = RepoInfo{Owner: owner, Name: name}
+		} else if err != nil {
+			return nil, err
+		}
+		bs = append(bs, Bookmark{RepoInfo: ri, BookmarkedAt: at})
+	}
+	sort.Slice(bs, func(i, j int) bool {
+		if !bs[i].BookmarkedAt.Equal(bs[j].BookmarkedAt) {
+			return bs[i].BookmarkedAt.After(bs[j].BookmarkedAt)
+		}
+		return bs[i].Owner+"/"+bs[i].Name < bs[j].Owner+"/"+bs[j].Name
+	})
+	return bs, nil
+}
+
+func bookmarksPage(w http.ResponseWriter, r *http.Request) {
+	bs, err := userBookmarks(r)
+	if err != nil {
+		http.Error(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := r.Context().Value(ctxBookmarksTmpl).(*template.Template)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, BookmarksPageCtx{Bookmarks: bs}); err != nil {
+		http.Error(w, "Some error with templates: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+func apiBookmarks(w http.ResponseWriter, r *http.Request) {
+	bs, err := userBookmarks(r)
+	if err != nil {
+		apiError(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, bs)
+}
+
+func apiMarks(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	marks, err := c.Marks(markUser(r))
+	if err != nil {
+		apiError(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, marks)
+}
+
+// apiSetMark marks the repo on PUT, and removes the mark on DELETE.
+func apiSetMark(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+
+	m, err := parseMark(chi.URLParam(r, "mark"))
+	if err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	owner, name := chi.URLParam(r, "owner"), chi.URLParam(r, "name")
+	if owner == "" || name == "" {
+		apiError(w, "Invalid repository", http.StatusBadRequest)
+		return
+	}
 
-			f, ok := StoreToLang[s]
-			if !ok {
-				http.Error(w, "Invalid language specified.", http.StatusBadRequest)
+	on := r.Method == http.MethodPut
+	if err := c.SetMark(markUser(r), m, owner, name, on); err != nil {
+		apiError(w, "Some error with saving: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userCookie is the cookie holding the token marks are stored under.
+const userCookie = "trendhub-user"
+
+// browserUser finds the user of the request from the X-Trendhub-User header or
+// the user cookie. Browsers without one are given a new token.
+func browserUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.Header.Get("X-Trendhub-User")
+		if user == "" {
+			if ck, err := r.Cookie(userCookie); err == nil {
+				user = ck.Value
+			}
+		}
+		if !validUser(user) {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				http.Error(w, "Couldn't make a user token: "+err.Error(), http.StatusInternalServerError)
 				return
 			}
-			seenLang[s] = struct{}{}
-			fs = append(fs, f)
+			user = hex.EncodeToString(b)
+			http.SetCookie(w, &http.Cookie{
+				Name:     userCookie,
+				Value:    user,
+				Path:     "/",
+				MaxAge:   365 * 24 * 60 * 60,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
 		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxUser, user)))
+	})
+}
 
+// markUser returns who the marks of the request belong to. Those who have
+// logged in keep theirs wherever they log in from. The prefix can't be in a
+// browser token, so nobody can pass for them with the header.
+func markUser(r *http.Request) string {
+	if p := principal(r); p != nil {
+		return "principal:" + p.Name
 	}
+	return r.Context().Value(ctxUser).(string)
+}
 
-	tStart := time.Now()
+// maxNoteLength is the longest note text we store.
+const maxNoteLength = 10000
 
-	for _, f := range fs {
-		tis, ts, err := c.Latest(f, pctx.Period)
-		if err != nil {
-			// TODO(rHermes): Create some kind of blank page when we have no scrape?
-			if err == ErrNoScrapesForLang || err == ErrNoScrapesForPeriod {
-				continue
-			}
-			http.Error(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
-			return
+// saveNote saves a new version of the note of the repo in the URL. The author is
+// the user, unless given.
+func saveNote(r *http.Request, text string, tags []string, author string) (Note, int, error) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+
+	n := Note{
+		Owner:    chi.URLParam(r, "owner"),
+		Name:     chi.URLParam(r, "name"),
+		Text:     strings.TrimSpace(text),
+		Tags:     normalizeTags(tags),
+		Author:   strings.TrimSpace(author),
+		EditedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if !validRepoName(n.Owner, n.Name) {
+		return n, http.StatusBadRequest, errors.New("Invalid repository")
+	}
+	if len(n.Text) > maxNoteLength {
+		return n, http.StatusBadRequest, fmt.Errorf("The note is longer than %d bytes", maxNoteLength)
+	}
+	if n.Author == "" {
+		if p := principal(r); p != nil {
+			n.Author = p.Name
+		} else {
+			n.Author = r.Context().Value(ctxUser).(string)
 		}
-		pctx.Langs = append(pctx.Langs, LanguageScrape{
-			Lang:    f,
-			Items:   tis,
-			Scraped: ts,
-		})
 	}
-	pctx.BoltDur = time.Since(tStart)
+	if err := c.SaveNote(n); err != nil {
+		return n, http.StatusInternalServerError, err
+	}
+	return n, http.StatusCreated, nil
+}
 
-	tmpl := r.Context().Value(ctxIdxTmpl).(*template.Template)
+type RepoPageCtx struct {
+	Repo RepoInfo
+	// Known is set if the repo has been trending.
+	Known bool
+	Note  Note
+	// History is the versions of the note, the latest first.
+	History []Note
+}
+
+func repoPage(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	owner, name := chi.URLParam(r, "owner"), chi.URLParam(r, "name")
+	// Notes can be kept on repos that haven't been trending, but only on
+	// those that could exist.
+	if !validRepoName(owner, name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	pctx := RepoPageCtx{Known: true}
+	var err error
+	pctx.Repo, err = c.Repo(owner, name)
+	if err == ErrUnknownRepo {
+		pctx.Repo = RepoInfo{Owner: owner, Name: name}
+		pctx.Known = false
+	} else if err != nil {
+		http.Error(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h, err := c.NoteHistory(owner, name)
+	if err != nil {
+		http.Error(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := len(h) - 1; i >= 0; i-- {
+		pctx.History = append(pctx.History, h[i])
+	}
+	if len(h) != 0 {
+		pctx.Note = h[len(h)-1]
+	}
+
+	tmpl := r.Context().Value(ctxRepoTmpl).(*template.Template)
 	var buf bytes.Buffer
 	if err := tmpl.Execute(&buf, pctx); err != nil {
 		http.Error(w, "Some error with templates: "+err.Error(), http.StatusInternalServerError)
@@ -127,89 +583,426 @@ func indexPage(w http.ResponseWriter, r *http.Request) {
 	buf.WriteTo(w)
 }
 
-func apiIndex(w http.ResponseWriter, r *http.Request) {
+// repoNoteForm saves the note from the form on the repo page.
+func repoNoteForm(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, code, err := saveNote(r, r.PostForm.Get("text"), []string{r.PostForm.Get("tags")}, r.PostForm.Get("author"))
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	http.Redirect(w, r, "/repos/"+n.Owner+"/"+n.Name, http.StatusSeeOther)
+}
+
+func apiRepoNotes(w http.ResponseWriter, r *http.Request) {
 	c := r.Context().Value(ctxCrawler).(*Crawler)
+	h, err := c.NoteHistory(chi.URLParam(r, "owner"), chi.URLParam(r, "name"))
+	if err != nil {
+		apiError(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if h == nil {
+		h = []Note{}
+	}
 
-	qv := r.URL.Query()
-	qLangs := strings.Split(qv.Get("langs"), ",")
-	qPeriod := qv.Get("period")
+	writeJSON(w, http.StatusOK, h)
+}
 
-	var pctx IndexPageCtx
+// apiSaveRepoNote saves a note given as JSON with Text, Tags and Author.
+func apiSaveRepoNote(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Text   string
+		Tags   []string
+		Author string
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 2*maxNoteLength)).Decode(&in); err != nil {
+		apiError(w, "Invalid note: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, code, err := saveNote(r, in.Text, in.Tags, in.Author)
+	if err != nil {
+		apiError(w, err.Error(), code)
+		return
+	}
+
+	writeJSON(w, code, n)
+}
+
+type NotesPageCtx struct {
+	Q     string
+	Tag   string
+	Notes []Note
+}
 
-	switch qPeriod {
-	case PeriodDaily, PeriodMonthly, PeriodWeekly:
-		pctx.Period = qPeriod
-	default:
-		pctx.Period = PeriodDaily
+// queryNotes returns the notes matching the q and tag query parameters.
+func queryNotes(r *http.Request) (NotesPageCtx, error) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	pctx := NotesPageCtx{
+		Q:     r.URL.Query().Get("q"),
+		Tag:   r.URL.Query().Get("tag"),
+		Notes: []Note{},
 	}
-	pctx.Periods = []string{PeriodDaily, PeriodWeekly, PeriodMonthly}
 
-	var fs []Language
-	var err error
-	if qv.Get("langs") == "" {
-		fs, err = c.Follows()
-		if err != nil {
-			http.Error(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
-			return
+	ns, err := c.Notes()
+	if err != nil {
+		return pctx, err
+	}
+	for _, n := range ns {
+		if matchNote(n, pctx.Q, pctx.Tag) {
+			pctx.Notes = append(pctx.Notes, n)
 		}
-	} else {
-		seenLang := make(map[string]struct{}, 0)
-		for _, s := range qLangs {
-			if _, ok := seenLang[s]; ok {
-				continue
-			}
+	}
+	return pctx, nil
+}
 
-			f, ok := StoreToLang[s]
-			if !ok {
-				http.Error(w, "Invalid language specified.", http.StatusBadRequest)
-				return
-			}
-			seenLang[s] = struct{}{}
-			fs = append(fs, f)
+func notesPage(w http.ResponseWriter, r *http.Request) {
+	pctx, err := queryNotes(r)
+	if err != nil {
+		http.Error(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := r.Context().Value(ctxNotesTmpl).(*template.Template)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, pctx); err != nil {
+		http.Error(w, "Some error with templates: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+func apiNotes(w http.ResponseWriter, r *http.Request) {
+	pctx, err := queryNotes(r)
+	if err != nil {
+		apiError(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pctx.Notes)
+}
+
+// DefaultSearchLimit is how many search results are shown when not asked for.
+const DefaultSearchLimit = 50
+
+type SearchPageCtx struct {
+	Q       string
+	Langs   string
+	Periods []string
+	Period  string
+	Since   string
+	Until   string
+	Results []SearchResult
+}
+
+// querySearch searches for q with the langs, period, since, until and limit
+// query parameters. An empty q gives no results, rather than an error.
+func querySearch(r *http.Request) (SearchPageCtx, int, error) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	qv := r.URL.Query()
+	pctx := SearchPageCtx{
+		Q:       qv.Get("q"),
+		Langs:   qv.Get("langs"),
+		Periods: []string{PeriodDaily, PeriodWeekly, PeriodMonthly},
+		Period:  qv.Get("period"),
+		Since:   qv.Get("since"),
+		Until:   qv.Get("until"),
+		Results: []SearchResult{},
+	}
+
+	f, err := parseRecordFilter(pctx.Langs, pctx.Period, pctx.Since, pctx.Until)
+	if err != nil {
+		return pctx, http.StatusBadRequest, err
+	}
+	limit := DefaultSearchLimit
+	if s := qv.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			return pctx, http.StatusBadRequest, fmt.Errorf("Invalid limit: %s", s)
 		}
+	}
 
+	rs, err := c.Search(pctx.Q, f, limit)
+	if err == ErrEmptyQuery {
+		return pctx, http.StatusOK, nil
+	} else if err != nil {
+		return pctx, http.StatusInternalServerError, err
+	}
+	pctx.Results = rs
+	return pctx, http.StatusOK, nil
+}
+
+func searchPage(w http.ResponseWriter, r *http.Request) {
+	pctx, code, err := querySearch(r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	tmpl := r.Context().Value(ctxSearchTmpl).(*template.Template)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, pctx); err != nil {
+		http.Error(w, "Some error with templates: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+func apiSearch(w http.ResponseWriter, r *http.Request) {
+	pctx, code, err := querySearch(r)
+	if err != nil {
+		apiError(w, err.Error(), code)
+		return
 	}
 
+	writeJSON(w, http.StatusOK, pctx.Results)
+}
+
+type OverlapPageCtx struct {
+	Repos   []RepoFeeds
+	BoltDur time.Duration
+}
+
+func queryOverlap(r *http.Request) (OverlapPageCtx, int, error) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	var pctx OverlapPageCtx
+
+	fs, code, err := queryLangs(r)
+	if err != nil {
+		return pctx, code, err
+	}
 	tStart := time.Now()
+	if pctx.Repos, err = c.Overlap(fs); err != nil {
+		return pctx, http.StatusInternalServerError, err
+	}
+	pctx.BoltDur = time.Since(tStart)
+	return pctx, http.StatusOK, nil
+}
+
+func overlapPage(w http.ResponseWriter, r *http.Request) {
+	pctx, code, err := queryOverlap(r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	tmpl := r.Context().Value(ctxOverlapTmpl).(*template.Template)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, pctx); err != nil {
+		http.Error(w, "Some error with templates: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+func apiOverlap(w http.ResponseWriter, r *http.Request) {
+	pctx, code, err := queryOverlap(r)
+	if err != nil {
+		apiError(w, err.Error(), code)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pctx.Repos)
+}
+
+func apiFollows(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	fs, err := c.Follows()
+	if err != nil {
+		apiError(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
+	names := []string{}
 	for _, f := range fs {
-		tis, ts, err := c.Latest(f, pctx.Period)
-		if err != nil {
-			// TODO(rHermes): Create some kind of blank page when we have no scrape?
-			if err == ErrNoScrapesForLang || err == ErrNoScrapesForPeriod {
-				continue
-			}
-			http.Error(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
+		names = append(names, f.StoreName)
+	}
+	writeJSON(w, http.StatusOK, names)
+}
+
+// apiSetFollow follows the language on PUT, and unfollows it on DELETE.
+func apiSetFollow(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+
+	l, ok := StoreToLang[chi.URLParam(r, "lang")]
+	if !ok {
+		apiError(w, "Unknown language: "+chi.URLParam(r, "lang"), http.StatusBadRequest)
+		return
+	}
+	var err error
+	if r.Method == http.MethodPut {
+		err = c.Follow(l)
+	} else {
+		err = c.Unfollow(l)
+	}
+	if err != nil {
+		apiError(w, "Some error with saving: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiRefresh refreshes the followed languages, and responds when it is done.
+func apiRefresh(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	// The refresh isn't stopped if the client gives up waiting for it.
+	if err := c.Refresh(context.WithoutCancel(r.Context())); err != nil {
+		apiError(w, "Couldn't refresh: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiExport is the export command over http, with the format, langs, period,
+// since and until query parameters.
+func apiExport(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	qv := r.URL.Query()
+
+	f, err := parseRecordFilter(qv.Get("langs"), qv.Get("period"), qv.Get("since"), qv.Get("until"))
+	if err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := qv.Get("format")
+	if format == "" {
+		format = FormatJSONL
+	}
+	rw, err := NewRecordWriter(format, w)
+	if err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trendhub.`+format+`"`)
+	err = c.ForEachRecord(f, rw.Write)
+	if err == nil {
+		err = rw.Close()
+	}
+	if err != nil {
+		// We have already started writing, so all we can do is cut it short.
+		slog.ErrorContext(r.Context(), "Couldn't write export", "err", err)
+	}
+}
+
+// FollowChoice is a language on the follows page.
+type FollowChoice struct {
+	Lang     Language
+	Followed bool
+}
+
+type FollowsPageCtx struct {
+	Langs []FollowChoice
+	Saved bool
+}
+
+// adminFollowsPage shows every language we know of, with the followed ones
+// checked.
+func adminFollowsPage(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+	fs, err := c.Follows()
+	if err != nil {
+		http.Error(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	followed := make(map[string]bool, len(fs))
+	for _, f := range fs {
+		followed[f.StoreName] = true
+	}
+	pctx := FollowsPageCtx{Saved: r.URL.Query().Get("saved") != ""}
+	for _, k := range sortedKeys(StoreToLang) {
+		pctx.Langs = append(pctx.Langs, FollowChoice{Lang: StoreToLang[k], Followed: followed[k]})
+	}
+
+	tmpl := r.Context().Value(ctxFollowsTmpl).(*template.Template)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, pctx); err != nil {
+		http.Error(w, "Some error with templates: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// adminFollowsForm makes the checked languages of the follows page the
+// followed ones.
+func adminFollowsForm(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	want := make(map[string]bool)
+	for _, n := range r.PostForm["lang"] {
+		if _, ok := StoreToLang[n]; !ok {
+			http.Error(w, "Unknown language: "+n, http.StatusBadRequest)
 			return
 		}
-		pctx.Langs = append(pctx.Langs, LanguageScrape{
-			Lang:    f,
-			Items:   tis,
-			Scraped: ts,
-		})
+		want[n] = true
 	}
-	pctx.BoltDur = time.Since(tStart)
-
-	bb, err := json.Marshal(pctx)
+	fs, err := c.Follows()
 	if err != nil {
-		http.Error(w, "Couldn't serialize json: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Some error with loading: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
-	w.Header().Set("content-type", "application/json")
-	// TODO(rHermes): Log errors here somewhere?
-	w.Write(bb)
+	for _, f := range fs {
+		if want[f.StoreName] {
+			delete(want, f.StoreName)
+			continue
+		}
+		if err := c.Unfollow(f); err != nil {
+			http.Error(w, "Some error with saving: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, k := range sortedKeys(want) {
+		if err := c.Follow(StoreToLang[k]); err != nil {
+			http.Error(w, "Some error with saving: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	http.Redirect(w, r, "/admin/follows?saved=1", http.StatusSeeOther)
 }
 
-func NewWebsite(c *Crawler) http.Handler {
+func adminBackup(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(ctxCrawler).(*Crawler)
+
+	compress := r.URL.Query().Get("gzip") != ""
+	name := "trendhub-" + time.Now().UTC().Format("20060102T150405Z") + ".db"
+	if compress {
+		name += ".gz"
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if _, err := c.Backup(w, compress); err != nil {
+		// We have already started writing, so all we can do is cut it short.
+		slog.ErrorContext(r.Context(), "Couldn't write backup", "err", err)
+	}
+}
+
+func NewWebsite(c *Crawler, opts WebsiteOptions) http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
+	r.Use(httpTracing)
+	r.Use(httpMetrics)
 	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
+	r.Use(requestLogger)
 	r.Use(middleware.Recoverer)
 
 	// r.Use(middleware.NewCompressor(flate.BestSpeed))
 	r.Use(middleware.Compress(flate.BestCompression))
 
 	r.Use(middleware.WithValue(ctxCrawler, c))
+	r.Use(middleware.WithValue(ctxOptions, opts))
 
 	// Here we create the templates
 	lt := template.Must(template.ParseFiles(
@@ -219,14 +1012,93 @@ func NewWebsite(c *Crawler) http.Handler {
 		"templates/trending-lang.html.tmpl",
 		"templates/trending-item.html.tmpl",
 	))
-	indexTemplate := template.Must(lt.ParseFiles("templates/index.html.tmpl"))
+	indexTemplate := template.Must(template.Must(lt.Clone()).ParseFiles("templates/index.html.tmpl"))
+	statsTemplate := template.Must(template.Must(lt.Clone()).ParseFiles("templates/stats.html.tmpl"))
+	overlapTemplate := template.Must(template.Must(lt.Clone()).ParseFiles("templates/overlap.html.tmpl"))
+	bookmarksTemplate := template.Must(template.Must(lt.Clone()).ParseFiles("templates/bookmarks.html.tmpl"))
+	repoTemplate := template.Must(template.Must(lt.Clone()).ParseFiles("templates/repo.html.tmpl"))
+	notesTemplate := template.Must(template.Must(lt.Clone()).ParseFiles("templates/notes.html.tmpl"))
+	searchTemplate := template.Must(template.Must(lt.Clone()).ParseFiles("templates/search.html.tmpl"))
+	followsTemplate := template.Must(template.Must(lt.Clone()).ParseFiles("templates/follows.html.tmpl"))
 
 	r.Use(middleware.WithValue(ctxIdxTmpl, indexTemplate))
+	r.Use(middleware.WithValue(ctxStatsTmpl, statsTemplate))
+	r.Use(middleware.WithValue(ctxOverlapTmpl, overlapTemplate))
+	r.Use(middleware.WithValue(ctxBookmarksTmpl, bookmarksTemplate))
+	r.Use(middleware.WithValue(ctxRepoTmpl, repoTemplate))
+	r.Use(middleware.WithValue(ctxNotesTmpl, notesTemplate))
+	r.Use(middleware.WithValue(ctxSearchTmpl, searchTemplate))
+	r.Use(middleware.WithValue(ctxFollowsTmpl, followsTemplate))
+	r.Use(browserUser)
+	r.Use(opts.Auth.Authenticate)
+	r.Use(checkOrigin)
 
 	workDir, _ := os.Getwd()
 	staticDir := filepath.Join(workDir, "static")
-	r.Get("/", indexPage)
-	r.Get("/api/v1/trending", apiIndex)
+	// Monitoring has to reach these without logging in.
+	r.Get("/healthz", healthz)
+	r.Get("/readyz", readyz)
+
+	// Looking is open to everyone, unless the site is private.
+	read := func(next http.Handler) http.Handler { return next }
+	if opts.Auth.Private {
+		read = opts.Auth.Require(RoleReader)
+	}
+
+	r.Group(func(r chi.Router) {
+		r.Use(read)
+		r.Get("/", indexPage)
+		r.Get("/fragments/trending-langs", trendingLangs)
+		r.Get("/stats", statsPage)
+		r.Get("/overlap", overlapPage)
+		r.Get("/bookmarks", bookmarksPage)
+		r.Get("/notes", notesPage)
+		r.Get("/search", searchPage)
+		r.Get("/repos/{owner}/{name}", repoPage)
+		r.Get("/api/v1/trending", apiIndex)
+		r.Get("/api/v1/stats", apiStats)
+		r.Get("/api/v1/breakouts", apiBreakouts)
+		r.Get("/api/v1/overlap", apiOverlap)
+		r.Get("/api/v1/bookmarks", apiBookmarks)
+		r.Get("/api/v1/notes", apiNotes)
+		r.Get("/api/v1/search", apiSearch)
+		r.Get("/api/v1/repos/{owner}/{name}/notes", apiRepoNotes)
+		r.Get("/api/v1/follows", apiFollows)
+		r.Get("/api/v1/export", apiExport)
+		r.Get("/api/v1/events", apiEvents)
+		r.Get("/api/v1/marks", apiMarks)
+
+		r.Route("/api/v2", v2Routes())
+
+		r.Method(http.MethodGet, "/metrics", metricsHandler(c))
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(opts.Auth.Require(RoleReader))
+		r.Put("/api/v1/marks/{mark}/{owner}/{name}", apiSetMark)
+		r.Delete("/api/v1/marks/{mark}/{owner}/{name}", apiSetMark)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(opts.Auth.Require(RoleAdmin))
+		r.Post("/repos/{owner}/{name}", repoNoteForm)
+		r.Post("/api/v1/repos/{owner}/{name}/notes", apiSaveRepoNote)
+		r.Put("/api/v1/follows/{lang}", apiSetFollow)
+		r.Delete("/api/v1/follows/{lang}", apiSetFollow)
+		r.Post("/api/v1/refresh", apiRefresh)
+
+		r.Route("/admin", func(r chi.Router) {
+			r.Get("/backup", adminBackup)
+			r.Get("/follows", adminFollowsPage)
+			r.Post("/follows", adminFollowsForm)
+		})
+	})
+
+	if o := opts.Auth.OIDC; o != nil {
+		r.Get("/auth/login", o.login)
+		r.Get("/auth/callback", o.callback)
+		r.Get("/auth/logout", o.logout)
+	}
 
 	FileServer(r, "/static", http.Dir(staticDir))
 
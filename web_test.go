@@ -0,0 +1,304 @@
+// Copyright 2019 Teodor Spæren
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// evil is what a scrape, an import or a note could hold to attack the pages.
+const evil = `<img src=x onerror=alert(1)>`
+
+// get makes a request to the website as the user, and returns the response.
+func get(t *testing.T, h http.Handler, user, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if user != "" {
+		req.Header.Set("X-Trendhub-User", user)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPagesEscape(t *testing.T) {
+	c, err := NewCrawler("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Follow(LangGo); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	err = c.SaveScrape(Scrape{Lang: LangGo, TakenAt: ts, Periods: map[string][]TrendingItem{
+		PeriodDaily: {{RepoOwner: "o", RepoName: "r", Description: evil, Language: evil, Stars: 1}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SaveNote(Note{Owner: "o", Name: "r", Text: evil, Tags: []string{evil}, Author: evil, EditedAt: ts}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetMark("tester", MarkBookmarked, "o", "r", true); err != nil {
+		t.Fatal(err)
+	}
+	h := NewWebsite(c, WebsiteOptions{})
+
+	for _, path := range []string{
+		"/", "/?q=" + evil, "/stats", "/overlap", "/bookmarks", "/notes", "/notes?q=" + evil,
+		"/search?q=r", "/search?q=" + evil, "/repos/o/r",
+	} {
+		rec := get(t, h, "tester", strings.ReplaceAll(path, " ", "%20"))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s: got status %d: %s", path, rec.Code, rec.Body)
+			continue
+		}
+		if strings.Contains(rec.Body.String(), "<img") {
+			t.Errorf("GET %s: got an unescaped tag", path)
+		}
+	}
+}
+
+func TestRepoPageNames(t *testing.T) {
+	c, err := NewCrawler("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h := NewWebsite(c, WebsiteOptions{})
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/repos/rhermes/trendhub", http.StatusOK},
+		{"/repos/some-one/name_with.dots", http.StatusOK},
+		{"/repos/%3Cimg%20src=x%20onerror=alert%281%29%3E/x", http.StatusNotFound},
+		{"/repos/o/%22quoted%22", http.StatusNotFound},
+		{"/repos/o/..", http.StatusNotFound},
+		{"/repos/" + strings.Repeat("a", 40) + "/r", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := get(t, h, "", tt.path); rec.Code != tt.code {
+			t.Errorf("GET %s: got status %d, want %d", tt.path, rec.Code, tt.code)
+		}
+	}
+}
+
+func TestMarksNeedReader(t *testing.T) {
+	c, err := NewCrawler("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h := NewWebsite(c, WebsiteOptions{Auth: Auth{Authenticators: []Authenticator{TokenAuth{
+		{Token: "alicetoken", Principal: Principal{Name: "alice", Role: RoleReader}},
+	}}}})
+
+	mark := func(token, user string) int {
+		req := httptest.NewRequest(http.MethodPut, "/api/v1/marks/bookmarked/o/r", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		req.Header.Set("X-Trendhub-User", user)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := mark("", "anon"); code != http.StatusUnauthorized {
+		t.Errorf("anonymous: got status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := mark("alicetoken", "browser1"); code != http.StatusNoContent {
+		t.Fatalf("alice: got status %d, want %d", code, http.StatusNoContent)
+	}
+
+	// The marks follow alice, not the browser used.
+	for _, user := range []string{"anon", "browser1"} {
+		ms, err := c.Marks(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ms) != 0 {
+			t.Errorf("%s: got marks %v, want none", user, ms)
+		}
+	}
+	ms, err := c.Marks("principal:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ms["o/r"][MarkBookmarked]; !ok {
+		t.Errorf("got marks %v, want o/r bookmarked", ms)
+	}
+}
+
+var (
+	itemTitleRe = regexp.MustCompile(`class="trending-item-title" href="https://github.com/([^"]+)"`)
+	indexLinkRe = regexp.MustCompile(`href="(/\?[^"]*)"`)
+)
+
+func TestIndexFilterAgrees(t *testing.T) {
+	c, err := NewCrawler("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Follow(LangGo); err != nil {
+		t.Fatal(err)
+	}
+	err = c.SaveScrape(Scrape{Lang: LangGo, TakenAt: time.Now().UTC().Truncate(time.Second), Periods: map[string][]TrendingItem{
+		PeriodDaily: {
+			{RepoOwner: "a", RepoName: "one", Description: "A fast parser", Stars: 100, StarsIncrease: 5, Forks: 1},
+			{RepoOwner: "b", RepoName: "two", Description: "Web framework", Stars: 50, StarsIncrease: 20, Forks: 9},
+			{RepoOwner: "c", RepoName: "three", Description: "Parser combinators", Stars: 300, StarsIncrease: 1, Forks: 3},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewWebsite(c, WebsiteOptions{})
+
+	for _, query := range []string{
+		"",
+		"min_stars=60",
+		"min_increase=5&sort=forks",
+		"q=parser&sort=stars&dedup=1",
+		"exclude=b&sort=increase&only=new&collapse=seen",
+		"period=daily&min_stars=10&q=a&exclude=c",
+	} {
+		page := get(t, h, "tester", "/?"+query)
+		api := get(t, h, "tester", "/api/v1/trending?"+query)
+		if page.Code != http.StatusOK || api.Code != http.StatusOK {
+			t.Errorf("%q: got status %d and %d", query, page.Code, api.Code)
+			continue
+		}
+
+		var shown []string
+		for _, m := range itemTitleRe.FindAllStringSubmatch(page.Body.String(), -1) {
+			shown = append(shown, m[1])
+		}
+		var ictx IndexPageCtx
+		if err := json.Unmarshal(api.Body.Bytes(), &ictx); err != nil {
+			t.Fatal(err)
+		}
+		var listed []string
+		for _, l := range ictx.Langs {
+			for _, it := range l.Items {
+				listed = append(listed, it.RepoOwner+"/"+it.RepoName)
+			}
+		}
+		if !reflect.DeepEqual(shown, listed) {
+			t.Errorf("%q: the page shows %v, the API lists %v", query, shown, listed)
+		}
+
+		qv, _ := url.ParseQuery(query)
+		q, err := parseTrendingQuery(qv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := IndexPageCtx{Period: q.Period, OnlyNew: q.OnlyNew, Dedup: q.Dedup, Collapse: q.Collapse, Filter: q.Filter}
+		got := IndexPageCtx{Period: ictx.Period, OnlyNew: ictx.OnlyNew, Dedup: ictx.Dedup, Collapse: ictx.Collapse, Filter: ictx.Filter}
+		if !reflect.DeepEqual(got, state) {
+			t.Errorf("%q: the API says %+v, want %+v", query, got, state)
+		}
+
+		// The links of the sidebar change one thing, and keep the rest.
+		links := indexLinkRe.FindAllStringSubmatch(page.Body.String(), -1)
+		if len(links) != 10 {
+			t.Errorf("%q: got %d links to the index, want 10", query, len(links))
+		}
+		for _, m := range links {
+			u, err := url.Parse(html.UnescapeString(m[1]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lv := u.Query()
+			changed := 0
+			for _, k := range []string{"period", "only", "dedup", "collapse", "sort", "min_stars", "min_increase", "q", "exclude"} {
+				if lv.Get(k) != qv.Get(k) {
+					changed++
+				}
+			}
+			if changed > 1 {
+				t.Errorf("%q: the link %s changes %d parameters, want at most 1", query, u, changed)
+			}
+		}
+	}
+}
+
+// langSections returns the repos shown in each language section of a page.
+func langSections(page string) map[string][]string {
+	sections := make(map[string][]string)
+	for _, part := range strings.Split(page, `<div class="trending-lang" id="lang-`)[1:] {
+		lang, _, _ := strings.Cut(part, `"`)
+		sections[lang] = []string{}
+		for _, m := range itemTitleRe.FindAllStringSubmatch(part, -1) {
+			sections[lang] = append(sections[lang], m[1])
+		}
+	}
+	return sections
+}
+
+func TestTrendingLangsFragment(t *testing.T) {
+	c, err := NewCrawler("memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ts := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	for _, l := range []Language{LangGo, LangRust, LangRuby} {
+		if err := c.Follow(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saveTestScrape(t, c, LangGo, ts, "o", "go-repo")
+	saveTestScrape(t, c, LangRust, ts, "o", "rust-repo")
+	err = c.SaveScrape(Scrape{Lang: LangRuby, TakenAt: ts, Periods: map[string][]TrendingItem{
+		PeriodDaily: {{RepoOwner: "o", RepoName: "go-repo", Stars: 1}, {RepoOwner: "o", RepoName: "ruby-repo", Stars: 2}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewWebsite(c, WebsiteOptions{})
+
+	// The sections are the same as on the page, repeats hidden and all.
+	query := "dedup=1&sort=stars"
+	page := get(t, h, "tester", "/?"+query)
+	rec := get(t, h, "tester", "/fragments/trending-langs?fragment=go,ruby&"+query)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "<html") {
+		t.Errorf("got a whole page: %s", rec.Body)
+	}
+	want := langSections(page.Body.String())
+	delete(want, "rust")
+	if got := langSections(rec.Body.String()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got sections %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(want["ruby"], []string{"o/ruby-repo"}) {
+		t.Errorf("got ruby section %v, want only o/ruby-repo", want["ruby"])
+	}
+}